@@ -1,19 +1,158 @@
 package main
 
 import (
+	"bytes"
 	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
 )
 
-func listenForEvents() {
-	defer fmt.Printf("stopped listening\n")
-	events := pubsub.Bus.Subscribe()
+// replayTimeLayout is the layout of the UTC time from which the events can be replayed.
+const replayTimeLayout = "2006-01-02 15:04:05"
 
-	for event := range events {
-		if event.ID < 1 {
-			fmt.Printf("<%s>: [error] %s\n", event.Timestamp.Format("2006-01-02 15:04:05:000"), event.Data)
-		} else if _, ok := selectedIds[event.ID]; ok {
-			fmt.Printf("<%s>: [%d]: %s\n", event.Timestamp.Format("2006-01-02 15:04:05:000"), event.ID, event.Data)
+// lastCursors are the cursors of the last received event of each account, so listening can continue where it stopped.
+//
+// Every account has its own stream and the cursors of different streams can't be compared,
+// so a single cursor could skip the events of the other accounts.
+var lastCursors = map[int]string{}
+
+// parseReplay parses the point from which the events should be replayed.
+//
+// It can be a duration (events from that long ago), UTC time, event cursor or "last" for the last received event
+// of each account. Empty input doesn't replay any events.
+func parseReplay(from string) (pubsub.Replay, error) {
+	from = strings.TrimSpace(from)
+
+	switch from {
+	case "":
+		return pubsub.Replay{}, nil
+	case "last":
+		if len(lastCursors) == 0 {
+			return pubsub.Replay{}, errors.New("no events were received yet")
+		}
+
+		// accounts without a received event only receive the new events
+		cursors := make(map[int]string, len(lastCursors))
+		for accountID, cursor := range lastCursors {
+			cursors[accountID] = cursor
+		}
+
+		return pubsub.Replay{Cursors: cursors}, nil
+	}
+
+	if d, err := time.ParseDuration(from); err == nil {
+		if d < 0 {
+			return pubsub.Replay{}, fmt.Errorf("%q should be a positive duration", from)
+		}
+
+		return pubsub.Replay{Since: time.Now().Add(-d)}, nil
+	}
+
+	if t, err := time.Parse(replayTimeLayout, from); err == nil {
+		return pubsub.Replay{Since: t}, nil
+	}
+
+	return pubsub.Replay{After: from}, nil
+}
+
+// listenForEvents prints the events of the selected accounts until Ctrl+C is pressed,
+// starting with the events since the replay point.
+func listenForEvents(replay pubsub.Replay) {
+	sub, err := pubsub.Bus.Subscribe(context.Background(), replay, selectedAccounts()...)
+	if err != nil {
+		fmt.Printf("Error subscribing to events: %v\n", err)
+		return
+	}
+	defer func() {
+		if len(lastCursors) > 0 {
+			fmt.Printf("stopped listening, last events: %s\n", formatCursors(lastCursors))
+		} else {
+			fmt.Printf("stopped listening\n")
+		}
+	}()
+
+	// Ctrl+C stops listening and returns to the prompt instead of exiting
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	go func() {
+		<-interrupt
+		sub.Close()
+	}()
+
+	events, statuses := sub.Events(), sub.Status()
+	for events != nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+
+			fmt.Println(formatEvent(event))
+
+			if event.Cursor != "" {
+				lastCursors[event.AccountID] = event.Cursor
+			}
+		case status, ok := <-statuses:
+			if !ok {
+				statuses = nil
+				break
+			}
+
+			printStatus(status)
+		}
+	}
+}
+
+// formatCursors formats the cursors of the last received events ordered by the account ID, e.g. [1]: 1612632939000-0.
+func formatCursors(cursors map[int]string) string {
+	accountIDs := make([]int, 0, len(cursors))
+	for accountID := range cursors {
+		accountIDs = append(accountIDs, accountID)
+	}
+	sort.Ints(accountIDs)
+
+	formatted := make([]string, 0, len(accountIDs))
+	for _, accountID := range accountIDs {
+		formatted = append(formatted, fmt.Sprintf("[%d]: %s", accountID, cursors[accountID]))
+	}
+
+	return strings.Join(formatted, ", ")
+}
+
+// formatEvent formats the event for printing, JSON payloads are indented on the lines after the header.
+func formatEvent(event *pubsub.Event) string {
+	timestamp := event.Timestamp.Format("2006-01-02 15:04:05:000")
+
+	if event.ContentType == pubsub.ContentTypeJSON {
+		buffer := &bytes.Buffer{}
+		if err := json.Indent(buffer, event.Data, "  ", "  "); err == nil {
+			return fmt.Sprintf("<%s>: [%d]: [%s]\n  %s", timestamp, event.AccountID, event.Source, buffer.String())
 		}
 	}
+
+	return fmt.Sprintf("<%s>: [%d]: %s [%s]", timestamp, event.AccountID, event.Text(), event.Source)
+}
+
+// printStatus prints the change of the subscription's health.
+func printStatus(status *pubsub.Status) {
+	timestamp := status.Timestamp.Format("2006-01-02 15:04:05:000")
+
+	switch status.Type {
+	case pubsub.StatusDisconnected:
+		fmt.Printf("<%s>: [reconnecting…] connection lost: %v\n", timestamp, status.Err)
+	case pubsub.StatusReconnected:
+		fmt.Printf("<%s>: [connected] receiving events again\n", timestamp)
+	default:
+		fmt.Printf("<%s>: [%s] %v\n", timestamp, status.Type, status.Err)
+	}
 }
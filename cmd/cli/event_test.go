@@ -0,0 +1,86 @@
+package main
+
+import (
+	"celtra-programming-assigment/pkg/pubsub"
+	"testing"
+	"time"
+)
+
+func Test_parseReplay(t *testing.T) {
+	lastCursors = map[int]string{}
+
+	replay, err := parseReplay("")
+	if err != nil || !replay.IsZero() {
+		t.Fatalf("empty input should not replay events")
+	}
+
+	replay, err = parseReplay("5m")
+	if err != nil {
+		t.Fatalf("failed to parse duration: %v", err)
+	}
+
+	if since := time.Since(replay.Since); since < 5*time.Minute || since > 6*time.Minute {
+		t.Fatalf("replay should start 5 minutes ago, started %s ago", since)
+	}
+
+	replay, err = parseReplay("2021-02-06 17:35:30")
+	if err != nil {
+		t.Fatalf("failed to parse time: %v", err)
+	}
+
+	if !replay.Since.Equal(time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC)) {
+		t.Fatalf("unexpected replay time %s", replay.Since)
+	}
+
+	replay, err = parseReplay(" 1612632930000-0 ")
+	if err != nil || replay.After != "1612632930000-0" {
+		t.Fatalf("cursor should be replayed after, got %+v", replay)
+	}
+
+	if _, err := parseReplay("-5m"); err == nil {
+		t.Fatalf("negative duration should not be accepted")
+	}
+
+	if _, err := parseReplay("last"); err == nil {
+		t.Fatalf("last should not be accepted before any event was received")
+	}
+
+	lastCursors = map[int]string{1: "1612632930000-1", 2: "1612632925000-0"}
+
+	// every account resumes after its own last event
+	replay, err = parseReplay("last")
+	if err != nil || len(replay.Cursors) != 2 || replay.Cursors[1] != lastCursors[1] || replay.Cursors[2] != lastCursors[2] {
+		t.Fatalf("last should be replayed after %v, got %+v", lastCursors, replay)
+	}
+}
+
+func Test_formatCursors(t *testing.T) {
+	cursors := map[int]string{2: "1612632925000-0", 1: "1612632930000-1"}
+
+	if formatted := formatCursors(cursors); formatted != "[1]: 1612632930000-1, [2]: 1612632925000-0" {
+		t.Fatalf("unexpected cursors %q", formatted)
+	}
+}
+
+func Test_formatEvent(t *testing.T) {
+	event, err := pubsub.NewEvent(1, "host", pubsub.ContentTypeText, []byte("test data"))
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+	event.Timestamp = time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC)
+
+	if text := formatEvent(event); text != "<2021-02-06 17:35:30:000>: [1]: test data [host]" {
+		t.Fatalf("unexpected text event %q", text)
+	}
+
+	event, err = pubsub.NewEvent(1, "host", pubsub.ContentTypeJSON, []byte(`{"key": [1, 2]}`))
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+	event.Timestamp = time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC)
+
+	expected := "<2021-02-06 17:35:30:000>: [1]: [host]\n  {\n    \"key\": [\n      1,\n      2\n    ]\n  }"
+	if text := formatEvent(event); text != expected {
+		t.Fatalf("unexpected JSON event %q", text)
+	}
+}
@@ -13,6 +13,8 @@ import (
 var (
 	redisAddr = flag.String("addr", "redis", "Redis address")
 	redisPort = flag.String("port", "6379", "Redis port")
+	busDriver = flag.String("bus", "redis", "Redis publish/subscribe (redis) or Redis Streams (streams)")
+	group     = flag.String("group", "", "Redis Streams consumer group, events are shared between the clients in the group")
 
 	commands = []string{"accounts", "events"}
 )
@@ -24,8 +26,18 @@ func main() {
 	os.Setenv("REDIS_ADDR", addr)
 	fmt.Printf("Connecting to Redis@%s\n", addr)
 
-	if err := pubsub.NewRedis(); err != nil {
-		panic(err)
+	switch *busDriver {
+	case "redis":
+		if err := pubsub.NewRedis(); err != nil {
+			panic(err)
+		}
+	case "streams":
+		os.Setenv("STREAM_GROUP", *group)
+		if err := pubsub.NewStreams(); err != nil {
+			panic(err)
+		}
+	default:
+		panic("unknown bus: " + *busDriver)
 	}
 
 	cli := liner.NewLiner()
@@ -75,9 +87,26 @@ func main() {
 				break
 			}
 
+			fmt.Printf(" replay events since a duration (e.g. 5m), UTC time (e.g. 2021-02-06 17:35:30), event cursor or \"last\"\n")
+			fmt.Printf(" press <Enter> to only receive new events\n")
+			from, err := cli.Prompt("replay >")
+			if err != nil {
+				if err == liner.ErrPromptAborted {
+					break
+				} else {
+					fmt.Printf("Error reading line: %v\n", err)
+				}
+			}
+
+			replay, err := parseReplay(from)
+			if err != nil {
+				fmt.Printf(" %v\n", err)
+				break
+			}
+
 			fmt.Printf("listening for events from: %d\n", selectedAccounts())
 
-			listenForEvents()
+			listenForEvents(replay)
 		default:
 			fmt.Printf("unrecognized command: %s\n", command)
 		}
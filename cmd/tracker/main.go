@@ -2,30 +2,232 @@ package main
 
 import (
 	"celtra-programming-assigment/cmd/tracker/rest"
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/env"
 	"celtra-programming-assigment/pkg/persistence"
 	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
+// migrateTo is the only way to revert migrations, the service itself only migrates the schema up when it starts
+var migrateTo = flag.Int("migrate", -1, "migrate the PostgreSQL schema up or down to the version and exit (0 reverts all migrations)")
+
 func init() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 }
 
 func main() {
-	// init persistence layer
-	if err := persistence.NewPostgres(); err != nil {
+	flag.Parse()
+
+	if *migrateTo >= 0 {
+		if err := persistence.MigratePostgres(*migrateTo); err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("database schema migrated to version %d", *migrateTo)
+
+		return
+	}
+
+	// init persistence layer (DB_DRIVER: postgres or memory)
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		if err := persistence.NewPostgres(); err != nil {
+			panic(err)
+		}
+	case "memory":
+		if err := persistence.NewMemory(); err != nil {
+			panic(err)
+		}
+	default:
+		panic("unknown DB_DRIVER: " + driver)
+	}
+
+	// init pubsub (BUS_DRIVER: redis, streams or memory)
+	switch driver := os.Getenv("BUS_DRIVER"); driver {
+	case "", "redis":
+		if err := pubsub.NewRedis(); err != nil {
+			panic(err)
+		}
+	case "streams":
+		if err := pubsub.NewStreams(); err != nil {
+			panic(err)
+		}
+	case "memory":
+		if err := pubsub.NewMemory(); err != nil {
+			panic(err)
+		}
+	default:
+		panic("unknown BUS_DRIVER: " + driver)
+	}
+
+	// init publish queue, published events are stored to the event log and events that can't be published
+	// are stored as dead letters
+	if err := pubsub.NewQueue(); err != nil {
+		panic(err)
+	}
+	pubsub.Queue.OnPublish = rest.Published
+	pubsub.Queue.OnDeadLetter = rest.StoreDeadLetter
+
+	// init account cache
+	if err := initCache(); err != nil {
 		panic(err)
 	}
 
-	// init pubsub
-	if err := pubsub.NewRedis(); err != nil {
+	// init event log
+	if err := persistence.NewEventLog(); err != nil {
 		panic(err)
 	}
 
-	// init REST API
-	if err := http.ListenAndServe(":8080", rest.CreateRouter()); err != nil {
+	// init REST API (INGEST_MODE: async or sync)
+	switch mode := os.Getenv("INGEST_MODE"); mode {
+	case "", rest.IngestAsync:
+	case rest.IngestSync:
+		rest.DefaultIngestMode = rest.IngestSync
+	default:
+		panic("unknown INGEST_MODE: " + mode)
+	}
+
+	// API key authentication (AUTH: enabled or disabled), ADMIN_API_KEY can be used to create the first keys
+	switch auth := os.Getenv("AUTH"); auth {
+	case "", "enabled":
+		rest.RequireAPIKeys = true
+		rest.AdminKey = os.Getenv("ADMIN_API_KEY")
+
+		if err := checkAdminKeys(); err != nil {
+			panic(err)
+		}
+	case "disabled":
+		log.Warn().Msg("API key authentication is disabled, anyone who can reach the service can use it")
+	default:
+		panic("unknown AUTH: " + auth)
+	}
+
+	// heartbeat interval of the event streams (e.g. 30s)
+	heartbeat, err := env.Duration("STREAM_HEARTBEAT", rest.HeartbeatInterval)
+	if err != nil {
+		panic(err)
+	}
+	rest.HeartbeatInterval = heartbeat
+
+	// comma separated origins of other web pages that can open a WebSocket (e.g. https://dashboard.example.com)
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		for _, origin := range strings.Split(origins, ",") {
+			rest.AllowedOrigins = append(rest.AllowedOrigins, strings.TrimSpace(origin))
+		}
+	}
+
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: rest.CreateRouter(),
+	}
+	// open event streams would keep the server from shutting down
+	server.RegisterOnShutdown(rest.CloseStreams)
+
+	go func() {
+		// wait for the stop signal and shut down gracefully, so the queued events get published and stored
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Error().Msgf("shutting down REST API: %v", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
+
+	pubsub.Queue.Close()
+	persistence.EventLog.Close()
+}
+
+// checkAdminKeys checks that API keys can be created, either with the ADMIN_API_KEY or with a stored admin key,
+// otherwise every request would be rejected.
+func checkAdminKeys() error {
+	if rest.AdminKey != "" {
+		return nil
+	}
+
+	count, err := persistence.APIKeys.CountAPIKeys(context.Background(), dto.ScopeAdmin)
+	if err != nil {
+		return fmt.Errorf("counting admin API keys: %v", err)
+	}
+
+	if count == 0 {
+		return errors.New("no admin API keys exist and ADMIN_API_KEY isn't set, so no API keys can be created " +
+			"(set ADMIN_API_KEY to a long random key or set AUTH to disabled)")
+	}
+
+	return nil
+}
+
+// initCache wraps the database with an account cache and the API key store with an API key cache, and uses
+// control messages on the bus to invalidate cached accounts and API keys on all service instances when an account
+// is changed or a key is revoked. Open sessions of revoked keys are closed as well.
+func initCache() error {
+	cache, err := persistence.NewCache()
+	if err != nil {
+		return err
+	}
+
+	keys, err := persistence.NewAPIKeyCache()
+	if err != nil {
+		return err
+	}
+
+	cache.OnChange = func(ID int) {
+		keys.InvalidateAccount(ID)
+		publishControl(&pubsub.ControlMessage{
+			Type:      pubsub.InvalidateAccount,
+			AccountID: ID,
+		})
+	}
+
+	keys.OnRevoke = func(ID int64) {
+		publishControl(&pubsub.ControlMessage{
+			Type:     pubsub.InvalidateAPIKey,
+			APIKeyID: ID,
+		})
+	}
+
+	messages := pubsub.Bus.SubscribeControl(context.Background())
+	go func() {
+		for message := range messages {
+			switch message.Type {
+			case pubsub.InvalidateAccount:
+				cache.Invalidate(message.AccountID)
+				// keys of a deleted account are revoked with it
+				keys.InvalidateAccount(message.AccountID)
+				rest.CheckAccountSessions(context.Background(), message.AccountID)
+			case pubsub.InvalidateAPIKey:
+				keys.Invalidate(message.APIKeyID)
+				rest.CloseAPIKeySessions(message.APIKeyID)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// publishControl publishes the control message to all service instances.
+func publishControl(message *pubsub.ControlMessage) {
+	if err := pubsub.Bus.PublishControl(context.Background(), message); err != nil {
+		log.Error().Msgf("publishing %s control message: %v", message.Type, err)
+	}
 }
@@ -0,0 +1,348 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/persistence"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+)
+
+// apiKeySize is the number of random bytes of a new API key
+const apiKeySize = 32
+
+// contextKey is the type of the request context keys of this package
+type contextKey int
+
+// request context keys
+const (
+	apiKeyContextKey   contextKey = iota // authenticated API key
+	queryKeyContextKey                   // set if the API key can be sent with the apiKey query parameter
+)
+
+var (
+	// RequireAPIKeys enables the API key authentication of all the routes
+	RequireAPIKeys = false
+	// AdminKey is an admin API key that isn't stored in the database and can be used to create the first keys,
+	// empty value disables it
+	AdminKey string
+
+	// errMissingAPIKey is returned when the request doesn't have an API key
+	errMissingAPIKey = errors.New("missing API key")
+	// errInvalidAPIKey is returned when the API key doesn't exist or was revoked
+	errInvalidAPIKey = errors.New("invalid API key")
+	// errQueryAPIKey is returned when the API key is sent with the query parameter to a route that doesn't accept it
+	errQueryAPIKey = errors.New("apiKey query parameter is only accepted by stream routes, use the Authorization header")
+
+	// sessions are the open event streams and WebSockets of the stored API keys
+	sessions   = map[*session]struct{}{}
+	sessionsMu sync.Mutex
+)
+
+// session is an open event stream or WebSocket, which is closed when its API key is revoked.
+type session struct {
+	key   *dto.APIKey
+	close func()
+}
+
+// authenticated wraps the handler, so it's only called with a valid API key of any scope.
+//
+// The handler can check which accounts the key can access with canAccess.
+func authenticated(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if !RequireAPIKeys {
+			handle(w, r, params)
+
+			return
+		}
+
+		key, err := authenticate(r)
+		if err != nil {
+			log.Error().Msgf("authenticating %s %s: %v", r.Method, r.URL.Path, err)
+
+			status := http.StatusInternalServerError
+			if err == errMissingAPIKey || err == errInvalidAPIKey || err == errQueryAPIKey {
+				status = http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tracker"`)
+			}
+			writeError(w, status, err.Error())
+
+			return
+		}
+
+		handle(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)), params)
+	}
+}
+
+// adminOnly wraps the handler, so it's only called with an admin API key.
+func adminOnly(handle httprouter.Handle) httprouter.Handle {
+	return authenticated(func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if key := requestAPIKey(r); key != nil && key.Scope != dto.ScopeAdmin {
+			log.Error().Msgf("API key %d can't access %s %s", key.ID, r.Method, r.URL.Path)
+			writeError(w, http.StatusForbidden, "admin API key is required")
+
+			return
+		}
+
+		handle(w, r, params)
+	})
+}
+
+// accountOnly wraps the handler of an account's route (e.g. /{accountID}/events),
+// so it's only called with an admin API key or a key of that account.
+func accountOnly(handle httprouter.Handle) httprouter.Handle {
+	return authenticated(func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// invalid account IDs are rejected by the handler
+		if accountID, err := parseAccountID(params); err == nil && !canAccess(r, accountID) {
+			log.Error().Msgf("API key %d can't access account %d", requestAPIKey(r).ID, accountID)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("API key can't access account %d", accountID))
+
+			return
+		}
+
+		handle(w, r, params)
+	})
+}
+
+// queryKey wraps the handler of a route that browsers open with EventSource or WebSocket, which can't set headers,
+// so the API key can also be sent with the apiKey query parameter. It has to wrap the authentication.
+//
+// Query parameters can end up in the logs of proxies, so other routes only accept the Authorization header.
+func queryKey(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		handle(w, r.WithContext(context.WithValue(r.Context(), queryKeyContextKey, true)), params)
+	}
+}
+
+// canAccess checks if the API key of the request can access the account.
+//
+// Admin keys can access all accounts, as well as all requests if the authentication is disabled.
+func canAccess(r *http.Request, accountID int) bool {
+	key := requestAPIKey(r)
+
+	return key == nil || key.Scope == dto.ScopeAdmin || key.AccountID == accountID
+}
+
+// requestAPIKey returns the authenticated API key of the request, nil if the authentication is disabled.
+func requestAPIKey(r *http.Request) *dto.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*dto.APIKey)
+
+	return key
+}
+
+// authenticate returns the API key of the request.
+//
+// The key is read from the Authorization header (e.g. Authorization: Bearer KEY) or from the apiKey query parameter
+// of the routes wrapped with queryKey.
+func authenticate(r *http.Request) (*dto.APIKey, error) {
+	key := r.URL.Query().Get("apiKey")
+	if allowed, _ := r.Context().Value(queryKeyContextKey).(bool); key != "" && !allowed {
+		return nil, errQueryAPIKey
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errInvalidAPIKey
+		}
+
+		key = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if key == "" {
+		return nil, errMissingAPIKey
+	}
+
+	if AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(AdminKey)) == 1 {
+		return &dto.APIKey{Scope: dto.ScopeAdmin}, nil
+	}
+
+	apiKey, err := persistence.APIKeys.GetAPIKey(r.Context(), persistence.HashAPIKey(key))
+	if errors.Is(err, persistence.ErrAPIKeyNotFound) {
+		return nil, errInvalidAPIKey
+	}
+
+	return apiKey, err
+}
+
+// openSession registers the event stream or WebSocket of the request's API key, so it is closed with the close function
+// when the key is revoked. Returns the function that unregisters the session when it ends.
+//
+// The ADMIN_API_KEY can't be revoked, so its sessions aren't registered, as well as all sessions if the authentication
+// is disabled.
+func openSession(r *http.Request, close func()) func() {
+	key := requestAPIKey(r)
+	if key == nil || key.ID == 0 {
+		return func() {}
+	}
+
+	s := &session{key: key, close: close}
+
+	sessionsMu.Lock()
+	sessions[s] = struct{}{}
+	sessionsMu.Unlock()
+
+	return func() {
+		sessionsMu.Lock()
+		delete(sessions, s)
+		sessionsMu.Unlock()
+	}
+}
+
+// CloseAPIKeySessions closes the open event streams and WebSockets of the revoked API key.
+func CloseAPIKeySessions(ID int64) {
+	for _, s := range findSessions(func(key *dto.APIKey) bool { return key.ID == ID }) {
+		log.Info().Msgf("closing session of revoked API key %d", ID)
+		s.close()
+	}
+}
+
+// CheckAccountSessions closes the open event streams and WebSockets of the account's API keys that were revoked,
+// e.g. because the account was deleted. The keys should be invalidated in the API key cache first.
+func CheckAccountSessions(ctx context.Context, accountID int) {
+	for _, s := range findSessions(func(key *dto.APIKey) bool {
+		return key.Scope == dto.ScopeAccount && key.AccountID == accountID
+	}) {
+		_, err := persistence.APIKeys.GetAPIKey(ctx, s.key.Hash)
+		if errors.Is(err, persistence.ErrAPIKeyNotFound) {
+			log.Info().Msgf("closing session of revoked API key %d", s.key.ID)
+			s.close()
+
+			continue
+		}
+		if err != nil {
+			log.Error().Msgf("checking API key %d of account %d: %v", s.key.ID, accountID, err)
+		}
+	}
+}
+
+// findSessions returns the open sessions of the API keys matching the condition.
+func findSessions(matches func(key *dto.APIKey) bool) []*session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	found := []*session{}
+	for s := range sessions {
+		if matches(s.key) {
+			found = append(found, s)
+		}
+	}
+
+	return found
+}
+
+// handleCreateAPIKey function handles POST requests.
+//
+// It creates a new API key with the scope from the JSON body (e.g. POST BASE_URL/admin/apikeys).
+// The key is only returned in this response, only its hash is stored.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body := struct {
+		Scope     string
+		AccountID int
+	}{}
+
+	if err := readJSON(r, &body); err != nil {
+		log.Error().Msgf("reading API key from body: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	switch body.Scope {
+	case dto.ScopeAdmin:
+		if body.AccountID != 0 {
+			writeError(w, http.StatusBadRequest, "admin API keys can't have an account")
+
+			return
+		}
+	case dto.ScopeAccount:
+		if _, err := persistence.DB.GetAccount(r.Context(), body.AccountID); err != nil {
+			log.Error().Msgf("getting account %d of the API key from database: %v", body.AccountID, err)
+			writeError(w, databaseStatus(err), err.Error())
+
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("scope should be %s or %s", dto.ScopeAdmin, dto.ScopeAccount))
+
+		return
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		log.Error().Msgf("generating API key: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	apiKey := &dto.APIKey{
+		Hash:      persistence.HashAPIKey(key),
+		Scope:     body.Scope,
+		AccountID: body.AccountID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := persistence.APIKeys.StoreAPIKey(r.Context(), apiKey); err != nil {
+		log.Error().Msgf("storing API key: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		*dto.APIKey
+		Key string
+	}{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+// handleDeleteAPIKey function handles DELETE requests.
+//
+// It revokes the API key matching the ID (e.g. DELETE BASE_URL/admin/apikeys/{ID}).
+func handleDeleteAPIKey(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	IDParam := params.ByName("id")
+
+	ID, err := strconv.ParseInt(IDParam, 10, 64)
+	if err != nil {
+		log.Error().Msgf("invalid API key ID: %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid API key ID %s: %v", IDParam, err))
+
+		return
+	}
+
+	if err := persistence.APIKeys.DeleteAPIKey(r.Context(), ID); err != nil {
+		log.Error().Msgf("deleting API key %d from database: %v", ID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	// other service instances close the sessions of the key when they receive the control message
+	CloseAPIKeySessions(ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newAPIKey generates a new random API key.
+func newAPIKey() (string, error) {
+	key := make([]byte, apiKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
@@ -0,0 +1,276 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/persistence"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testAdminKey is the admin key that isn't stored in the database
+const testAdminKey = "test-admin-key"
+
+// useAuth enables the API key authentication with an in-memory key store until the test ends.
+func useAuth(t *testing.T) {
+	apiKeys := persistence.APIKeys
+	persistence.APIKeys = &persistence.Memory{}
+	RequireAPIKeys = true
+	AdminKey = testAdminKey
+	t.Cleanup(func() {
+		persistence.APIKeys = apiKeys
+		RequireAPIKeys = false
+		AdminKey = ""
+	})
+
+	fakeDB.FnGetAccount = func(ID int) (*dto.Account, error) {
+		if ID != 1 && ID != 2 {
+			return nil, persistence.ErrAccountNotFound
+		}
+
+		return &dto.Account{ID: ID, Name: fmt.Sprintf("account %d", ID), IsActive: true}, nil
+	}
+}
+
+// authRequest sends the request with the API key and returns the response status.
+func authRequest(t *testing.T, method string, path string, key string, body string) int {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s request failed: %v", method, err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// createAPIKey creates an API key with the admin key and returns it.
+func createAPIKey(t *testing.T, body string) (int64, string) {
+	req, err := http.NewRequest("POST", server.URL+"/admin/apikeys", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	key := struct {
+		dto.APIKey
+		Key string
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if key.ID == 0 || len(key.Key) != 2*apiKeySize || key.CreatedAt.IsZero() {
+		t.Fatalf("unexpected API key %+v", key)
+	}
+
+	return key.ID, key.Key
+}
+
+func Test_Auth(t *testing.T) {
+	useAuth(t)
+
+	ID, key := createAPIKey(t, `{"Scope": "account", "AccountID": 1}`)
+	_, admin := createAPIKey(t, `{"Scope": "admin"}`)
+
+	for _, request := range []struct {
+		method string
+		path   string
+		key    string
+		status int
+	}{
+		// missing or invalid keys
+		{"GET", "/1", "", http.StatusUnauthorized},
+		{"GET", "/1", "invalid", http.StatusUnauthorized},
+		{"GET", "/1/stream?apiKey=invalid", "", http.StatusUnauthorized},
+		{"GET", "/accounts", "", http.StatusUnauthorized},
+		// the query parameter is only accepted by the stream routes
+		{"GET", "/1?apiKey=" + key, "", http.StatusUnauthorized},
+		{"GET", "/1?apiKey=" + key, key, http.StatusUnauthorized},
+		{"GET", "/2/stream?apiKey=" + key, "", http.StatusForbidden},
+		{"GET", "/stream?accounts=1,2&apiKey=" + key, "", http.StatusForbidden},
+		// account key can only access its account
+		{"GET", "/1", key, http.StatusOK},
+		{"GET", "/2", key, http.StatusForbidden},
+		{"PUT", "/2?data=test", key, http.StatusForbidden},
+		{"POST", "/2/events", key, http.StatusForbidden},
+		{"GET", "/2/stream", key, http.StatusForbidden},
+		{"GET", "/stream?accounts=1,2", key, http.StatusForbidden},
+		// and can't manage the service
+		{"DELETE", "/1", key, http.StatusForbidden},
+		{"GET", "/accounts", key, http.StatusForbidden},
+		{"GET", "/admin/deadletters", key, http.StatusForbidden},
+		{"POST", "/admin/apikeys", key, http.StatusForbidden},
+		// admin keys can access every account
+		{"GET", "/2", admin, http.StatusOK},
+		{"GET", "/2", testAdminKey, http.StatusOK},
+	} {
+		if status := authRequest(t, request.method, request.path, request.key, ""); status != request.status {
+			t.Fatalf("%s %s: expected %d but got %d", request.method, request.path, request.status, status)
+		}
+	}
+
+	// revoked keys can't be used anymore
+	if status := authRequest(t, "DELETE", fmt.Sprintf("/admin/apikeys/%d", ID), admin, ""); status != http.StatusNoContent {
+		t.Fatalf("expected %d but got %d", http.StatusNoContent, status)
+	}
+
+	if status := authRequest(t, "GET", "/1", key, ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected %d but got %d", http.StatusUnauthorized, status)
+	}
+
+	if status := authRequest(t, "DELETE", fmt.Sprintf("/admin/apikeys/%d", ID), admin, ""); status != http.StatusNotFound {
+		t.Fatalf("expected %d but got %d", http.StatusNotFound, status)
+	}
+}
+
+func Test_AuthBatch(t *testing.T) {
+	useAuth(t)
+	batchAccounts()
+
+	_, key := createAPIKey(t, `{"Scope": "account", "AccountID": 1}`)
+
+	body := `[{"accountId": 1, "data": "first"}, {"accountId": 2, "data": "second"}]`
+	results := postBatch(t, "application/json", body, map[string]string{"Authorization": "Bearer " + key})
+
+	if results[0].Status != http.StatusAccepted || results[1].Status != http.StatusForbidden {
+		t.Fatalf("expected %d and %d but got %+v", http.StatusAccepted, http.StatusForbidden, results)
+	}
+}
+
+func Test_CreateAPIKeyInvalid(t *testing.T) {
+	useAuth(t)
+
+	for _, request := range []struct {
+		body   string
+		status int
+	}{
+		{`{"Scope": "owner"}`, http.StatusBadRequest},
+		{`{"Scope": "admin", "AccountID": 1}`, http.StatusBadRequest},
+		{`{"Scope": "account"}`, http.StatusNotFound},
+		{`{"Scope": "account", "AccountID": 3}`, http.StatusNotFound},
+		{`{"Scope": `, http.StatusBadRequest},
+	} {
+		if status := authRequest(t, "POST", "/admin/apikeys", testAdminKey, request.body); status != request.status {
+			t.Fatalf("%s: expected %d but got %d", request.body, request.status, status)
+		}
+	}
+
+	if status := authRequest(t, "DELETE", "/admin/apikeys/asd", testAdminKey, ""); status != http.StatusBadRequest {
+		t.Fatalf("expected %d but got %d", http.StatusBadRequest, status)
+	}
+}
+
+func Test_AuthWebSocket(t *testing.T) {
+	useAuth(t)
+	streamAccounts()
+	useMemoryBus(t)
+
+	_, key := createAPIKey(t, `{"Scope": "account", "AccountID": 1}`)
+
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", "", server.URL); err == nil {
+		t.Fatalf("connecting without an API key should fail")
+	}
+
+	// browsers can't set the header, so the key is sent as a query parameter
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?apiKey="+key, "", server.URL)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{1, 2}})
+	if frame := receiveFrame(t, conn, wsError); frame.Error != "API key can't access account 2" {
+		t.Fatalf("unexpected error %q", frame.Error)
+	}
+
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{1}})
+	expectAccounts(t, conn, 1)
+}
+
+func Test_AuthRevokeSessions(t *testing.T) {
+	useAuth(t)
+	streamAccounts()
+	useMemoryBus(t)
+
+	ID, key := createAPIKey(t, `{"Scope": "account", "AccountID": 1}`)
+
+	reader := openStream(t, "/1/stream?apiKey="+key)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?apiKey="+key, "", server.URL)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{1}})
+	expectAccounts(t, conn, 1)
+
+	// sessions of the revoked key are closed
+	if status := authRequest(t, "DELETE", fmt.Sprintf("/admin/apikeys/%d", ID), testAdminKey, ""); status != http.StatusNoContent {
+		t.Fatalf("expected %d but got %d", http.StatusNoContent, status)
+	}
+
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		// lines that were sent before the key was revoked are read first
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the stream to end")
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("setting deadline: %v", err)
+	}
+
+	for {
+		frame := &wsFrame{}
+		err := websocket.JSON.Receive(conn, frame)
+		if err == nil && frame.Type == wsHeartbeat {
+			continue
+		}
+
+		var netErr net.Error
+		if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			t.Fatalf("expected the WebSocket to be closed but got %+v, %v", frame, err)
+		}
+
+		break
+	}
+}
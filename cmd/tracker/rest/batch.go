@@ -0,0 +1,322 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/persistence"
+	"celtra-programming-assigment/pkg/pubsub"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxBatchItems is the maximum number of events in a batch
+	maxBatchItems = 1000
+	// maxBatchBodySize is the maximum size of the batch request body in bytes
+	maxBatchBodySize = 5 << 20
+)
+
+// errDataTooLarge is returned when the JSON object data of a batch item is larger than a single event's body can be
+var errDataTooLarge = fmt.Errorf("data is larger than %d bytes", maxEventBodySize)
+
+// batchItem is a single event of the batch request, its data is a string or a JSON object.
+type batchItem struct {
+	AccountID int
+	Data      json.RawMessage
+	EventTime *time.Time
+}
+
+// payload returns the content type and the payload of the item's data.
+func (item *batchItem) payload() (string, []byte, error) {
+	data := bytes.TrimSpace(item.Data)
+
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		if text == "" {
+			return "", nil, errors.New("missing data")
+		}
+
+		return pubsub.ContentTypeText, []byte(text), nil
+	}
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		if len(data) > maxEventBodySize {
+			return "", nil, errDataTooLarge
+		}
+
+		return pubsub.ContentTypeJSON, data, nil
+	}
+
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return "", nil, errors.New("missing data")
+	}
+
+	return "", nil, errors.New("data should be a string or a JSON object")
+}
+
+// batchResult is the result of a single event of the batch request.
+//
+// Status has the same meaning as the status of a single event request, ID is the ID of an accepted event.
+type batchResult struct {
+	Status int
+	ID     string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// handleBatch function handles POST requests.
+//
+// It is used to receive a batch of events for multiple accounts (e.g. POST BASE_URL/events).
+// The body is a JSON array (Content-Type: application/json) or NDJSON (Content-Type: application/x-ndjson)
+// of items in the following format: {"accountId": 1, "data": "ACCOUNT_DATA", "eventTime": "2021-02-06T17:00:00Z"}.
+// The data can also be a JSON object, which is published as a JSON payload. The eventTime field is optional.
+//
+// Every item is validated and published separately, so the response is 200 OK with a result for every item
+// in the same order. Items are ingested like the events of handlePut, including the X-Ingest-Mode header.
+// Items of accounts that the API key can't access are rejected.
+func handleBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mode, err := ingestMode(r)
+	if err != nil {
+		log.Error().Msgf("invalid ingest mode for batch: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+
+	items, results, err := readBatch(r)
+	if err != nil {
+		log.Error().Msgf("reading batch: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// look up all the accounts at once
+	IDs := []int{}
+	seen := map[int]bool{}
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+
+		if _, _, err := item.payload(); err != nil {
+			status := http.StatusBadRequest
+			if err == errDataTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			results[i] = batchResult{Status: status, Error: err.Error()}
+			items[i] = nil
+
+			continue
+		}
+
+		if !canAccess(r, item.AccountID) {
+			results[i] = batchResult{Status: http.StatusForbidden, Error: fmt.Sprintf("API key can't access account %d", item.AccountID)}
+			items[i] = nil
+
+			continue
+		}
+
+		if !seen[item.AccountID] {
+			seen[item.AccountID] = true
+			IDs = append(IDs, item.AccountID)
+		}
+	}
+
+	active := map[int]bool{}
+	if len(IDs) > 0 {
+		if active, err = persistence.DB.IsActiveAccounts(r.Context(), IDs); err != nil {
+			log.Error().Msgf("checking if %d accounts are active: %v", len(IDs), err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+
+			return
+		}
+	}
+
+	events := make([]*pubsub.Event, len(items))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+
+		isActive, ok := active[item.AccountID]
+		if !ok {
+			results[i] = batchResult{Status: http.StatusNotFound, Error: persistence.ErrAccountNotFound.Error()}
+
+			continue
+		}
+
+		if !isActive {
+			results[i] = batchResult{Status: http.StatusBadRequest, Error: "account not active"}
+
+			continue
+		}
+
+		contentType, payload, _ := item.payload()
+		event, err := pubsub.NewEvent(item.AccountID, hostname, contentType, payload)
+		if err != nil {
+			log.Error().Msgf("creating event for accoundID %d: %v", item.AccountID, err)
+			results[i] = batchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+
+			continue
+		}
+
+		if item.EventTime != nil {
+			t := item.EventTime.UTC()
+			event.EventTime = &t
+		}
+
+		events[i] = event
+	}
+
+	if mode == IngestSync {
+		ingestBatchSync(r, events, results)
+	} else {
+		ingestBatchAsync(w, events, results)
+	}
+
+	writeJSON(w, http.StatusOK, struct{ Results []batchResult }{Results: results})
+}
+
+// ingestBatchAsync queues the events to be published and sets their results,
+// the events are stored by the queue's OnPublish once they are published.
+func ingestBatchAsync(w http.ResponseWriter, events []*pubsub.Event, results []batchResult) {
+	for i, event := range events {
+		if event == nil {
+			continue
+		}
+
+		if err := pubsub.Queue.Publish(event); err != nil {
+			log.Error().Msgf("queueing event for accoundID %d: %v", event.AccountID, err)
+			results[i] = batchResult{Status: http.StatusServiceUnavailable, Error: err.Error()}
+
+			// the client should retry the rejected events once the queue has some room again
+			w.Header().Set("Retry-After", "1")
+
+			continue
+		}
+
+		results[i] = batchResult{Status: http.StatusAccepted, ID: event.ID}
+	}
+}
+
+// ingestBatchSync publishes the events and stores them with a single batch (if the event log is enabled)
+// and sets their results.
+//
+// Published events that can't be stored are queued to the event log instead, their result is 202 Accepted
+// with the error, like in ingestSync.
+func ingestBatchSync(r *http.Request, events []*pubsub.Event, results []batchResult) {
+	published := []int{}
+	for i, event := range events {
+		if event == nil {
+			continue
+		}
+
+		if err := pubsub.Bus.Publish(r.Context(), event); err != nil {
+			log.Error().Msgf("publishing event for accoundID %d: %v", event.AccountID, err)
+			results[i] = batchResult{Status: http.StatusServiceUnavailable, Error: err.Error()}
+
+			continue
+		}
+		CountPublished(event)
+
+		results[i] = batchResult{Status: http.StatusCreated, ID: event.ID}
+		published = append(published, i)
+	}
+
+	if persistence.EventLog == nil || len(published) == 0 {
+		return
+	}
+
+	stored := make([]*dto.Event, 0, len(published))
+	for _, i := range published {
+		stored = append(stored, storedEvent(events[i]))
+	}
+
+	if err := persistence.Events.StoreEvents(r.Context(), stored); err != nil {
+		log.Error().Msgf("storing %d published events: %v", len(stored), err)
+
+		// the events were published, so they are queued to the event log and shouldn't be retried
+		for n, i := range published {
+			if err := persistence.EventLog.Write(stored[n]); err != nil {
+				log.Error().Msgf("queueing published event %s to the event log: %v", events[i].ID, err)
+			}
+
+			results[i] = batchResult{
+				Status: http.StatusAccepted,
+				ID:     events[i].ID,
+				Error:  fmt.Sprintf("event was published, but it wasn't stored: %v", err),
+			}
+		}
+	}
+}
+
+// readBatch reads the items of the batch request body.
+//
+// Items that can't be parsed are nil and their result is already set, the other results are empty.
+func readBatch(r *http.Request) ([]*batchItem, []batchResult, error) {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading body: %v", err)
+	}
+
+	// every item is parsed separately, so one invalid item doesn't reject the whole batch
+	var raw []json.RawMessage
+	switch contentType := r.Header.Get("Content-Type"); {
+	case strings.Contains(contentType, "application/x-ndjson"):
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxBatchBodySize)
+
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				raw = append(raw, append(json.RawMessage{}, line...))
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, nil, fmt.Errorf("reading body: %v", err)
+		}
+	case strings.Contains(contentType, "application/json"):
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON format in the body: %v", err)
+		}
+	default:
+		return nil, nil, errors.New("incorrect content type")
+	}
+
+	if len(raw) == 0 {
+		return nil, nil, errors.New("empty batch")
+	}
+
+	if len(raw) > maxBatchItems {
+		return nil, nil, fmt.Errorf("batch has %d events, at most %d are allowed", len(raw), maxBatchItems)
+	}
+
+	items := make([]*batchItem, len(raw))
+	results := make([]batchResult, len(raw))
+	for i, data := range raw {
+		item := &batchItem{}
+		if err := json.Unmarshal(data, item); err != nil {
+			results[i] = batchResult{Status: http.StatusBadRequest, Error: fmt.Sprintf("invalid event: %v", err)}
+
+			continue
+		}
+
+		items[i] = item
+	}
+
+	return items, results, nil
+}
@@ -0,0 +1,278 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/persistence"
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postBatch sends the batch request and returns the decoded results.
+func postBatch(t *testing.T, contentType string, body string, header map[string]string) []batchResult {
+	req, err := http.NewRequest("POST", server.URL+"/events", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	response := struct{ Results []batchResult }{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	return response.Results
+}
+
+// batchAccounts mocks the database with active account 1, inactive account 2 and returns the lookups.
+func batchAccounts() *[][]int {
+	lookups := [][]int{}
+	fakeDB.FnIsActiveAccounts = func(IDs []int) (map[int]bool, error) {
+		lookups = append(lookups, IDs)
+
+		all := map[int]bool{1: true, 2: false}
+		active := map[int]bool{}
+		for _, ID := range IDs {
+			if isActive, ok := all[ID]; ok {
+				active[ID] = isActive
+			}
+		}
+
+		return active, nil
+	}
+
+	return &lookups
+}
+
+func Test_Batch(t *testing.T) {
+	lookups := batchAccounts()
+
+	bus := &pubsub.Memory{}
+	queue := pubsub.Queue
+	pubsub.Queue = pubsub.NewPublisher(bus, 1, 100, nil)
+	defer func() {
+		pubsub.Queue.Close()
+		pubsub.Queue = queue
+	}()
+
+	sub, err := bus.Subscribe(context.Background(), pubsub.Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	body := `[
+		{"accountId": 1, "data": "first", "eventTime": "2021-02-06T18:00:00+01:00"},
+		{"accountId": 2, "data": "inactive"},
+		{"accountId": 3, "data": "missing"},
+		{"accountId": 1},
+		{"accountId": "one", "data": "invalid"},
+		{"accountId": 1, "data": {"key": "second"}}
+	]`
+
+	results := postBatch(t, "application/json", body, nil)
+
+	expected := []int{http.StatusAccepted, http.StatusBadRequest, http.StatusNotFound, http.StatusBadRequest, http.StatusBadRequest, http.StatusAccepted}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results but got %v", len(expected), results)
+	}
+
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Fatalf("result %d: expected %d but got %+v", i, status, results[i])
+		}
+	}
+
+	if results[2].Error != persistence.ErrAccountNotFound.Error() {
+		t.Fatalf("expected %s but got %s", persistence.ErrAccountNotFound, results[2].Error)
+	}
+
+	// all the accounts are looked up at once
+	if len(*lookups) != 1 || len((*lookups)[0]) != 3 {
+		t.Fatalf("expected a single lookup of 3 accounts but got %v", *lookups)
+	}
+
+	for _, i := range []int{0, 5} {
+		select {
+		case event := <-sub.Events():
+			if event.ID != results[i].ID {
+				t.Fatalf("expected event %s but got %s", results[i].ID, event.ID)
+			}
+
+			if i == 5 && (event.ContentType != pubsub.ContentTypeJSON || string(event.Data) != `{"key":"second"}`) {
+				t.Fatalf("unexpected JSON event %+v", event)
+			}
+
+			if i == 0 && (event.EventTime == nil || !event.EventTime.Equal(time.Date(2021, 2, 6, 17, 0, 0, 0, time.UTC))) {
+				t.Fatalf("unexpected event time %v", event.EventTime)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+}
+
+func Test_BatchNDJSON(t *testing.T) {
+	batchAccounts()
+
+	published := []*pubsub.Event{}
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		if event.Text() == "unavailable" {
+			return errors.New("bus is down")
+		}
+
+		published = append(published, event)
+		return nil
+	}
+	defer func() {
+		fakeBus.FnPublish = func(event *pubsub.Event) error {
+			return nil
+		}
+	}()
+
+	body := `{"accountId": 1, "data": "first"}
+
+not json
+{"accountId": 1, "data": "unavailable"}
+`
+
+	// events are published before the response in the sync mode
+	results := postBatch(t, "application/x-ndjson", body, map[string]string{"X-Ingest-Mode": "sync"})
+
+	expected := []int{http.StatusCreated, http.StatusBadRequest, http.StatusServiceUnavailable}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results but got %v", len(expected), results)
+	}
+
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Fatalf("result %d: expected %d but got %+v", i, status, results[i])
+		}
+	}
+
+	if len(published) != 1 || published[0].ID != results[0].ID {
+		t.Fatalf("expected published event %s but got %v", results[0].ID, published)
+	}
+}
+
+func Test_BatchSyncStoreError(t *testing.T) {
+	batchAccounts()
+
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		return nil
+	}
+
+	store := &recordingStore{}
+	events, eventLog := persistence.Events, persistence.EventLog
+	persistence.Events = &failingStore{}
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() {
+		persistence.Events, persistence.EventLog = events, eventLog
+	}()
+
+	results := postBatch(t, "application/json", `[{"accountId": 1, "data": "first"}]`, map[string]string{"X-Ingest-Mode": "sync"})
+
+	// the event was published, so it shouldn't be sent again
+	if len(results) != 1 || results[0].Status != http.StatusAccepted || results[0].ID == "" || results[0].Error == "" {
+		t.Fatalf("expected an accepted event with an error but got %+v", results)
+	}
+
+	persistence.EventLog.Close()
+
+	if len(store.events) != 1 || store.events[0].EventID != results[0].ID {
+		t.Fatalf("expected stored event %s but got %v", results[0].ID, store.events)
+	}
+}
+
+func Test_BatchInvalid(t *testing.T) {
+	batchAccounts()
+
+	tooLarge := "[" + strings.Repeat(`{"accountId": 1, "data": "x"},`, maxBatchItems) + `{"accountId": 1, "data": "x"}]`
+
+	for _, request := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", `[{"accountId": 1, "data": "x"}]`},
+		{"application/json", `{"accountId": 1, "data": "x"}`},
+		{"application/json", `[]`},
+		{"application/x-ndjson", ``},
+		{"application/json", tooLarge},
+	} {
+		req, err := http.NewRequest("POST", server.URL+"/events", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", request.contentType)
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s %.50s: expected %d but got %d", request.contentType, request.body, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func Test_BatchLargeData(t *testing.T) {
+	batchAccounts()
+
+	large := `{"key": "` + strings.Repeat("x", maxEventBodySize) + `"}`
+	body := `[{"accountId": 1, "data": ` + large + `}, {"accountId": 1, "data": {"key": "small"}}]`
+
+	results := postBatch(t, "application/json", body, nil)
+
+	expected := []int{http.StatusRequestEntityTooLarge, http.StatusAccepted}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results but got %v", len(expected), results)
+	}
+
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Fatalf("result %d: expected %d but got %+v", i, status, results[i])
+		}
+	}
+}
+
+func Test_BatchBadDatabase(t *testing.T) {
+	fakeDB.FnIsActiveAccounts = func(IDs []int) (map[int]bool, error) {
+		return nil, errors.New("database is down")
+	}
+
+	req, err := http.NewRequest("POST", server.URL+"/events", strings.NewReader(`[{"accountId": 1, "data": "x"}]`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d but got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
@@ -0,0 +1,223 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/persistence"
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+)
+
+// StoreDeadLetter stores the event that couldn't be published, so it can be inspected and re-driven later.
+func StoreDeadLetter(event *pubsub.Event, publishErr error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Msgf("serializing dead letter %s to JSON: %v", event.ID, err)
+
+		return
+	}
+
+	deadLetter := &dto.DeadLetter{
+		EventID:   event.ID,
+		AccountID: event.AccountID,
+		Event:     data,
+		Error:     publishErr.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+
+	// events are dead-lettered in the background, so there is no request context to use
+	if err := persistence.DeadLetters.StoreDeadLetter(context.Background(), deadLetter); err != nil {
+		log.Error().Msgf("storing dead letter %s: %v", event.ID, err)
+	}
+}
+
+// handleDeadLetters function handles GET requests.
+//
+// It returns a page of events that couldn't be published ordered by their ID
+// (e.g. GET BASE_URL/admin/deadletters?accountId=1&limit=100&cursor=CURSOR).
+func handleDeadLetters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filter, err := parseDeadLetterFilter(r.URL.Query())
+	if err != nil {
+		log.Error().Msgf("invalid dead letter filter: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// fetch one more dead letter to find out if there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	deadLetters, err := persistence.DeadLetters.ListDeadLetters(r.Context(), filter)
+	if err != nil {
+		log.Error().Msgf("listing dead letters from database: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	page := struct {
+		DeadLetters []*dto.DeadLetter
+		NextCursor  string
+	}{
+		DeadLetters: deadLetters,
+	}
+
+	if len(deadLetters) > limit {
+		page.DeadLetters = deadLetters[:limit]
+		page.NextCursor = encodeCursor(int(page.DeadLetters[limit-1].ID))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleDeadLetter function handles GET requests.
+//
+// It returns a JSON representation of the dead letter matching the ID (e.g. GET BASE_URL/admin/deadletters/{ID}).
+func handleDeadLetter(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID, err := parseDeadLetterID(params)
+	if err != nil {
+		log.Error().Msgf("invalid dead letter ID: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	deadLetter, err := persistence.DeadLetters.GetDeadLetter(r.Context(), ID)
+	if err != nil {
+		log.Error().Msgf("getting dead letter %d from database: %v", ID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetter)
+}
+
+// handleDeleteDeadLetter function handles DELETE requests.
+//
+// It discards the dead letter matching the ID without publishing it (e.g. DELETE BASE_URL/admin/deadletters/{ID}).
+func handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID, err := parseDeadLetterID(params)
+	if err != nil {
+		log.Error().Msgf("invalid dead letter ID: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if err := persistence.DeadLetters.DeleteDeadLetter(r.Context(), ID); err != nil {
+		log.Error().Msgf("deleting dead letter %d from database: %v", ID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRedrive function handles POST requests.
+//
+// It publishes the event of the dead letter matching the ID again, stores it to the event log and deletes the dead letter
+// when the event was published (e.g. POST BASE_URL/admin/deadletters/{ID}/redrive).
+func handleRedrive(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID, err := parseDeadLetterID(params)
+	if err != nil {
+		log.Error().Msgf("invalid dead letter ID: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	deadLetter, err := persistence.DeadLetters.GetDeadLetter(r.Context(), ID)
+	if err != nil {
+		log.Error().Msgf("getting dead letter %d from database: %v", ID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	event := &pubsub.Event{}
+	if err := json.Unmarshal(deadLetter.Event, event); err != nil {
+		log.Error().Msgf("deserializing dead letter %d: %v", ID, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	if err := pubsub.Bus.Publish(r.Context(), event); err != nil {
+		log.Error().Msgf("re-driving event %s for accoundID %d: %v", event.ID, event.AccountID, err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+
+		return
+	}
+
+	// the event wasn't stored to the event log, because events are only stored once they are published
+	Published(event)
+
+	if err := persistence.DeadLetters.DeleteDeadLetter(r.Context(), ID); err != nil {
+		log.Error().Msgf("deleting re-driven dead letter %d from database: %v", ID, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("event was published, but the dead letter wasn't deleted: %v", err))
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct{ ID string }{ID: event.ID})
+}
+
+// parseDeadLetterFilter is a helper function to parse the dead letter filter from the query parameters.
+func parseDeadLetterFilter(query url.Values) (persistence.DeadLetterFilter, error) {
+	filter := persistence.DeadLetterFilter{
+		Limit: defaultListLimit,
+	}
+
+	if accountID := query.Get("accountId"); accountID != "" {
+		ID, err := strconv.Atoi(accountID)
+		if err != nil {
+			return filter, fmt.Errorf("invalid accountId %s: %v", accountID, err)
+		}
+
+		filter.AccountID = ID
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxListLimit {
+			return filter, fmt.Errorf("limit %s should be a number between 1 and %d", limit, maxListLimit)
+		}
+
+		filter.Limit = l
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		afterID, err := decodeCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+
+		filter.AfterID = int64(afterID)
+	}
+
+	return filter, nil
+}
+
+// parseDeadLetterID is a helper function to parse the dead letter ID from the request context.
+func parseDeadLetterID(params httprouter.Params) (int64, error) {
+	IDParam := params.ByName("id")
+
+	ID, err := strconv.ParseInt(IDParam, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid dead letter ID %s: %v", IDParam, err)
+	}
+
+	return ID, nil
+}
@@ -0,0 +1,234 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/persistence"
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useDeadLetters replaces the dead letter store with an in-memory store for the duration of the test.
+func useDeadLetters(t *testing.T) persistence.DeadLetterStore {
+	deadLetters := persistence.DeadLetters
+	persistence.DeadLetters = &persistence.Memory{}
+	t.Cleanup(func() { persistence.DeadLetters = deadLetters })
+
+	return persistence.DeadLetters
+}
+
+func Test_DeadLetters(t *testing.T) {
+	store := useDeadLetters(t)
+
+	for i := 1; i <= 3; i++ {
+		event, err := pubsub.NewEvent(i, "test", pubsub.ContentTypeText, []byte("test data"))
+		if err != nil {
+			t.Fatalf("creating event: %v", err)
+		}
+
+		StoreDeadLetter(event, errors.New("bus is down"))
+	}
+
+	resp, err := server.Client().Get(server.URL + "/admin/deadletters?limit=2")
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	page := struct {
+		DeadLetters []*dto.DeadLetter
+		NextCursor  string
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if len(page.DeadLetters) != 2 || page.NextCursor == "" {
+		t.Fatalf("expected 2 dead letters and a cursor but got %+v", page)
+	}
+
+	if page.DeadLetters[0].AccountID != 1 || page.DeadLetters[0].Error != "bus is down" {
+		t.Fatalf("unexpected dead letter %+v", page.DeadLetters[0])
+	}
+
+	// the stored event can be re-driven as it was
+	event := &pubsub.Event{}
+	if err := json.Unmarshal(page.DeadLetters[0].Event, event); err != nil {
+		t.Fatalf("decoding dead letter event: %v", err)
+	}
+
+	if event.ID != page.DeadLetters[0].EventID || event.Text() != "test data" {
+		t.Fatalf("unexpected dead letter event %+v", event)
+	}
+
+	resp, err = server.Client().Get(server.URL + "/admin/deadletters?accountId=3")
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if len(page.DeadLetters) != 1 || page.DeadLetters[0].AccountID != 3 || page.NextCursor != "" {
+		t.Fatalf("expected 1 dead letter of account 3 but got %+v", page)
+	}
+
+	resp, err = server.Client().Get(fmt.Sprintf("%s/admin/deadletters/%d", server.URL, page.DeadLetters[0].ID))
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/admin/deadletters/%d", server.URL, page.DeadLetters[0].ID), nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("DELETE request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if _, err := store.GetDeadLetter(context.Background(), page.DeadLetters[0].ID); err != persistence.ErrDeadLetterNotFound {
+		t.Fatalf("expected %v, got %v", persistence.ErrDeadLetterNotFound, err)
+	}
+}
+
+func Test_Redrive(t *testing.T) {
+	store := useDeadLetters(t)
+
+	event, err := pubsub.NewEvent(1, "test", pubsub.ContentTypeText, []byte("test data"))
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	StoreDeadLetter(event, errors.New("bus is down"))
+
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		return errors.New("bus is down")
+	}
+	defer func() {
+		fakeBus.FnPublish = func(event *pubsub.Event) error {
+			return nil
+		}
+	}()
+
+	// dead letter is kept while the bus is unavailable
+	resp, err := server.Client().Post(server.URL+"/admin/deadletters/1/redrive", "", nil)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	published := []*pubsub.Event{}
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		published = append(published, event)
+		return nil
+	}
+
+	resp, err = server.Client().Post(server.URL+"/admin/deadletters/1/redrive", "", nil)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if len(published) != 1 || published[0].ID != event.ID || published[0].Text() != "test data" {
+		t.Fatalf("expected published event %s but got %v", event.ID, published)
+	}
+
+	if _, err := store.GetDeadLetter(context.Background(), 1); err != persistence.ErrDeadLetterNotFound {
+		t.Fatalf("expected %v, got %v", persistence.ErrDeadLetterNotFound, err)
+	}
+
+	// re-driven dead letter doesn't exist anymore
+	resp, err = server.Client().Post(server.URL+"/admin/deadletters/1/redrive", "", nil)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func Test_RedriveEventLog(t *testing.T) {
+	useDeadLetters(t)
+
+	event, err := pubsub.NewEvent(1, "test", pubsub.ContentTypeText, []byte("test data"))
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	StoreDeadLetter(event, errors.New("bus is down"))
+
+	store := &recordingStore{}
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() { persistence.EventLog = nil }()
+
+	resp, err := server.Client().Post(server.URL+"/admin/deadletters/1/redrive", "", nil)
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// closing the event log stores the re-driven event
+	persistence.EventLog.Close()
+
+	if len(store.events) != 1 {
+		t.Fatalf("expected %d stored event but got %d", 1, len(store.events))
+	}
+
+	if stored := store.events[0]; stored.EventID != event.ID || stored.AccountID != 1 || stored.Data != "test data" {
+		t.Fatalf("unexpected stored event: %+v", stored)
+	}
+}
+
+func Test_DeadLettersInvalidParams(t *testing.T) {
+	useDeadLetters(t)
+
+	for _, path := range []string{"/admin/deadletters?limit=0", "/admin/deadletters?cursor=!!!", "/admin/deadletters?accountId=abc", "/admin/deadletters/abc"} {
+		resp, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d but got %d", path, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
@@ -2,13 +2,18 @@
 package rest
 
 import (
+	"bytes"
+	"celtra-programming-assigment/pkg/dto"
 	"celtra-programming-assigment/pkg/persistence"
 	"celtra-programming-assigment/pkg/pubsub"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -19,7 +24,27 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// defaultListLimit is the number of accounts returned by handleList if the limit isn't set
+	defaultListLimit = 100
+	// maxListLimit is the maximum number of accounts returned by handleList
+	maxListLimit = 1000
+	// maxEventBodySize is the maximum size of the JSON payload of a single event in bytes
+	maxEventBodySize = 64 << 10
+)
+
+// ingestion modes of handlePut
+const (
+	// IngestAsync responds before the event is published.
+	IngestAsync = "async"
+	// IngestSync responds after the event is published and stored.
+	IngestSync = "sync"
+)
+
 var (
+	// DefaultIngestMode is the ingestion mode of requests without the X-Ingest-Mode header
+	DefaultIngestMode = IngestAsync
+
 	// rate counter
 	counter = ratecounter.NewRateCounter(1 * time.Second)
 	// hostname of the service (Docker container ID)
@@ -27,12 +52,31 @@ var (
 )
 
 // CreateRouter returns a router with registered handlers
-func CreateRouter() *httprouter.Router {
-	router := httprouter.New()
-	router.GET("/:accountId", handleGet)
-	router.GET("/", handleRate)
-	router.POST("/", handlePost)
-	router.PUT("/:accountId", handlePut)
+//
+// If RequireAPIKeys is set, account routes can be used with an admin API key or a key of the account,
+// and the other routes that manage the service can only be used with an admin key.
+func CreateRouter() http.Handler {
+	router := newRouter()
+	router.Handle(http.MethodGet, "/:accountId", accountOnly(handleGet))
+	router.Handle(http.MethodGet, "/", adminOnly(handleRate))
+	router.Handle(http.MethodPost, "/", adminOnly(handlePost))
+	router.Handle(http.MethodPut, "/:accountId", accountOnly(handlePut))
+	router.Handle(http.MethodPatch, "/:accountId", adminOnly(handlePatch))
+	router.Handle(http.MethodDelete, "/:accountId", adminOnly(handleDelete))
+	router.Handle(http.MethodGet, "/accounts", adminOnly(handleList))
+	router.Handle(http.MethodGet, "/:accountId/events", accountOnly(handleEvents))
+	router.Handle(http.MethodPut, "/:accountId/events", accountOnly(handlePutJSON))
+	router.Handle(http.MethodPost, "/:accountId/events", accountOnly(handlePutJSON))
+	router.Handle(http.MethodPost, "/events", authenticated(handleBatch))
+	router.Handle(http.MethodGet, "/:accountId/stream", queryKey(accountOnly(handleStream)))
+	router.Handle(http.MethodGet, "/stream", queryKey(authenticated(handleStreamAccounts)))
+	router.Handle(http.MethodGet, "/ws", queryKey(authenticated(handleWebSocket)))
+	router.Handle(http.MethodGet, "/admin/deadletters", adminOnly(handleDeadLetters))
+	router.Handle(http.MethodGet, "/admin/deadletters/:id", adminOnly(handleDeadLetter))
+	router.Handle(http.MethodDelete, "/admin/deadletters/:id", adminOnly(handleDeleteDeadLetter))
+	router.Handle(http.MethodPost, "/admin/deadletters/:id/redrive", adminOnly(handleRedrive))
+	router.Handle(http.MethodPost, "/admin/apikeys", adminOnly(handleCreateAPIKey))
+	router.Handle(http.MethodDelete, "/admin/apikeys/:id", adminOnly(handleDeleteAPIKey))
 
 	return router
 }
@@ -44,15 +88,15 @@ func handleGet(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 	accountID, err := parseAccountID(params)
 	if err != nil {
 		log.Error().Msgf("invalid accountId value: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 
 		return
 	}
 
-	account, err := persistence.DB.GetAccount(accountID)
+	account, err := persistence.DB.GetAccount(r.Context(), accountID)
 	if err != nil {
 		log.Error().Msgf("getting account %d from database: %v", accountID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, databaseStatus(err), err.Error())
 
 		return
 	}
@@ -60,7 +104,7 @@ func handleGet(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 	body, err := json.Marshal(account)
 	if err != nil {
 		log.Error().Msgf("serializing account %d to JSON: %v", accountID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 
 		return
 	}
@@ -72,19 +116,48 @@ func handleGet(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 	}
 }
 
-// handleGet function handles GET requests.
+// CountPublished counts the published event in the event rate.
+func CountPublished(event *pubsub.Event) {
+	counter.Incr(1)
+}
+
+// Published counts the event published by the publish queue and stores it to the event log (if it is enabled).
 //
-// It returns a JSON representation of an account matching the accountID (e.g. GET BASE_URL/{accountID}).
+// Events are only stored once they are published, so events rejected by a full queue are never stored.
+func Published(event *pubsub.Event) {
+	CountPublished(event)
+
+	if persistence.EventLog != nil {
+		if err := persistence.EventLog.Write(storedEvent(event)); err != nil {
+			log.Error().Msgf("storing event for accoundID %d: %v", event.AccountID, err)
+		}
+	}
+}
+
+// handleRate function handles GET requests.
+//
+// It returns a JSON representation of the current event rate and the metrics of the publish queue (e.g. GET BASE_URL).
 func handleRate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	stats := pubsub.Queue.Stats()
 	rate := struct {
-		Rate int64
+		Rate       int64
+		QueueDepth int
+		Dropped    int64
+		Failed     int64
+		Spooled    int64
+		SpoolDepth int64
 	}{
-		Rate: counter.Rate(),
+		Rate:       counter.Rate(),
+		QueueDepth: stats.Depth,
+		Dropped:    stats.Dropped,
+		Failed:     stats.Failed,
+		Spooled:    stats.Spooled,
+		SpoolDepth: stats.SpoolDepth,
 	}
 	body, err := json.Marshal(rate)
 	if err != nil {
 		log.Error().Msgf("serializing to JSON: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 
 		return
 	}
@@ -96,44 +169,174 @@ func handleRate(w http.ResponseWriter, r *http.Request, params httprouter.Params
 	}
 }
 
-// handlePost function handles POST requests.
+// handleList function handles GET requests.
 //
-// It creates a new account and returns a Location header with a relative URL where the new account can be accesed from.
+// It returns a page of accounts ordered by their ID (e.g. GET BASE_URL/accounts?active=true&name_prefix=foo&limit=100&cursor=CURSOR).
 //
-// The function accepts JSON payload in the following format: {"Name":"ACCOUNT_NAME", "IsActive": true/false}
-func handlePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	defer r.Body.Close()
+// All query parameters are optional. The response contains a NextCursor value which is used to fetch the next page
+// and is empty on the last page.
+func handleList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filter, err := parseAccountFilter(r.URL.Query())
+	if err != nil {
+		log.Error().Msgf("invalid account filter: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
 
-	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		http.Error(w, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	// fetch one more account to find out if there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	accounts, err := persistence.DB.ListAccounts(r.Context(), filter)
+	if err != nil {
+		log.Error().Msgf("listing accounts from database: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
 
 		return
 	}
 
-	bodyBytes, err := ioutil.ReadAll(r.Body)
+	page := struct {
+		Accounts   []*dto.Account
+		NextCursor string
+	}{
+		Accounts: accounts,
+	}
+
+	if len(accounts) > limit {
+		page.Accounts = accounts[:limit]
+		page.NextCursor = encodeCursor(page.Accounts[limit-1].ID)
+	}
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		log.Error().Msgf("serializing accounts to JSON: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error().Msgf("writing body: %v", err)
+	}
+}
+
+// handleEvents function handles GET requests.
+//
+// It returns a page of stored events of an account ordered by time
+// (e.g. GET BASE_URL/{accountID}/events?from=2021-02-06T17:00:00Z&to=2021-02-06T18:00:00Z&limit=100&cursor=CURSOR).
+//
+// All query parameters are optional. Events are returned as a JSON object or as NDJSON (one event per line)
+// if the request has an "Accept: application/x-ndjson" header. The cursor for the next page is returned
+// in the X-Next-Cursor header (and as NextCursor in JSON) and is empty on the last page.
+// Unknown accounts are not found (404), like on the other account routes.
+func handleEvents(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, err := parseAccountID(params)
+	if err != nil {
+		log.Error().Msgf("invalid accountId value: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		log.Error().Msgf("invalid event filter: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// an unknown account is not found, instead of having no events
+	if _, err := persistence.DB.GetAccount(r.Context(), accountID); err != nil {
+		log.Error().Msgf("getting account %d from database: %v", accountID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	filter.AccountID = accountID
+
+	// fetch one more event to find out if there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	events, err := persistence.Events.ListEvents(r.Context(), filter)
 	if err != nil {
-		log.Error().Msgf("reading body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error().Msgf("listing events of account %d from database: %v", accountID, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
 
 		return
 	}
 
+	page := struct {
+		Events     []*dto.Event
+		NextCursor string
+	}{
+		Events: events,
+	}
+
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.NextCursor = encodeEventCursor(page.Events[limit-1])
+	}
+
+	w.Header().Set("X-Next-Cursor", page.NextCursor)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		encoder := json.NewEncoder(w)
+		for _, event := range page.Events {
+			if err := encoder.Encode(event); err != nil {
+				log.Error().Msgf("writing events of account %d: %v", accountID, err)
+
+				return
+			}
+		}
+
+		return
+	}
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		log.Error().Msgf("serializing events to JSON: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error().Msgf("writing body: %v", err)
+	}
+}
+
+// handlePost function handles POST requests.
+//
+// It creates a new account and returns a Location header with a relative URL where the new account can be accesed from.
+//
+// The function accepts JSON payload in the following format: {"Name":"ACCOUNT_NAME", "IsActive": true/false}
+func handlePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	bodyStruct := struct {
 		Name     string
 		IsActive bool
 	}{}
 
-	if err := json.Unmarshal(bodyBytes, &bodyStruct); err != nil {
-		log.Error().Msgf("invalid JSON format in the body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := readJSON(r, &bodyStruct); err != nil {
+		log.Error().Msgf("invalid body: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
 
 		return
 	}
 
-	account, err := persistence.DB.CreateAccount(bodyStruct.Name, bodyStruct.IsActive)
+	account, err := persistence.DB.CreateAccount(r.Context(), bodyStruct.Name, bodyStruct.IsActive)
 	if err != nil {
 		log.Error().Msgf("creating new account: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 
 		return
 	}
@@ -144,51 +347,512 @@ func handlePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 // handlePut function handles PUT requests.
 //
-// It is used to receive events for a specific account (e.g. PUT BASE_URL/{accountID}?data="ACCOUNT_DATA")
+// It is used to receive events for a specific account (e.g. PUT BASE_URL/{accountID}?data="ACCOUNT_DATA").
+// The time when the event happened can be supplied with the optional eventTime query parameter (RFC 3339).
+//
+// Events are published asynchronously and the response is 202 Accepted. With the "X-Ingest-Mode: sync" header
+// (or the sync DefaultIngestMode), the response is 201 Created with the event ID after the event is published.
 func handlePut(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, ok := activeAccountID(w, r, params)
+	if !ok {
+		return
+	}
+
+	data := r.URL.Query().Get("data")
+	if data == "" {
+		log.Error().Msgf("missing data value for accoundID %d", accountID)
+		writeError(w, http.StatusBadRequest, "missing data")
+
+		return
+	}
+
+	event, err := pubsub.NewEvent(accountID, hostname, pubsub.ContentTypeText, []byte(data))
+	if err != nil {
+		log.Error().Msgf("creating event for accoundID %d: %v", accountID, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	ingest(w, r, event)
+}
+
+// handlePutJSON function handles PUT and POST requests.
+//
+// It is used to receive events with a JSON object payload for a specific account
+// (e.g. POST BASE_URL/{accountID}/events with the {"key": "value"} body and the application/json content type).
+// A body larger than maxEventBodySize bytes is rejected with 413 Request Entity Too Large and a body with another
+// content type with 415 Unsupported Media Type, otherwise the event is ingested like with handlePut.
+func handlePutJSON(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, ok := activeAccountID(w, r, params)
+	if !ok {
+		return
+	}
+
+	payload, status, err := readPayload(r)
+	if err != nil {
+		log.Error().Msgf("invalid payload for accoundID %d: %v", accountID, err)
+		writeError(w, status, err.Error())
+
+		return
+	}
+
+	event, err := pubsub.NewEvent(accountID, hostname, pubsub.ContentTypeJSON, payload)
+	if err != nil {
+		log.Error().Msgf("creating event for accoundID %d: %v", accountID, err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	ingest(w, r, event)
+}
+
+// activeAccountID parses the account ID and checks that the account is active.
+//
+// If it isn't, the error response is written and false is returned.
+func activeAccountID(w http.ResponseWriter, r *http.Request, params httprouter.Params) (int, bool) {
 	accountID, err := parseAccountID(params)
 	if err != nil {
 		log.Error().Msgf("invalid accountId value: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 
-		return
+		return 0, false
 	}
 
-	active, err := persistence.DB.IsActiveAccount(accountID)
+	active, err := persistence.DB.IsActiveAccount(r.Context(), accountID)
 	if err != nil {
 		log.Error().Msgf("checking if accountID %d is active: %v", accountID, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, databaseStatus(err), err.Error())
 
-		return
+		return 0, false
 	}
 
 	if !active {
-		log.Error().Msgf("accoundID %d is not active: %v", accountID, err)
-		http.Error(w, "account not active", http.StatusBadRequest)
+		log.Error().Msgf("accoundID %d is not active", accountID)
+		writeError(w, http.StatusBadRequest, "account not active")
+
+		return 0, false
+	}
+
+	return accountID, true
+}
+
+// ingest sets the optional event time of the event and publishes it in the requested ingestion mode.
+func ingest(w http.ResponseWriter, r *http.Request, event *pubsub.Event) {
+	if eventTime := r.URL.Query().Get("eventTime"); eventTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, eventTime)
+		if err != nil {
+			log.Error().Msgf("invalid eventTime value for accoundID %d: %v", event.AccountID, err)
+			writeError(w, http.StatusBadRequest, "invalid eventTime value")
+
+			return
+		}
+
+		t = t.UTC()
+		event.EventTime = &t
+	}
+
+	mode, err := ingestMode(r)
+	if err != nil {
+		log.Error().Msgf("invalid ingest mode for accoundID %d: %v", event.AccountID, err)
+		writeError(w, http.StatusBadRequest, err.Error())
 
 		return
 	}
 
-	data := r.URL.Query().Get("data")
-	if data == "" {
-		log.Error().Msgf("missing data value for accoundID %d: %v", accountID, err)
-		http.Error(w, "missing data", http.StatusBadRequest)
+	if mode == IngestSync {
+		ingestSync(w, r, event)
+
+		return
+	}
+
+	// the event is stored by the queue's OnPublish once it is published
+	if err := pubsub.Queue.Publish(event); err != nil {
+		log.Error().Msgf("queueing event for accoundID %d: %v", event.AccountID, err)
+
+		// the client should retry once the queue has some room again
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ingestSync publishes the event and stores it to the event store (if the event log is enabled)
+// before responding with 201 Created and the event ID.
+//
+// If publishing fails, the client gets 503 Service Unavailable and can retry the request.
+// If the event was published but storing it fails, the event is queued to the event log instead and the client gets
+// 202 Accepted with the event ID and the error, because a retried request would publish the event again.
+func ingestSync(w http.ResponseWriter, r *http.Request, event *pubsub.Event) {
+	if err := pubsub.Bus.Publish(r.Context(), event); err != nil {
+		log.Error().Msgf("publishing event for accoundID %d: %v", event.AccountID, err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
 
 		return
 	}
+	CountPublished(event)
+
+	if persistence.EventLog != nil {
+		if err := persistence.Events.StoreEvents(r.Context(), []*dto.Event{storedEvent(event)}); err != nil {
+			log.Error().Msgf("storing published event %s for accoundID %d: %v", event.ID, event.AccountID, err)
 
-	data = fmt.Sprintf("%s [%s]", data, hostname)
+			if err := persistence.EventLog.Write(storedEvent(event)); err != nil {
+				log.Error().Msgf("queueing published event %s for accoundID %d to the event log: %v", event.ID, event.AccountID, err)
+			}
+
+			writeJSON(w, http.StatusAccepted, struct {
+				ID    string
+				Error string
+			}{ID: event.ID, Error: fmt.Sprintf("event was published, but it wasn't stored: %v", err)})
 
-	go func() {
-		if err := pubsub.Bus.Publish(accountID, data); err != nil {
-			log.Error().Msgf("publishing event for accoundID %d: %v", accountID, err)
 			return
 		}
+	}
 
-		counter.Incr(1)
-	}()
+	writeJSON(w, http.StatusCreated, struct{ ID string }{ID: event.ID})
+}
 
-	w.WriteHeader(http.StatusAccepted)
+// handlePatch function handles PATCH requests.
+//
+// It changes the name and/or the active state of an account (e.g. PATCH BASE_URL/{accountID})
+// and returns a JSON representation of the updated account.
+//
+// The function accepts JSON payload in the following format: {"Name":"ACCOUNT_NAME", "IsActive": true/false}.
+// Both fields are optional but at least one of them has to be present.
+func handlePatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, err := parseAccountID(params)
+	if err != nil {
+		log.Error().Msgf("invalid accountId value: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	bodyStruct := struct {
+		Name     *string
+		IsActive *bool
+	}{}
+
+	if err := readJSON(r, &bodyStruct); err != nil {
+		log.Error().Msgf("invalid body: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if bodyStruct.Name == nil && bodyStruct.IsActive == nil {
+		writeError(w, http.StatusBadRequest, "nothing to update")
+
+		return
+	}
+
+	if bodyStruct.Name != nil && *bodyStruct.Name == "" {
+		writeError(w, http.StatusBadRequest, "name can't be empty")
+
+		return
+	}
+
+	// both fields are changed together, so a failed request doesn't leave the account half updated
+	account, err := persistence.DB.PatchAccount(r.Context(), accountID, bodyStruct.Name, bodyStruct.IsActive)
+	if err != nil {
+		log.Error().Msgf("updating account %d: %v", accountID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account)
+}
+
+// handleDelete function handles DELETE requests.
+//
+// It removes the account matching the accountID (e.g. DELETE BASE_URL/{accountID}).
+func handleDelete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, err := parseAccountID(params)
+	if err != nil {
+		log.Error().Msgf("invalid accountId value: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if err := persistence.DB.DeleteAccount(r.Context(), accountID); err != nil {
+		log.Error().Msgf("deleting account %d: %v", accountID, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errorBody is the JSON body of error responses.
+type errorBody struct {
+	Status int
+	Error  string
+}
+
+// writeError is a helper function that writes an error response with a JSON body.
+func writeError(w http.ResponseWriter, status int, message string) {
+	body, err := json.Marshal(errorBody{
+		Status: status,
+		Error:  message,
+	})
+	if err != nil {
+		log.Error().Msgf("serializing error to JSON: %v", err)
+		http.Error(w, message, status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(body); err != nil {
+		log.Error().Msgf("writing error body: %v", err)
+	}
+}
+
+// writeJSON is a helper function that writes a response with the JSON representation of v.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Msgf("serializing to JSON: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(body); err != nil {
+		log.Error().Msgf("writing body: %v", err)
+	}
+}
+
+// databaseStatus is a helper function that returns the response status for a failed database operation.
+//
+// Missing accounts, dead letters and API keys are reported as 404 Not Found and all other errors as 500 Internal Server Error.
+func databaseStatus(err error) int {
+	if errors.Is(err, persistence.ErrAccountNotFound) || errors.Is(err, persistence.ErrDeadLetterNotFound) ||
+		errors.Is(err, persistence.ErrAPIKeyNotFound) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// readJSON is a helper function that checks the content type of the request and deserializes its JSON body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		return errors.New("incorrect content type")
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %v", err)
+	}
+
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return fmt.Errorf("invalid JSON format in the body: %v", err)
+	}
+
+	return nil
+}
+
+// readPayload is a helper function that reads the JSON object payload from the request body.
+//
+// It returns the response status if the payload is invalid.
+func readPayload(r *http.Request) ([]byte, int, error) {
+	defer r.Body.Close()
+
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		return nil, http.StatusUnsupportedMediaType, errors.New("incorrect content type")
+	}
+
+	// read one byte more to find out if the body is too large
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEventBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("reading body: %v", err)
+	}
+
+	if len(payload) > maxEventBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body is larger than %d bytes", maxEventBodySize)
+	}
+
+	if !json.Valid(payload) || !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return nil, http.StatusBadRequest, errors.New("body should be a JSON object")
+	}
+
+	return payload, http.StatusOK, nil
+}
+
+// parseAccountFilter is a helper function to parse the account filter from the query parameters.
+func parseAccountFilter(query url.Values) (persistence.AccountFilter, error) {
+	filter := persistence.AccountFilter{
+		NamePrefix: query.Get("name_prefix"),
+		Limit:      defaultListLimit,
+	}
+
+	if active := query.Get("active"); active != "" {
+		isActive, err := strconv.ParseBool(active)
+		if err != nil {
+			return filter, fmt.Errorf("invalid active %s: %v", active, err)
+		}
+
+		filter.Active = &isActive
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxListLimit {
+			return filter, fmt.Errorf("limit %s should be a number between 1 and %d", limit, maxListLimit)
+		}
+
+		filter.Limit = l
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		afterID, err := decodeCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+
+		filter.AfterID = afterID
+	}
+
+	return filter, nil
+}
+
+// encodeCursor returns an opaque pagination cursor pointing after the given ID.
+func encodeCursor(ID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(ID)))
+}
+
+// decodeCursor returns the ID the pagination cursor is pointing after.
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return -1, fmt.Errorf("invalid cursor %s: %v", cursor, err)
+	}
+
+	ID, err := strconv.Atoi(string(decoded))
+	if err != nil {
+		return -1, fmt.Errorf("invalid cursor %s: %v", cursor, err)
+	}
+
+	return ID, nil
+}
+
+// parseEventFilter is a helper function to parse the event filter from the query parameters.
+func parseEventFilter(query url.Values) (persistence.EventFilter, error) {
+	filter := persistence.EventFilter{
+		Limit: defaultListLimit,
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from %s: %v", from, err)
+		}
+
+		filter.From = t
+	}
+
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339Nano, to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to %s: %v", to, err)
+		}
+
+		filter.To = t
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxListLimit {
+			return filter, fmt.Errorf("limit %s should be a number between 1 and %d", limit, maxListLimit)
+		}
+
+		filter.Limit = l
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		event, err := decodeEventCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+
+		filter.AfterTimestamp = event.Timestamp
+		filter.AfterID = event.ID
+	}
+
+	return filter, nil
+}
+
+// encodeEventCursor returns an opaque pagination cursor pointing after the given event.
+func encodeEventCursor(event *dto.Event) string {
+	cursor := fmt.Sprintf("%s/%d", event.Timestamp.Format(time.RFC3339Nano), event.ID)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+// decodeEventCursor returns the timestamp and the ID of the event the pagination cursor is pointing after.
+func decodeEventCursor(cursor string) (*dto.Event, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s: %v", cursor, err)
+	}
+
+	parts := strings.SplitN(string(decoded), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor %s", cursor)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s: %v", cursor, err)
+	}
+
+	ID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s: %v", cursor, err)
+	}
+
+	return &dto.Event{ID: ID, Timestamp: timestamp}, nil
+}
+
+// storedEvent converts the published event to the event stored in the event log.
+func storedEvent(event *pubsub.Event) *dto.Event {
+	return &dto.Event{
+		EventID:     event.ID,
+		AccountID:   event.AccountID,
+		Timestamp:   event.Timestamp,
+		EventTime:   event.EventTime,
+		Data:        event.Text(),
+		Source:      event.Source,
+		ContentType: event.ContentType,
+	}
+}
+
+// ingestMode returns the ingestion mode requested with the X-Ingest-Mode header or the DefaultIngestMode.
+func ingestMode(r *http.Request) (string, error) {
+	switch mode := r.Header.Get("X-Ingest-Mode"); mode {
+	case "":
+		return DefaultIngestMode, nil
+	case IngestAsync, IngestSync:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown ingest mode: %s", mode)
+	}
 }
 
 // parseAccountID is a helper function to parse account ID from the request context.
@@ -6,23 +6,33 @@ import (
 	"celtra-programming-assigment/pkg/dto"
 	"celtra-programming-assigment/pkg/persistence"
 	"celtra-programming-assigment/pkg/pubsub"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 // mockedDB implements persistence.Database interface and exposes
 // functions that can be used to mock the database response.
 type mockedDB struct {
-	FnIsActiveAccount func(ID int) (bool, error)
-	FnCreateAccount   func(name string, isActive bool) (*dto.Account, error)
-	FnGetAccount      func(ID int) (*dto.Account, error)
+	FnIsActiveAccount  func(ID int) (bool, error)
+	FnIsActiveAccounts func(IDs []int) (map[int]bool, error)
+	FnCreateAccount    func(name string, isActive bool) (*dto.Account, error)
+	FnGetAccount       func(ID int) (*dto.Account, error)
+	FnUpdateAccount    func(ID int, name string) (*dto.Account, error)
+	FnSetActive        func(ID int, isActive bool) error
+	FnPatchAccount     func(ID int, name *string, isActive *bool) (*dto.Account, error)
+	FnDeleteAccount    func(ID int) error
+	FnListAccounts     func(filter persistence.AccountFilter) ([]*dto.Account, error)
 }
 
-func (m *mockedDB) IsActiveAccount(ID int) (bool, error) {
+func (m *mockedDB) IsActiveAccount(ctx context.Context, ID int) (bool, error) {
 	if m.FnIsActiveAccount == nil {
 		return false, errorNotImplemented
 	}
@@ -30,7 +40,15 @@ func (m *mockedDB) IsActiveAccount(ID int) (bool, error) {
 	return m.FnIsActiveAccount(ID)
 }
 
-func (m *mockedDB) CreateAccount(name string, isActive bool) (*dto.Account, error) {
+func (m *mockedDB) IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error) {
+	if m.FnIsActiveAccounts == nil {
+		return nil, errorNotImplemented
+	}
+
+	return m.FnIsActiveAccounts(IDs)
+}
+
+func (m *mockedDB) CreateAccount(ctx context.Context, name string, isActive bool) (*dto.Account, error) {
 	if m.FnCreateAccount == nil {
 		return nil, errorNotImplemented
 	}
@@ -38,7 +56,7 @@ func (m *mockedDB) CreateAccount(name string, isActive bool) (*dto.Account, erro
 	return m.FnCreateAccount(name, isActive)
 }
 
-func (m *mockedDB) GetAccount(ID int) (*dto.Account, error) {
+func (m *mockedDB) GetAccount(ctx context.Context, ID int) (*dto.Account, error) {
 	if m.FnGetAccount == nil {
 		return nil, errorNotImplemented
 	}
@@ -46,27 +64,85 @@ func (m *mockedDB) GetAccount(ID int) (*dto.Account, error) {
 	return m.FnGetAccount(ID)
 }
 
+func (m *mockedDB) UpdateAccount(ctx context.Context, ID int, name string) (*dto.Account, error) {
+	if m.FnUpdateAccount == nil {
+		return nil, errorNotImplemented
+	}
+
+	return m.FnUpdateAccount(ID, name)
+}
+
+func (m *mockedDB) SetActive(ctx context.Context, ID int, isActive bool) error {
+	if m.FnSetActive == nil {
+		return errorNotImplemented
+	}
+
+	return m.FnSetActive(ID, isActive)
+}
+
+func (m *mockedDB) PatchAccount(ctx context.Context, ID int, name *string, isActive *bool) (*dto.Account, error) {
+	if m.FnPatchAccount == nil {
+		return nil, errorNotImplemented
+	}
+
+	return m.FnPatchAccount(ID, name, isActive)
+}
+
+func (m *mockedDB) DeleteAccount(ctx context.Context, ID int) error {
+	if m.FnDeleteAccount == nil {
+		return errorNotImplemented
+	}
+
+	return m.FnDeleteAccount(ID)
+}
+
+func (m *mockedDB) ListAccounts(ctx context.Context, filter persistence.AccountFilter) ([]*dto.Account, error) {
+	if m.FnListAccounts == nil {
+		return nil, errorNotImplemented
+	}
+
+	return m.FnListAccounts(filter)
+}
+
 // mockedBus implements pubsub.PubSub interface and exposes
 // functions that can be used to mock the publish/subscribe calls.
 type mockedBus struct {
-	FnPublish   func(accountID int, data string) error
-	FnSubscribe func() chan *pubsub.Event
+	FnPublish          func(event *pubsub.Event) error
+	FnSubscribe        func(replay pubsub.Replay, accountIDs []int) (*pubsub.Subscription, error)
+	FnPublishControl   func(message *pubsub.ControlMessage) error
+	FnSubscribeControl func() chan *pubsub.ControlMessage
 }
 
-func (b *mockedBus) Publish(accountID int, data string) error {
+func (b *mockedBus) Publish(ctx context.Context, event *pubsub.Event) error {
 	if b.FnPublish == nil {
 		return errorNotImplemented
 	}
 
-	return b.FnPublish(accountID, data)
+	return b.FnPublish(event)
 }
 
-func (b *mockedBus) Subscribe() chan *pubsub.Event {
+func (b *mockedBus) Subscribe(ctx context.Context, replay pubsub.Replay, accountIDs ...int) (*pubsub.Subscription, error) {
 	if b.FnSubscribe == nil {
+		return nil, errorNotImplemented
+	}
+
+	return b.FnSubscribe(replay, accountIDs)
+}
+
+func (b *mockedBus) PublishControl(ctx context.Context, message *pubsub.ControlMessage) error {
+	if b.FnPublishControl == nil {
+		return errorNotImplemented
+	}
+
+	return b.FnPublishControl(message)
+}
+
+func (b *mockedBus) SubscribeControl(ctx context.Context) chan *pubsub.ControlMessage {
+	if b.FnSubscribeControl == nil {
 		return nil
 	}
 
-	return b.FnSubscribe()
+	return b.FnSubscribeControl()
 }
 
 var (
@@ -89,6 +165,7 @@ func TestMain(m *testing.M) {
 	// pubsub mock
 	fakeBus = &mockedBus{}
 	pubsub.Bus = fakeBus
+	pubsub.Queue = pubsub.NewPublisher(fakeBus, 1, 100, nil)
 
 	m.Run()
 }
@@ -295,7 +372,7 @@ func Test_Put(t *testing.T) {
 		return account.IsActive, nil
 	}
 
-	fakeBus.FnPublish = func(accountID int, data string) error {
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
 		return nil
 	}
 
@@ -321,7 +398,7 @@ func Test_PutNotActive(t *testing.T) {
 		return false, nil
 	}
 
-	fakeBus.FnPublish = func(accountID int, data string) error {
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
 		return nil
 	}
 
@@ -352,7 +429,7 @@ func Test_PutNoData(t *testing.T) {
 		return account.IsActive, nil
 	}
 
-	fakeBus.FnPublish = func(accountID int, data string) error {
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
 		return nil
 	}
 
@@ -389,3 +466,985 @@ func Test_PutInvalidParam(t *testing.T) {
 		t.Fatalf("expected %d but got %d", http.StatusBadRequest, resp.StatusCode)
 	}
 }
+
+func Test_PutMemoryBus(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	// publish through a real in-memory bus instead of the mock
+	bus := &pubsub.Memory{}
+	queue := pubsub.Queue
+	pubsub.Bus = bus
+	pubsub.Queue = pubsub.NewPublisher(bus, 1, 100, nil)
+	defer func() {
+		pubsub.Queue.Close()
+		pubsub.Bus = fakeBus
+		pubsub.Queue = queue
+	}()
+
+	sub, err := bus.Subscribe(context.Background(), pubsub.Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	select {
+	case event := <-sub.Events():
+		if event.AccountID != 1 {
+			t.Fatalf("expected %d but got %d", 1, event.AccountID)
+		}
+		if event.Text() != "testdata" || event.Source != hostname {
+			t.Fatalf("expected testdata from %s but got %s from %s", hostname, event.Text(), event.Source)
+		}
+		if event.ID == "" || event.Version != pubsub.EventVersion {
+			t.Fatalf("expected an event envelope but got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+}
+
+func Test_PutQueueFull(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	// the bus doesn't accept any events until the test ends
+	blocked := make(chan struct{})
+	bus := &mockedBus{
+		FnPublish: func(event *pubsub.Event) error {
+			<-blocked
+			return nil
+		},
+	}
+
+	store := &recordingStore{}
+	queue := pubsub.Queue
+	pubsub.Queue = pubsub.NewPublisher(bus, 1, 1, nil)
+	pubsub.Queue.OnPublish = Published
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() {
+		pubsub.Queue = queue
+		persistence.EventLog = nil
+	}()
+
+	accepted, status := 0, 0
+	for i := 0; i < 5 && status != http.StatusServiceUnavailable; i++ {
+		req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("PUT request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		status = resp.StatusCode
+		if status == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("expected Retry-After header")
+		}
+		if status == http.StatusAccepted {
+			accepted++
+		}
+	}
+
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, status)
+	}
+
+	if dropped := pubsub.Queue.Stats().Dropped; dropped != 1 {
+		t.Fatalf("expected %d dropped event but got %d", 1, dropped)
+	}
+
+	// the accepted events are stored once they are published, the rejected event is never stored
+	close(blocked)
+	pubsub.Queue.Close()
+	persistence.EventLog.Close()
+
+	if len(store.events) != accepted {
+		t.Fatalf("expected %d stored events but got %d", accepted, len(store.events))
+	}
+}
+
+func Test_PutSync(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	published := []*pubsub.Event{}
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		published = append(published, event)
+		return nil
+	}
+
+	store := &recordingStore{}
+	events, eventLog := persistence.Events, persistence.EventLog
+	persistence.Events = store
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() {
+		persistence.EventLog.Close()
+		persistence.Events, persistence.EventLog = events, eventLog
+	}()
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("X-Ingest-Mode", "sync")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	body := struct{ ID string }{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	// the event is already published and stored when the response is received
+	if len(published) != 1 || published[0].ID != body.ID {
+		t.Fatalf("expected published event %s but got %v", body.ID, published)
+	}
+
+	if len(store.events) != 1 || store.events[0].EventID != body.ID {
+		t.Fatalf("expected stored event %s but got %v", body.ID, store.events)
+	}
+}
+
+func Test_PutSyncPublishError(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		return errors.New("bus is down")
+	}
+	defer func() {
+		fakeBus.FnPublish = func(event *pubsub.Event) error {
+			return nil
+		}
+	}()
+
+	// the deployment default is used without the header
+	DefaultIngestMode = IngestSync
+	defer func() { DefaultIngestMode = IngestAsync }()
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func Test_PutSyncStoreError(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	published := []*pubsub.Event{}
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		published = append(published, event)
+		return nil
+	}
+
+	// storing fails synchronously, the event log stores the event later
+	store := &recordingStore{}
+	events, eventLog := persistence.Events, persistence.EventLog
+	persistence.Events = &failingStore{}
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() {
+		persistence.Events, persistence.EventLog = events, eventLog
+	}()
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("X-Ingest-Mode", "sync")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the event was published, so the client shouldn't retry
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	body := struct {
+		ID    string
+		Error string
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if len(published) != 1 || published[0].ID != body.ID || body.Error == "" {
+		t.Fatalf("expected published event %s with an error but got %+v", body.ID, body)
+	}
+
+	persistence.EventLog.Close()
+
+	if len(store.events) != 1 || store.events[0].EventID != body.ID {
+		t.Fatalf("expected stored event %s but got %v", body.ID, store.events)
+	}
+}
+
+func Test_PutBadIngestMode(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("X-Ingest-Mode", "eventually")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func Test_Rate(t *testing.T) {
+	resp, err := server.Client().Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	rate := map[string]int64{}
+	if err := json.NewDecoder(resp.Body).Decode(&rate); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	for _, metric := range []string{"Rate", "QueueDepth", "Dropped", "Failed", "Spooled", "SpoolDepth"} {
+		if _, ok := rate[metric]; !ok {
+			t.Fatalf("expected %s metric in %v", metric, rate)
+		}
+	}
+}
+
+func Test_Patch(t *testing.T) {
+	patched := map[int]*dto.Account{
+		2: {ID: 2, Name: "old name", IsActive: true},
+	}
+
+	fakeDB.FnPatchAccount = func(ID int, name *string, isActive *bool) (*dto.Account, error) {
+		account, ok := patched[ID]
+		if !ok {
+			return nil, errors.New("no account")
+		}
+		if name != nil {
+			account.Name = *name
+		}
+		if isActive != nil {
+			account.IsActive = *isActive
+		}
+
+		return account, nil
+	}
+
+	req, err := http.NewRequest("PATCH", server.URL+"/2", strings.NewReader(`{"Name":"new name","IsActive":false}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PATCH request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	account := &dto.Account{}
+	if err := json.Unmarshal(body, account); err != nil {
+		t.Fatalf("unmarshaling body: %v", err)
+	}
+
+	if account.Name != "new name" {
+		t.Fatalf("expected %s but got %s", "new name", account.Name)
+	}
+
+	if account.IsActive {
+		t.Fatalf("account is still active")
+	}
+}
+
+func Test_PatchDeactivateOnly(t *testing.T) {
+	fakeDB.FnPatchAccount = func(ID int, name *string, isActive *bool) (*dto.Account, error) {
+		if name != nil {
+			t.Errorf("name should not be updated")
+		}
+		if isActive == nil || *isActive {
+			t.Errorf("expected account to be deactivated")
+		}
+
+		return &dto.Account{ID: ID, Name: "test account"}, nil
+	}
+
+	req, err := http.NewRequest("PATCH", server.URL+"/2", strings.NewReader(`{"IsActive":false}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PATCH request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func Test_PatchBadBody(t *testing.T) {
+	for _, body := range []string{`{}`, `{"Name":""}`, `"bad body"`} {
+		req, err := http.NewRequest("PATCH", server.URL+"/2", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("PATCH request failed: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d but got %d", body, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func Test_PatchBadDatabase(t *testing.T) {
+	fakeDB.FnPatchAccount = func(ID int, name *string, isActive *bool) (*dto.Account, error) {
+		return nil, errors.New("bad database")
+	}
+
+	req, err := http.NewRequest("PATCH", server.URL+"/2", strings.NewReader(`{"IsActive":true}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PATCH request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d but got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func Test_Delete(t *testing.T) {
+	deleted := 0
+	fakeDB.FnDeleteAccount = func(ID int) error {
+		deleted = ID
+
+		return nil
+	}
+
+	req, err := http.NewRequest("DELETE", server.URL+"/3", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("DELETE request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if deleted != 3 {
+		t.Fatalf("expected %d but got %d", 3, deleted)
+	}
+}
+
+func Test_DeleteBadDatabase(t *testing.T) {
+	fakeDB.FnDeleteAccount = func(ID int) error {
+		return errors.New("bad database")
+	}
+
+	req, err := http.NewRequest("DELETE", server.URL+"/3", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("DELETE request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d but got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func Test_List(t *testing.T) {
+	var received persistence.AccountFilter
+	fakeDB.FnListAccounts = func(filter persistence.AccountFilter) ([]*dto.Account, error) {
+		received = filter
+
+		listed := []*dto.Account{}
+		for id := filter.AfterID + 1; id <= 10 && len(listed) < filter.Limit; id++ {
+			listed = append(listed, &dto.Account{ID: id, Name: "foo", IsActive: true})
+		}
+
+		return listed, nil
+	}
+
+	page := struct {
+		Accounts   []*dto.Account
+		NextCursor string
+	}{}
+
+	getPage := func(url string) {
+		resp, err := server.Client().Get(url)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("unmarshaling body: %v", err)
+		}
+	}
+
+	getPage(server.URL + "/accounts?active=true&name_prefix=foo&limit=4")
+
+	if received.Active == nil || !*received.Active || received.NamePrefix != "foo" || received.AfterID != 0 {
+		t.Fatalf("unexpected filter: %+v", received)
+	}
+
+	if len(page.Accounts) != 4 || page.Accounts[0].ID != 1 || page.Accounts[3].ID != 4 {
+		t.Fatalf("expected accounts 1-4 but got %v", page.Accounts)
+	}
+
+	if page.NextCursor == "" {
+		t.Fatalf("expected a cursor for the next page")
+	}
+
+	getPage(server.URL + "/accounts?limit=4&cursor=" + page.NextCursor)
+
+	if received.Active != nil || received.AfterID != 4 {
+		t.Fatalf("unexpected filter: %+v", received)
+	}
+
+	if len(page.Accounts) != 4 || page.Accounts[0].ID != 5 {
+		t.Fatalf("expected accounts 5-8 but got %v", page.Accounts)
+	}
+
+	// last page has no cursor
+	getPage(server.URL + "/accounts?limit=4&cursor=" + page.NextCursor)
+
+	if len(page.Accounts) != 2 || page.Accounts[1].ID != 10 {
+		t.Fatalf("expected accounts 9-10 but got %v", page.Accounts)
+	}
+
+	if page.NextCursor != "" {
+		t.Fatalf("expected no cursor on the last page but got %s", page.NextCursor)
+	}
+}
+
+func Test_ListInvalidParams(t *testing.T) {
+	for _, query := range []string{"active=maybe", "limit=0", "limit=asd", "limit=1001", "cursor=!!!"} {
+		resp, err := server.Client().Get(server.URL + "/accounts?" + query)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d but got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func Test_ListBadDatabase(t *testing.T) {
+	fakeDB.FnListAccounts = func(filter persistence.AccountFilter) ([]*dto.Account, error) {
+		return nil, errors.New("bad database")
+	}
+
+	resp, err := server.Client().Get(server.URL + "/accounts")
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d but got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func Test_PutStoresEvent(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		return nil
+	}
+
+	store := &recordingStore{}
+	queue := pubsub.Queue
+	pubsub.Queue = pubsub.NewPublisher(fakeBus, 1, 100, nil)
+	pubsub.Queue.OnPublish = Published
+	persistence.EventLog = persistence.NewEventWriter(store, 10, time.Hour, 10)
+	defer func() {
+		pubsub.Queue = queue
+		persistence.EventLog = nil
+	}()
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata&eventTime=2021-02-06T18:35:30%2B01:00", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	// closing the publisher publishes the queued events and closing the event log stores them
+	pubsub.Queue.Close()
+	persistence.EventLog.Close()
+
+	if len(store.events) != 1 {
+		t.Fatalf("expected %d stored event but got %d", 1, len(store.events))
+	}
+
+	event := store.events[0]
+	if event.AccountID != 1 || event.Data != "testdata" || event.Source != hostname || event.EventID == "" || event.ContentType != pubsub.ContentTypeText {
+		t.Fatalf("unexpected stored event: %+v", event)
+	}
+
+	if event.EventTime == nil || !event.EventTime.Equal(time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC)) {
+		t.Fatalf("unexpected event time: %v", event.EventTime)
+	}
+}
+
+func Test_PutBadEventTime(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata&eventTime=yesterday", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func Test_PutJSON(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	published := []*pubsub.Event{}
+	fakeBus.FnPublish = func(event *pubsub.Event) error {
+		published = append(published, event)
+		return nil
+	}
+
+	for _, method := range []string{"PUT", "POST"} {
+		body := `{"campaign": "spring", "clicks": 3, "tags": ["a", "b"]}`
+		req, err := http.NewRequest(method, server.URL+"/1/events?eventTime=2021-02-06T17:00:00Z", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Ingest-Mode", "sync")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", method, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected %d but got %d", http.StatusCreated, resp.StatusCode)
+		}
+	}
+
+	if len(published) != 2 {
+		t.Fatalf("expected %d published events but got %d", 2, len(published))
+	}
+
+	// the payload is carried as structured data
+	event := published[0]
+	if event.ContentType != pubsub.ContentTypeJSON || string(event.Data) != `{"campaign":"spring","clicks":3,"tags":["a","b"]}` {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	if event.EventTime == nil || !event.EventTime.Equal(time.Date(2021, 2, 6, 17, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected event time %v", event.EventTime)
+	}
+}
+
+func Test_PutJSONInvalid(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return true, nil
+	}
+
+	for _, request := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"text/plain", `{"key": "value"}`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"key": `, http.StatusBadRequest},
+		{"application/json", `"text"`, http.StatusBadRequest},
+		{"application/json", `[1, 2]`, http.StatusBadRequest},
+		{"application/json", `{"key": "` + strings.Repeat("x", maxEventBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest("POST", server.URL+"/1/events", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", request.contentType)
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != request.status {
+			t.Fatalf("%s %.20s: expected %d but got %d", request.contentType, request.body, request.status, resp.StatusCode)
+		}
+	}
+}
+
+// recordingStore implements persistence.EventStore interface and records the stored events.
+type recordingStore struct {
+	events []*dto.Event
+}
+
+func (s *recordingStore) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	s.events = append(s.events, events...)
+
+	return nil
+}
+
+func (s *recordingStore) ListEvents(ctx context.Context, filter persistence.EventFilter) ([]*dto.Event, error) {
+	return nil, errorNotImplemented
+}
+
+// failingStore implements persistence.EventStore interface and fails to store events.
+type failingStore struct{}
+
+func (s *failingStore) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	return errors.New("database is down")
+}
+
+func (s *failingStore) ListEvents(ctx context.Context, filter persistence.EventFilter) ([]*dto.Event, error) {
+	return nil, errorNotImplemented
+}
+
+func Test_Events(t *testing.T) {
+	// use the in-memory event store
+	db, events := persistence.DB, persistence.Events
+	defer func() { persistence.DB, persistence.Events = db, events }()
+
+	if err := persistence.NewMemory(); err != nil {
+		t.Fatalf("creating memory database: %v", err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if _, err := persistence.DB.CreateAccount(context.Background(), name, true); err != nil {
+			t.Fatalf("creating account: %v", err)
+		}
+	}
+
+	start := time.Date(2021, 2, 6, 17, 0, 0, 0, time.UTC)
+	stored := []*dto.Event{}
+	for i := 0; i < 5; i++ {
+		stored = append(stored, &dto.Event{AccountID: 1, Timestamp: start.Add(time.Duration(i) * time.Minute), Data: fmt.Sprint(i), Source: "test"})
+		stored = append(stored, &dto.Event{AccountID: 2, Timestamp: start.Add(time.Duration(i) * time.Minute), Data: fmt.Sprint(i), Source: "test"})
+	}
+
+	if err := persistence.Events.StoreEvents(context.Background(), stored); err != nil {
+		t.Fatalf("storing events: %v", err)
+	}
+
+	page := struct {
+		Events     []*dto.Event
+		NextCursor string
+	}{}
+
+	getPage := func(url string) {
+		resp, err := server.Client().Get(url)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("unmarshaling body: %v", err)
+		}
+
+		if cursor := resp.Header.Get("X-Next-Cursor"); cursor != page.NextCursor {
+			t.Fatalf("expected cursor header %s but got %s", page.NextCursor, cursor)
+		}
+	}
+
+	// events from 17:01 (inclusive) to 17:04 (exclusive)
+	getPage(server.URL + "/1/events?from=2021-02-06T17:01:00Z&to=2021-02-06T17:04:00Z&limit=2")
+
+	if len(page.Events) != 2 || page.Events[0].Data != "1" || page.Events[1].Data != "2" || page.Events[0].AccountID != 1 {
+		t.Fatalf("expected events 1 and 2 but got %v", page.Events)
+	}
+
+	if page.NextCursor == "" {
+		t.Fatalf("expected a cursor for the next page")
+	}
+
+	getPage(server.URL + "/1/events?from=2021-02-06T17:01:00Z&to=2021-02-06T17:04:00Z&limit=2&cursor=" + page.NextCursor)
+
+	if len(page.Events) != 1 || page.Events[0].Data != "3" {
+		t.Fatalf("expected event 3 but got %v", page.Events)
+	}
+
+	if page.NextCursor != "" {
+		t.Fatalf("expected no cursor on the last page but got %s", page.NextCursor)
+	}
+}
+
+func Test_EventsNDJSON(t *testing.T) {
+	db, events := persistence.DB, persistence.Events
+	defer func() { persistence.DB, persistence.Events = db, events }()
+
+	if err := persistence.NewMemory(); err != nil {
+		t.Fatalf("creating memory database: %v", err)
+	}
+
+	if _, err := persistence.DB.CreateAccount(context.Background(), "first", true); err != nil {
+		t.Fatalf("creating account: %v", err)
+	}
+
+	stored := []*dto.Event{
+		{AccountID: 1, Timestamp: time.Now().UTC(), Data: "first", Source: "test"},
+		{AccountID: 1, Timestamp: time.Now().UTC(), Data: "second", Source: "test"},
+	}
+
+	if err := persistence.Events.StoreEvents(context.Background(), stored); err != nil {
+		t.Fatalf("storing events: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/1/events", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Fatalf("expected %s but got %s", "application/x-ndjson", contentType)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected %d lines but got %d", 2, len(lines))
+	}
+
+	event := &dto.Event{}
+	if err := json.Unmarshal([]byte(lines[1]), event); err != nil {
+		t.Fatalf("unmarshaling line: %v", err)
+	}
+
+	if event.Data != "second" {
+		t.Fatalf("expected %s but got %s", "second", event.Data)
+	}
+}
+
+func Test_EventsInvalidParams(t *testing.T) {
+	for _, path := range []string{"/asd/events", "/1/events?from=yesterday", "/1/events?to=1", "/1/events?limit=0", "/1/events?cursor=MQ"} {
+		resp, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d but got %d", path, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func Test_NotFound(t *testing.T) {
+	fakeDB.FnGetAccount = func(ID int) (*dto.Account, error) {
+		return nil, persistence.ErrAccountNotFound
+	}
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return false, persistence.ErrAccountNotFound
+	}
+	fakeDB.FnPatchAccount = func(ID int, name *string, isActive *bool) (*dto.Account, error) {
+		return nil, persistence.ErrAccountNotFound
+	}
+	fakeDB.FnDeleteAccount = func(ID int) error {
+		return persistence.ErrAccountNotFound
+	}
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/666", ""},
+		{"PUT", "/666?data=testdata", ""},
+		{"PATCH", "/666", `{"IsActive":false}`},
+		{"DELETE", "/666", ""},
+		{"GET", "/666/events", ""},
+	}
+
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, server.URL+r.path, strings.NewReader(r.body))
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", r.method, err)
+		}
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected %d but got %d", r.method, http.StatusNotFound, resp.StatusCode)
+		}
+
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("%s: expected %s but got %s", r.method, "application/json", contentType)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+
+		errBody := errorBody{}
+		if err := json.Unmarshal(body, &errBody); err != nil {
+			t.Fatalf("unmarshaling body: %v", err)
+		}
+
+		if errBody.Status != http.StatusNotFound || errBody.Error != persistence.ErrAccountNotFound.Error() {
+			t.Fatalf("%s: unexpected error body: %s", r.method, body)
+		}
+	}
+}
+
+func Test_PutBadDatabase(t *testing.T) {
+	fakeDB.FnIsActiveAccount = func(ID int) (bool, error) {
+		return false, errors.New("bad database")
+	}
+
+	req, err := http.NewRequest("PUT", server.URL+"/1?data=testdata", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %d but got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
@@ -0,0 +1,57 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// router dispatches requests to handlers registered with httprouter.
+//
+// httprouter doesn't allow a static path segment next to a wildcard (e.g. /accounts and /:accountId),
+// so routes starting with a static segment are kept in a separate router which is selected by the first path segment.
+type router struct {
+	accounts *httprouter.Router  // routes starting with the /:accountId wildcard
+	static   *httprouter.Router  // routes starting with a static segment
+	prefixes map[string]struct{} // first path segments of the static routes
+}
+
+// newRouter creates a new router without any registered routes.
+func newRouter() *router {
+	return &router{
+		accounts: httprouter.New(),
+		static:   httprouter.New(),
+		prefixes: map[string]struct{}{},
+	}
+}
+
+// Handle registers a new request handler with the given path and method.
+func (rt *router) Handle(method string, path string, handle httprouter.Handle) {
+	segment := firstSegment(path)
+	if segment == "" || strings.HasPrefix(segment, ":") {
+		rt.accounts.Handle(method, path, handle)
+
+		return
+	}
+
+	rt.prefixes[segment] = struct{}{}
+	rt.static.Handle(method, path, handle)
+}
+
+// ServeHTTP makes the router implement the http.Handler interface.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := rt.prefixes[firstSegment(r.URL.Path)]; ok {
+		rt.static.ServeHTTP(w, r)
+
+		return
+	}
+
+	rt.accounts.ServeHTTP(w, r)
+}
+
+// firstSegment returns the first segment of the path (e.g. "accounts" for "/accounts/1").
+func firstSegment(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
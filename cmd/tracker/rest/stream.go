@@ -0,0 +1,388 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/persistence"
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxStreamAccounts is the maximum number of accounts of a single stream
+	maxStreamAccounts = 100
+	// streamRetry is the time after which a disconnected client should reconnect to the stream
+	streamRetry = 3 * time.Second
+)
+
+var (
+	// HeartbeatInterval is the time between heartbeats of idle event streams,
+	// they keep proxies from closing the connection.
+	HeartbeatInterval = 15 * time.Second
+
+	// shutdown is closed when the service is shutting down, so the open streams end
+	shutdown     = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// CloseStreams ends all open event streams, it should be called when the service is shutting down,
+// otherwise the streams keep their connections open until the clients disconnect.
+func CloseStreams() {
+	shutdownOnce.Do(func() {
+		close(shutdown)
+	})
+}
+
+// handleStream function handles GET requests.
+//
+// It streams the events of the account as Server-Sent Events (e.g. GET BASE_URL/{accountID}/stream).
+func handleStream(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	accountID, err := parseAccountID(params)
+	if err != nil {
+		log.Error().Msgf("invalid accountId value: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	stream(w, r, []int{accountID})
+}
+
+// handleStreamAccounts function handles GET requests.
+//
+// It streams the events of multiple accounts as Server-Sent Events (e.g. GET BASE_URL/stream?accounts=1,2,3).
+func handleStreamAccounts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	accountIDs, err := parseAccountIDs(r.URL.Query().Get("accounts"))
+	if err != nil {
+		log.Error().Msgf("invalid accounts value: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	for _, accountID := range accountIDs {
+		if !canAccess(r, accountID) {
+			log.Error().Msgf("API key %d can't access account %d", requestAPIKey(r).ID, accountID)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("API key can't access account %d", accountID))
+
+			return
+		}
+	}
+
+	stream(w, r, accountIDs)
+}
+
+// stream subscribes to the events of the accounts and writes them as Server-Sent Events
+// until the client disconnects or the service shuts down.
+//
+// The ID of every event is its cursor (if the messaging bus stores events), so a reconnecting client
+// resumes after the last received event with the Last-Event-ID header or the lastEventId query parameter.
+// Only Redis Streams store the events, other messaging buses reject resuming with pubsub.ErrReplayNotSupported.
+// Streams of multiple accounts send the last cursor of every account as the ID (see streamCursors),
+// because the cursors of different accounts' streams aren't ordered. The ID with the cursors where every account's
+// stream started is sent first, so accounts without received events don't skip the events published while
+// the client was disconnected.
+// Changes of the subscription's health are sent as "status" events and a comment is sent
+// when nothing was sent for HeartbeatInterval.
+func stream(w http.ResponseWriter, r *http.Request, accountIDs []int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error().Msgf("response writer doesn't support streaming")
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+
+		return
+	}
+
+	if err := checkAccounts(r.Context(), accountIDs); err != nil {
+		log.Error().Msgf("streaming accounts %v: %v", accountIDs, err)
+		writeError(w, databaseStatus(err), err.Error())
+
+		return
+	}
+
+	replay, err := parseLastEventID(lastEventID(r), accountIDs)
+	if err != nil {
+		log.Error().Msgf("invalid last event ID: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// the stream ends when its API key is revoked
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer openSession(r, cancel)()
+
+	sub, err := pubsub.Bus.Subscribe(ctx, replay, accountIDs...)
+	if err != nil {
+		log.Error().Msgf("subscribing to events of accounts %v: %v", accountIDs, err)
+
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, pubsub.ErrReplayNotSupported) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err.Error())
+
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx buffers the responses of upstream servers, which would delay the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// the cursors of a multi account stream resume after the last received event of every account,
+	// accounts without received events resume where the subscription started
+	var cursors streamCursors
+	if len(accountIDs) > 1 {
+		cursors = streamCursors(sub.Cursors())
+		if cursors == nil {
+			cursors = streamCursors{}
+		}
+	}
+
+	if err := writeStreamStart(w, cursors); err != nil {
+		log.Error().Msgf("writing stream of accounts %v: %v", accountIDs, err)
+
+		return
+	}
+	flusher.Flush()
+
+	interval := HeartbeatInterval
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+
+	events, statuses := sub.Events(), sub.Status()
+	for {
+		var err error
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// the client disconnected or the API key was revoked
+				return
+			}
+
+			ID := event.Cursor
+			if cursors != nil && ID != "" {
+				cursors[event.AccountID] = ID
+				ID = cursors.String()
+			}
+
+			err = writeStreamEvent(w, event, ID)
+		case status, ok := <-statuses:
+			if !ok {
+				statuses = nil
+
+				continue
+			}
+
+			err = writeStreamStatus(w, status)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case <-shutdown:
+			return
+		}
+
+		if err != nil {
+			log.Error().Msgf("writing stream of accounts %v: %v", accountIDs, err)
+
+			return
+		}
+		flusher.Flush()
+
+		// the connection isn't idle after an event or a status was sent, so the next heartbeat can wait
+		heartbeat.Reset(interval)
+	}
+}
+
+// writeStreamStart writes the reconnection time of the stream and the cursors where the stream started, if any.
+//
+// The cursors are sent as an ID without data, which sets the last event ID of the client without dispatching an event,
+// so a client that disconnects before receiving an event of every account doesn't miss their events.
+func writeStreamStart(w io.Writer, cursors streamCursors) error {
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds()); err != nil {
+		return err
+	}
+
+	if len(cursors) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "id: %s\n\n", cursors)
+
+	return err
+}
+
+// writeStreamEvent writes the event envelope as a Server-Sent Event with the given ID, which is omitted if empty.
+func writeStreamEvent(w io.Writer, event *pubsub.Event, ID string) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("serializing event %s to JSON: %v", event.ID, err)
+	}
+
+	if ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+
+	return err
+}
+
+// streamStatus is the change of the subscription's health that is sent to the clients of the event streams.
+type streamStatus struct {
+	Type      string
+	Timestamp time.Time
+	Error     string `json:",omitempty"`
+}
+
+// newStreamStatus converts the status of the subscription to the status sent to the clients.
+func newStreamStatus(status *pubsub.Status) *streamStatus {
+	message := &streamStatus{
+		Type:      status.Type,
+		Timestamp: status.Timestamp,
+	}
+
+	if status.Err != nil {
+		message.Error = status.Err.Error()
+	}
+
+	return message
+}
+
+// writeStreamStatus writes the change of the subscription's health as a "status" Server-Sent Event.
+func writeStreamStatus(w io.Writer, status *pubsub.Status) error {
+	data, err := json.Marshal(newStreamStatus(status))
+	if err != nil {
+		return fmt.Errorf("serializing %s status to JSON: %v", status.Type, err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+
+	return err
+}
+
+// checkAccounts checks that all the accounts exist, inactive accounts can be streamed as well.
+//
+// Returns an error wrapping persistence.ErrAccountNotFound for the first account that doesn't exist.
+func checkAccounts(ctx context.Context, accountIDs []int) error {
+	active, err := persistence.DB.IsActiveAccounts(ctx, accountIDs)
+	if err != nil {
+		return fmt.Errorf("checking if accounts %v exist: %w", accountIDs, err)
+	}
+
+	for _, accountID := range accountIDs {
+		if _, ok := active[accountID]; !ok {
+			return fmt.Errorf("account %d: %w", accountID, persistence.ErrAccountNotFound)
+		}
+	}
+
+	return nil
+}
+
+// lastEventID returns the ID of the last event the client received before reconnecting,
+// EventSource sends it with the Last-Event-ID header, other clients can also use the lastEventId query parameter.
+func lastEventID(r *http.Request) string {
+	if ID := r.Header.Get("Last-Event-ID"); ID != "" {
+		return ID
+	}
+
+	return r.URL.Query().Get("lastEventId")
+}
+
+// streamCursors are the cursors of the last received event of every account of a multi account stream.
+//
+// They are sent as the event ID in the "ACCOUNT_ID:CURSOR,ACCOUNT_ID:CURSOR" format, sorted by the account ID.
+type streamCursors map[int]string
+
+// String formats the cursors as the event ID.
+func (c streamCursors) String() string {
+	accountIDs := make([]int, 0, len(c))
+	for accountID := range c {
+		accountIDs = append(accountIDs, accountID)
+	}
+	sort.Ints(accountIDs)
+
+	parts := make([]string, len(accountIDs))
+	for i, accountID := range accountIDs {
+		parts[i] = fmt.Sprintf("%d:%s", accountID, c[accountID])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// parseLastEventID converts the ID of the last event the client received to the replay point of the stream.
+//
+// IDs with the cursors of multiple accounts (see streamCursors) resume every account after its own cursor,
+// cursors of accounts that aren't streamed are ignored. Other IDs are a single cursor all the accounts resume after.
+func parseLastEventID(ID string, accountIDs []int) (pubsub.Replay, error) {
+	if !strings.Contains(ID, ":") {
+		return pubsub.Replay{After: ID}, nil
+	}
+
+	streamed := map[int]bool{}
+	for _, accountID := range accountIDs {
+		streamed[accountID] = true
+	}
+
+	cursors := map[int]string{}
+	for _, part := range strings.Split(ID, ",") {
+		fields := strings.SplitN(part, ":", 2)
+
+		accountID, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) != 2 || fields[1] == "" {
+			return pubsub.Replay{}, fmt.Errorf("invalid cursor %q in last event ID", part)
+		}
+
+		if streamed[accountID] {
+			cursors[accountID] = fields[1]
+		}
+	}
+
+	return pubsub.Replay{Cursors: cursors}, nil
+}
+
+// parseAccountIDs is a helper function to parse a comma separated list of account IDs.
+func parseAccountIDs(value string) ([]int, error) {
+	if value == "" {
+		return nil, errors.New("no accounts")
+	}
+
+	IDs := []int{}
+	seen := map[int]bool{}
+	for _, IDParam := range strings.Split(value, ",") {
+		ID, err := strconv.Atoi(strings.TrimSpace(IDParam))
+		if err != nil || ID < 1 {
+			return nil, fmt.Errorf("account ID %q should be a positive number", IDParam)
+		}
+
+		if !seen[ID] {
+			seen[ID] = true
+			IDs = append(IDs, ID)
+		}
+	}
+
+	if len(IDs) > maxStreamAccounts {
+		return nil, fmt.Errorf("%d accounts requested, at most %d are allowed", len(IDs), maxStreamAccounts)
+	}
+
+	return IDs, nil
+}
@@ -0,0 +1,395 @@
+package rest
+
+import (
+	"bufio"
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamAccounts mocks the database with existing accounts 1 and 2.
+func streamAccounts() {
+	fakeDB.FnIsActiveAccounts = func(IDs []int) (map[int]bool, error) {
+		active := map[int]bool{}
+		for _, ID := range IDs {
+			if ID == 1 || ID == 2 {
+				active[ID] = ID == 1
+			}
+		}
+
+		return active, nil
+	}
+}
+
+// useMemoryBus replaces the mocked bus with an in-memory bus until the test ends.
+func useMemoryBus(t *testing.T) *pubsub.Memory {
+	bus := &pubsub.Memory{}
+	pubsub.Bus = bus
+	t.Cleanup(func() {
+		pubsub.Bus = fakeBus
+	})
+
+	return bus
+}
+
+// openStream opens the stream and returns a reader of its lines after the retry field was received,
+// at which point the stream is subscribed to the events.
+func openStream(t *testing.T, path string) *bufio.Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected text/event-stream but got %s", contentType)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if line := readLine(t, reader); line != "retry: 3000" {
+		t.Fatalf("expected the retry field but got %q", line)
+	}
+
+	return reader
+}
+
+// readLine reads the next non-empty line of the stream.
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	lines := make(chan string, 1)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+
+				return
+			}
+
+			if line = strings.TrimSuffix(line, "\n"); line != "" {
+				lines <- line
+
+				return
+			}
+		}
+	}()
+
+	select {
+	case line, ok := <-lines:
+		if !ok {
+			t.Fatalf("stream ended")
+		}
+
+		return line
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+
+	return ""
+}
+
+func Test_Stream(t *testing.T) {
+	streamAccounts()
+	bus := useMemoryBus(t)
+
+	reader := openStream(t, "/1/stream")
+
+	for _, accountID := range []int{2, 1} {
+		event, err := pubsub.NewEvent(accountID, "test", pubsub.ContentTypeText, []byte("test data"))
+		if err != nil {
+			t.Fatalf("creating event: %v", err)
+		}
+
+		if err := bus.Publish(context.Background(), event); err != nil {
+			t.Fatalf("publishing event: %v", err)
+		}
+	}
+
+	// only the event of the streamed account is received
+	line := readLine(t, reader)
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("expected the event data but got %q", line)
+	}
+
+	event := &pubsub.Event{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil {
+		t.Fatalf("failed to deserialize event: %v", err)
+	}
+
+	if event.AccountID != 1 || event.Text() != "test data" || event.Source != "test" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func Test_StreamAccounts(t *testing.T) {
+	streamAccounts()
+	bus := useMemoryBus(t)
+
+	reader := openStream(t, "/stream?accounts=1,2")
+
+	for _, accountID := range []int{1, 2} {
+		event, err := pubsub.NewEvent(accountID, "test", pubsub.ContentTypeText, []byte("test data"))
+		if err != nil {
+			t.Fatalf("creating event: %v", err)
+		}
+
+		if err := bus.Publish(context.Background(), event); err != nil {
+			t.Fatalf("publishing event: %v", err)
+		}
+
+		line := readLine(t, reader)
+
+		received := &pubsub.Event{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), received); err != nil {
+			t.Fatalf("failed to deserialize %q: %v", line, err)
+		}
+
+		if received.ID != event.ID {
+			t.Fatalf("expected event %s but got %s", event.ID, received.ID)
+		}
+	}
+}
+
+func Test_StreamHeartbeat(t *testing.T) {
+	streamAccounts()
+	useMemoryBus(t)
+
+	interval := HeartbeatInterval
+	HeartbeatInterval = 10 * time.Millisecond
+	defer func() {
+		HeartbeatInterval = interval
+	}()
+
+	reader := openStream(t, "/1/stream")
+
+	if line := readLine(t, reader); line != ": heartbeat" {
+		t.Fatalf("expected a heartbeat but got %q", line)
+	}
+}
+
+func Test_StreamResume(t *testing.T) {
+	streamAccounts()
+
+	var replay pubsub.Replay
+	fakeBus.FnSubscribe = func(r pubsub.Replay, accountIDs []int) (*pubsub.Subscription, error) {
+		replay = r
+
+		return nil, pubsub.ErrReplayNotSupported
+	}
+
+	for _, request := range []struct {
+		path   string
+		header string
+	}{
+		{"/1/stream", "1612632930000-0"},
+		{"/stream?accounts=1&lastEventId=1612632930000-0", ""},
+	} {
+		replay = pubsub.Replay{}
+
+		req, err := http.NewRequest("GET", server.URL+request.path, nil)
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+
+		if request.header != "" {
+			req.Header.Set("Last-Event-ID", request.header)
+		}
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if replay.After != "1612632930000-0" {
+			t.Fatalf("%s: expected to resume after %s but got %+v", request.path, "1612632930000-0", replay)
+		}
+
+		// the bus doesn't store events, so they can't be replayed
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected %d but got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func Test_StreamResumeAccounts(t *testing.T) {
+	streamAccounts()
+
+	var replay pubsub.Replay
+	fakeBus.FnSubscribe = func(r pubsub.Replay, accountIDs []int) (*pubsub.Subscription, error) {
+		replay = r
+
+		return nil, pubsub.ErrReplayNotSupported
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/stream?accounts=1,2", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", "1:1612632930000-0,2:1612632920000-3")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if replay.After != "" || len(replay.Cursors) != 2 || replay.Cursors[1] != "1612632930000-0" || replay.Cursors[2] != "1612632920000-3" {
+		t.Fatalf("expected to resume every account after its cursor but got %+v", replay)
+	}
+
+	// accounts without a cursor aren't resumed after the cursor of another account
+	req.Header.Set("Last-Event-ID", "1:1612632930000-0")
+
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if replay.After != "" || len(replay.Cursors) != 1 || replay.Cursors[1] != "1612632930000-0" {
+		t.Fatalf("expected to resume only account 1 after its cursor but got %+v", replay)
+	}
+
+	// invalid IDs are rejected before subscribing
+	replay = pubsub.Replay{}
+	req.Header.Set("Last-Event-ID", "1:1612632930000-0,x:1")
+
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest || !replay.IsZero() {
+		t.Fatalf("expected %d without subscribing but got %d and %+v", http.StatusBadRequest, resp.StatusCode, replay)
+	}
+}
+
+func Test_streamCursors(t *testing.T) {
+	cursors := streamCursors{}
+	for _, event := range []struct {
+		accountID int
+		cursor    string
+		ID        string
+	}{
+		{2, "1612632930000-0", "2:1612632930000-0"},
+		{1, "1612632920000-0", "1:1612632920000-0,2:1612632930000-0"},
+		{2, "1612632940000-0", "1:1612632920000-0,2:1612632940000-0"},
+	} {
+		cursors[event.accountID] = event.cursor
+
+		if ID := cursors.String(); ID != event.ID {
+			t.Fatalf("expected %s but got %s", event.ID, ID)
+		}
+
+		// the ID resumes every account after its cursor
+		replay, err := parseLastEventID(event.ID, []int{1, 2})
+		if err != nil {
+			t.Fatalf("parsing %s: %v", event.ID, err)
+		}
+
+		if streamCursors(replay.Cursors).String() != event.ID {
+			t.Fatalf("expected %s but got %+v", event.ID, replay)
+		}
+	}
+}
+
+func Test_writeStreamStart(t *testing.T) {
+	for _, test := range []struct {
+		cursors streamCursors
+		output  string
+	}{
+		{nil, "retry: 3000\n\n"},
+		// the start cursors of every account are sent before any event is received
+		{streamCursors{1: "1612632930000-0", 2: "0-0"}, "retry: 3000\n\nid: 1:1612632930000-0,2:0-0\n\n"},
+	} {
+		output := &strings.Builder{}
+		if err := writeStreamStart(output, test.cursors); err != nil {
+			t.Fatalf("writing stream start: %v", err)
+		}
+
+		if output.String() != test.output {
+			t.Fatalf("expected %q but got %q", test.output, output.String())
+		}
+	}
+}
+
+func Test_StreamInvalid(t *testing.T) {
+	streamAccounts()
+
+	fakeBus.FnSubscribe = func(r pubsub.Replay, accountIDs []int) (*pubsub.Subscription, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	for _, request := range []struct {
+		path   string
+		status int
+	}{
+		{"/asd/stream", http.StatusBadRequest},
+		{"/stream", http.StatusBadRequest},
+		{"/stream?accounts=1,asd", http.StatusBadRequest},
+		{"/stream?accounts=1,-2", http.StatusBadRequest},
+		{"/3/stream", http.StatusNotFound},
+		{"/stream?accounts=1,3", http.StatusNotFound},
+		{"/1/stream", http.StatusServiceUnavailable},
+	} {
+		resp, err := server.Client().Get(server.URL + request.path)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != request.status {
+			t.Fatalf("%s: expected %d but got %d", request.path, request.status, resp.StatusCode)
+		}
+	}
+}
+
+func Test_writeStreamEvent(t *testing.T) {
+	event, err := pubsub.NewEvent(1, "test", pubsub.ContentTypeText, []byte("test data"))
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+	event.Cursor = "1612632930000-0"
+
+	recorder := httptest.NewRecorder()
+	if err := writeStreamEvent(recorder, event, event.Cursor); err != nil {
+		t.Fatalf("writing event: %v", err)
+	}
+
+	data, _ := json.Marshal(event)
+	if expected := "id: 1612632930000-0\ndata: " + string(data) + "\n\n"; recorder.Body.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	status := &pubsub.Status{Type: pubsub.StatusDisconnected, Timestamp: time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC), Err: errors.New("connection refused")}
+	if err := writeStreamStatus(recorder, status); err != nil {
+		t.Fatalf("writing status: %v", err)
+	}
+
+	expected := "event: status\ndata: {\"Type\":\"disconnected\",\"Timestamp\":\"2021-02-06T17:35:30Z\",\"Error\":\"connection refused\"}\n\n"
+	if recorder.Body.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, recorder.Body.String())
+	}
+}
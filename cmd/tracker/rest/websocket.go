@@ -0,0 +1,394 @@
+// Package rest contains handler code for REST API calls
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// maxWebSocketMessageSize is the maximum size of a message received from a WebSocket client in bytes
+const maxWebSocketMessageSize = 16 << 10
+
+// types of the messages exchanged with WebSocket clients
+const (
+	wsSubscribe   = "subscribe"   // client: receive the events of the accounts
+	wsUnsubscribe = "unsubscribe" // client: stop receiving the events of the accounts
+	wsAccounts    = "accounts"    // server: accounts whose events are received after a subscribe or unsubscribe
+	wsEvent       = "event"       // server: event of a subscribed account
+	wsStatus      = "status"      // server: change of the subscription's health
+	wsError       = "error"       // server: message that couldn't be handled
+	wsHeartbeat   = "heartbeat"   // server: sent every HeartbeatInterval
+)
+
+// wsRequest is a message received from a WebSocket client, e.g. {"Type": "subscribe", "Accounts": [1, 2]}.
+type wsRequest struct {
+	Type     string
+	Accounts []int
+}
+
+// AllowedOrigins are the origins of the web pages, besides the service's own, that can open a WebSocket,
+// "*" allows all origins.
+var AllowedOrigins []string
+
+// wsClient is a connected WebSocket client with a single subscription to the events of the selected accounts.
+//
+// The subscription is only changed by the goroutine reading the client's messages and forwards its events
+// to the client in its own goroutine. It is closed when no accounts are selected.
+type wsClient struct {
+	conn *websocket.Conn
+	ctx  context.Context
+	sub  *pubsub.Subscription
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex // serializes writes to the connection and guards accounts
+	accounts map[int]struct{}
+}
+
+// handleWebSocket function handles GET requests.
+//
+// It upgrades the connection to a WebSocket, where the client can subscribe to and unsubscribe from the events
+// of accounts at any time (e.g. GET BASE_URL/ws). Browsers can only open it from the pages of allowed origins.
+func handleWebSocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	server := websocket.Server{Handshake: checkOrigin, Handler: serveWebSocket}
+	server.ServeHTTP(w, r)
+}
+
+// checkOrigin rejects the WebSocket with 403 Forbidden if it was opened from a page of an origin that isn't allowed,
+// so other web pages can't use the API key a browser sends with its cookies or basic auth credentials.
+//
+// Browsers always send the Origin header, other clients don't have to, so WebSockets without it are allowed.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	originURL, err := websocket.Origin(config, r)
+	if err != nil || originURL == nil {
+		return err
+	}
+	config.Origin = originURL
+
+	// the service's own pages
+	if strings.EqualFold(originURL.Host, r.Host) {
+		return nil
+	}
+
+	origin := originURL.Scheme + "://" + originURL.Host
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+
+	log.Error().Msgf("WebSocket from origin %s isn't allowed", origin)
+
+	return fmt.Errorf("origin %s isn't allowed", origin)
+}
+
+// serveWebSocket handles the messages of the client until it disconnects or the service shuts down.
+func serveWebSocket(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = maxWebSocketMessageSize
+
+	ctx, cancel := context.WithCancel(conn.Request().Context())
+
+	client := &wsClient{
+		conn:     conn,
+		ctx:      ctx,
+		accounts: map[int]struct{}{},
+	}
+
+	// closing the connection when the API key is revoked ends the reading of the client's messages
+	defer openSession(conn.Request(), func() { conn.Close() })()
+
+	go client.keepAlive()
+	defer func() {
+		cancel()
+		client.wg.Wait()
+		conn.Close()
+	}()
+
+	for {
+		request := &wsRequest{}
+		if err := websocket.JSON.Receive(conn, request); err != nil {
+			if errors.Is(err, websocket.ErrFrameTooLarge) {
+				client.sendError(fmt.Errorf("message is larger than %d bytes", maxWebSocketMessageSize))
+
+				continue
+			}
+
+			var (
+				syntaxErr *json.SyntaxError
+				typeErr   *json.UnmarshalTypeError
+			)
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				client.sendError(fmt.Errorf("invalid message: %v", err))
+
+				continue
+			}
+
+			// the client disconnected or the connection was closed
+			return
+		}
+
+		switch request.Type {
+		case wsSubscribe:
+			client.subscribe(request.Accounts)
+		case wsUnsubscribe:
+			client.unsubscribe(request.Accounts)
+		default:
+			client.sendError(fmt.Errorf("unknown message type %q", request.Type))
+		}
+	}
+}
+
+// subscribe adds the accounts that aren't subscribed yet to the subscription and sends the selected accounts.
+//
+// Nothing is subscribed if any of the accounts doesn't exist or the API key can't access it.
+func (c *wsClient) subscribe(accountIDs []int) {
+	added := []int{}
+	seen := map[int]bool{}
+	for _, accountID := range accountIDs {
+		if accountID < 1 {
+			c.sendError(fmt.Errorf("account ID %d should be a positive number", accountID))
+
+			return
+		}
+
+		if !canAccess(c.conn.Request(), accountID) {
+			c.sendError(fmt.Errorf("API key can't access account %d", accountID))
+
+			return
+		}
+
+		if _, ok := c.accounts[accountID]; !ok && !seen[accountID] {
+			seen[accountID] = true
+			added = append(added, accountID)
+		}
+	}
+
+	if len(c.accounts)+len(added) > maxStreamAccounts {
+		c.sendError(fmt.Errorf("at most %d accounts can be subscribed", maxStreamAccounts))
+
+		return
+	}
+
+	if len(added) > 0 {
+		if err := checkAccounts(c.ctx, added); err != nil {
+			log.Error().Msgf("subscribing to accounts %v: %v", added, err)
+			c.sendError(err)
+
+			return
+		}
+	}
+
+	if len(added) > 0 {
+		if err := c.add(added); err != nil {
+			log.Error().Msgf("subscribing to events of accounts %v: %v", added, err)
+			c.sendError(fmt.Errorf("subscribing to accounts %v: %v", added, err))
+		}
+	}
+
+	c.sendAccounts()
+}
+
+// add adds the accounts to the subscription, the subscription is created for the first selected accounts.
+func (c *wsClient) add(accountIDs []int) error {
+	// the accounts are selected first, so their events aren't skipped as soon as they are received
+	c.setAccounts(accountIDs, true)
+
+	if c.sub == nil {
+		sub, err := pubsub.Bus.Subscribe(c.ctx, pubsub.Replay{}, accountIDs...)
+		if err != nil {
+			c.setAccounts(accountIDs, false)
+
+			return err
+		}
+		c.sub = sub
+
+		c.wg.Add(1)
+		go c.forward(sub)
+	} else if err := c.sub.Add(c.ctx, accountIDs...); err != nil {
+		c.setAccounts(accountIDs, false)
+
+		return err
+	}
+
+	return nil
+}
+
+// setAccounts selects or deselects the accounts.
+func (c *wsClient) setAccounts(accountIDs []int, selected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, accountID := range accountIDs {
+		if selected {
+			c.accounts[accountID] = struct{}{}
+		} else {
+			delete(c.accounts, accountID)
+		}
+	}
+}
+
+// unsubscribe removes the accounts from the subscription and sends the selected accounts.
+//
+// The subscription is closed when the last account is removed.
+func (c *wsClient) unsubscribe(accountIDs []int) {
+	removed := []int{}
+
+	// events of the removed accounts that are still on their way aren't sent after the accounts are removed here
+	c.mu.Lock()
+	for _, accountID := range accountIDs {
+		if _, ok := c.accounts[accountID]; ok {
+			delete(c.accounts, accountID)
+			removed = append(removed, accountID)
+		}
+	}
+	remaining := len(c.accounts)
+	c.mu.Unlock()
+
+	switch {
+	case len(removed) == 0:
+	case remaining == 0:
+		c.sub.Close()
+		c.sub = nil
+	default:
+		if err := c.sub.Remove(c.ctx, removed...); err != nil {
+			// the subscription doesn't deliver the events of the removed accounts anyway
+			log.Error().Msgf("unsubscribing from events of accounts %v: %v", removed, err)
+		}
+	}
+
+	c.sendAccounts()
+}
+
+// forward sends the events and status changes of the subscription to the client until the subscription ends.
+func (c *wsClient) forward(sub *pubsub.Subscription) {
+	defer c.wg.Done()
+
+	events, statuses := sub.Events(), sub.Status()
+	for events != nil || statuses != nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+
+				continue
+			}
+
+			c.sendEvent(event)
+		case status, ok := <-statuses:
+			if !ok {
+				statuses = nil
+
+				continue
+			}
+
+			c.send(struct {
+				Type   string
+				Status *streamStatus
+			}{
+				Type:   wsStatus,
+				Status: newStreamStatus(status),
+			})
+		}
+	}
+}
+
+// keepAlive sends a heartbeat every HeartbeatInterval, so proxies don't close idle connections,
+// and closes the connection when the service shuts down.
+func (c *wsClient) keepAlive() {
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			c.send(struct{ Type string }{Type: wsHeartbeat})
+		case <-shutdown:
+			// closing the connection ends the reading of the client's messages
+			c.conn.Close()
+
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendEvent sends the event if its account is still selected.
+func (c *wsClient) sendEvent(event *pubsub.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.accounts[event.AccountID]; !ok {
+		return
+	}
+
+	c.write(struct {
+		Type  string
+		Event *pubsub.Event
+	}{
+		Type:  wsEvent,
+		Event: event,
+	})
+}
+
+// sendAccounts sends the sorted IDs of the subscribed accounts.
+func (c *wsClient) sendAccounts() {
+	c.mu.Lock()
+	accountIDs := make([]int, 0, len(c.accounts))
+	for accountID := range c.accounts {
+		accountIDs = append(accountIDs, accountID)
+	}
+	c.mu.Unlock()
+	sort.Ints(accountIDs)
+
+	c.send(struct {
+		Type     string
+		Accounts []int
+	}{
+		Type:     wsAccounts,
+		Accounts: accountIDs,
+	})
+}
+
+// sendError sends the error of a message that couldn't be handled, the connection stays open.
+func (c *wsClient) sendError(err error) {
+	c.send(struct {
+		Type  string
+		Error string
+	}{
+		Type:  wsError,
+		Error: err.Error(),
+	})
+}
+
+// send sends the message as a JSON frame.
+//
+// A message that can't be sent closes the connection, which ends the reading of the client's messages.
+func (c *wsClient) send(message interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.write(message)
+}
+
+// write sends the message as a JSON frame, the caller has to hold the lock.
+func (c *wsClient) write(message interface{}) {
+	if err := websocket.JSON.Send(c.conn, message); err != nil {
+		if c.ctx.Err() == nil {
+			log.Error().Msgf("sending WebSocket message: %v", err)
+		}
+
+		c.conn.Close()
+	}
+}
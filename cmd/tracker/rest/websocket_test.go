@@ -0,0 +1,253 @@
+package rest
+
+import (
+	"celtra-programming-assigment/pkg/pubsub"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsFrame is any message sent to a WebSocket client.
+type wsFrame struct {
+	Type     string
+	Accounts []int
+	Event    *pubsub.Event
+	Status   *streamStatus
+	Error    string
+}
+
+// dialWebSocket connects to the WebSocket endpoint until the test ends.
+func dialWebSocket(t *testing.T) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", "", server.URL)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+// sendRequest sends the message to the WebSocket endpoint.
+func sendRequest(t *testing.T, conn *websocket.Conn, message interface{}) {
+	if err := websocket.JSON.Send(conn, message); err != nil {
+		t.Fatalf("failed to send %v: %v", message, err)
+	}
+}
+
+// receiveFrame receives the next message of the given type from the WebSocket endpoint, heartbeats are skipped.
+func receiveFrame(t *testing.T, conn *websocket.Conn, frameType string) *wsFrame {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("setting deadline: %v", err)
+	}
+
+	for {
+		frame := &wsFrame{}
+		if err := websocket.JSON.Receive(conn, frame); err != nil {
+			t.Fatalf("failed to receive %s: %v", frameType, err)
+		}
+
+		if frame.Type == wsHeartbeat && frameType != wsHeartbeat {
+			continue
+		}
+
+		if frame.Type != frameType {
+			t.Fatalf("expected %s but got %+v", frameType, frame)
+		}
+
+		return frame
+	}
+}
+
+// publishText publishes a text event for each of the accounts and returns the events.
+func publishText(t *testing.T, bus pubsub.PubSub, accountIDs ...int) []*pubsub.Event {
+	events := []*pubsub.Event{}
+	for _, accountID := range accountIDs {
+		event, err := pubsub.NewEvent(accountID, "test", pubsub.ContentTypeText, []byte("test data"))
+		if err != nil {
+			t.Fatalf("creating event: %v", err)
+		}
+
+		if err := bus.Publish(context.Background(), event); err != nil {
+			t.Fatalf("publishing event: %v", err)
+		}
+
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// expectAccounts checks the selected accounts that were sent after a subscribe or unsubscribe.
+func expectAccounts(t *testing.T, conn *websocket.Conn, expected ...int) {
+	frame := receiveFrame(t, conn, wsAccounts)
+	if len(frame.Accounts) != len(expected) {
+		t.Fatalf("expected accounts %v but got %v", expected, frame.Accounts)
+	}
+
+	for i := range expected {
+		if frame.Accounts[i] != expected[i] {
+			t.Fatalf("expected accounts %v but got %v", expected, frame.Accounts)
+		}
+	}
+}
+
+func Test_WebSocket(t *testing.T) {
+	streamAccounts()
+	bus := useMemoryBus(t)
+
+	conn := dialWebSocket(t)
+
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{1}})
+	expectAccounts(t, conn, 1)
+
+	// only the events of the subscribed accounts are received
+	events := publishText(t, bus, 2, 1)
+	if frame := receiveFrame(t, conn, wsEvent); frame.Event.ID != events[1].ID || frame.Event.Text() != "test data" {
+		t.Fatalf("expected event %s but got %+v", events[1].ID, frame.Event)
+	}
+
+	// accounts can be added without reconnecting
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{2, 1, 2}})
+	expectAccounts(t, conn, 1, 2)
+
+	events = publishText(t, bus, 2)
+	if frame := receiveFrame(t, conn, wsEvent); frame.Event.ID != events[0].ID {
+		t.Fatalf("expected event %s but got %+v", events[0].ID, frame.Event)
+	}
+
+	// and removed
+	sendRequest(t, conn, map[string]interface{}{"type": "unsubscribe", "accounts": []int{1, 3}})
+	expectAccounts(t, conn, 2)
+
+	events = publishText(t, bus, 1, 2)
+	if frame := receiveFrame(t, conn, wsEvent); frame.Event.ID != events[1].ID {
+		t.Fatalf("expected event %s but got %+v", events[1].ID, frame.Event)
+	}
+
+	sendRequest(t, conn, wsRequest{Type: wsUnsubscribe, Accounts: []int{2}})
+	expectAccounts(t, conn)
+
+	// accounts can be subscribed again after all of them were removed
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{1}})
+	expectAccounts(t, conn, 1)
+
+	events = publishText(t, bus, 2, 1)
+	if frame := receiveFrame(t, conn, wsEvent); frame.Event.ID != events[1].ID {
+		t.Fatalf("expected event %s but got %+v", events[1].ID, frame.Event)
+	}
+}
+
+// countingBus is an in-memory bus that counts the subscriptions.
+type countingBus struct {
+	pubsub.Memory
+	subscriptions int32
+}
+
+func (b *countingBus) Subscribe(ctx context.Context, replay pubsub.Replay, accountIDs ...int) (*pubsub.Subscription, error) {
+	atomic.AddInt32(&b.subscriptions, 1)
+
+	return b.Memory.Subscribe(ctx, replay, accountIDs...)
+}
+
+func Test_WebSocketSingleSubscription(t *testing.T) {
+	streamAccounts()
+	bus := &countingBus{}
+	pubsub.Bus = bus
+	defer func() {
+		pubsub.Bus = fakeBus
+	}()
+
+	conn := dialWebSocket(t)
+
+	for _, accountIDs := range [][]int{{1}, {2}} {
+		sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: accountIDs})
+		receiveFrame(t, conn, wsAccounts)
+	}
+
+	sendRequest(t, conn, wsRequest{Type: wsUnsubscribe, Accounts: []int{1}})
+	expectAccounts(t, conn, 2)
+
+	// the accounts are added to and removed from the same subscription
+	if subscriptions := atomic.LoadInt32(&bus.subscriptions); subscriptions != 1 {
+		t.Fatalf("expected %d but got %d", 1, subscriptions)
+	}
+
+	events := publishText(t, &bus.Memory, 1, 2)
+	if frame := receiveFrame(t, conn, wsEvent); frame.Event.ID != events[1].ID {
+		t.Fatalf("expected event %s but got %+v", events[1].ID, frame.Event)
+	}
+}
+
+func Test_WebSocketOrigin(t *testing.T) {
+	URL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	defer func() {
+		AllowedOrigins = nil
+	}()
+
+	for _, request := range []struct {
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{server.URL, nil, true},
+		{"https://dashboard.example.com", nil, false},
+		{"https://dashboard.example.com", []string{"https://other.example.com", "https://dashboard.example.com/"}, true},
+		{"https://dashboard.example.com", []string{"*"}, true},
+	} {
+		AllowedOrigins = request.allowed
+
+		conn, err := websocket.Dial(URL, "", request.origin)
+		if err == nil {
+			conn.Close()
+		}
+
+		if (err == nil) != request.ok {
+			t.Fatalf("%s with %v: expected allowed %t but got %v", request.origin, request.allowed, request.ok, err)
+		}
+	}
+}
+
+func Test_WebSocketInvalid(t *testing.T) {
+	streamAccounts()
+	useMemoryBus(t)
+
+	conn := dialWebSocket(t)
+
+	for _, message := range []interface{}{
+		"not an object",
+		wsRequest{Type: "listen", Accounts: []int{1}},
+		wsRequest{Type: wsSubscribe, Accounts: []int{1, 3}},
+		wsRequest{Type: wsSubscribe, Accounts: []int{-1}},
+		map[string]interface{}{"Type": wsSubscribe, "Accounts": "1"},
+		map[string]interface{}{"Type": wsSubscribe, "Accounts": make([]int, maxWebSocketMessageSize)},
+	} {
+		sendRequest(t, conn, message)
+
+		if frame := receiveFrame(t, conn, wsError); frame.Error == "" {
+			t.Fatalf("expected an error for %.50v", message)
+		}
+	}
+
+	// the connection stays open and nothing was subscribed
+	sendRequest(t, conn, wsRequest{Type: wsSubscribe, Accounts: []int{2}})
+	expectAccounts(t, conn, 2)
+}
+
+func Test_WebSocketHeartbeat(t *testing.T) {
+	interval := HeartbeatInterval
+	HeartbeatInterval = 10 * time.Millisecond
+	defer func() {
+		HeartbeatInterval = interval
+	}()
+
+	conn := dialWebSocket(t)
+
+	receiveFrame(t, conn, wsHeartbeat)
+}
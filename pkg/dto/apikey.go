@@ -0,0 +1,21 @@
+// Package dto contains implementations of data transfer objects.
+package dto
+
+import "time"
+
+// scopes of the API keys
+const (
+	ScopeAdmin   = "admin"   // key can use all the routes
+	ScopeAccount = "account" // key can only use the routes of its account
+)
+
+// APIKey DTO used to represent an API key with its scope and the account it is scoped to.
+//
+// Only the SHA-256 hash of the key is stored, the key itself is only known when it is created.
+type APIKey struct {
+	ID        int64
+	Hash      string `json:"-"`
+	Scope     string
+	AccountID int `json:",omitempty"` // zero for admin keys
+	CreatedAt time.Time
+}
@@ -0,0 +1,18 @@
+// Package dto contains implementations of data transfer objects.
+package dto
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeadLetter DTO used to represent an event that couldn't be published, with the serialized event envelope,
+// the error of the last attempt and the time when publishing was given up.
+type DeadLetter struct {
+	ID        int64
+	EventID   string
+	AccountID int
+	Event     json.RawMessage
+	Error     string
+	FailedAt  time.Time
+}
@@ -0,0 +1,20 @@
+// Package dto contains implementations of data transfer objects.
+package dto
+
+import "time"
+
+// Event DTO used to represent a single stored event with the account ID, time of ingestion,
+// received data and hostname of the service instance that received it.
+//
+// EventID is the unique ID of the published event, EventTime is the time supplied by the client (if any)
+// and ContentType describes the data. Events stored before they had IDs have an empty EventID.
+type Event struct {
+	ID          int64
+	EventID     string
+	AccountID   int
+	Timestamp   time.Time
+	EventTime   *time.Time `json:",omitempty"`
+	Data        string
+	Source      string
+	ContentType string
+}
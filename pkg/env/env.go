@@ -0,0 +1,41 @@
+// Package env contains helpers for reading the configuration from environment variables.
+package env
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Int reads a positive integer from the environment variable
+// or returns the default value if the variable isn't set.
+func Int(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		return 0, errors.New(name + " should be a positive number")
+	}
+
+	return i, nil
+}
+
+// Duration reads a positive duration (e.g. 500ms) from the environment variable
+// or returns the default value if the variable isn't set.
+func Duration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.New(name + " should be a positive duration")
+	}
+
+	return d, nil
+}
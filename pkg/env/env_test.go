@@ -0,0 +1,61 @@
+package env
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Int(t *testing.T) {
+	defer os.Unsetenv("TEST_INT")
+
+	for _, test := range []struct {
+		value    string
+		expected int
+		valid    bool
+	}{
+		{"", 10, true},
+		{"5", 5, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"five", 0, false},
+	} {
+		os.Setenv("TEST_INT", test.value)
+
+		i, err := Int("TEST_INT", 10)
+		if (err == nil) != test.valid {
+			t.Fatalf("%q: unexpected error %v", test.value, err)
+		}
+
+		if i != test.expected {
+			t.Fatalf("%q: expected %d but got %d", test.value, test.expected, i)
+		}
+	}
+}
+
+func Test_Duration(t *testing.T) {
+	defer os.Unsetenv("TEST_DURATION")
+
+	for _, test := range []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"", time.Second, true},
+		{"500ms", 500 * time.Millisecond, true},
+		{"0s", 0, false},
+		{"-1s", 0, false},
+		{"500", 0, false},
+	} {
+		os.Setenv("TEST_DURATION", test.value)
+
+		d, err := Duration("TEST_DURATION", time.Second)
+		if (err == nil) != test.valid {
+			t.Fatalf("%q: unexpected error %v", test.value, err)
+		}
+
+		if d != test.expected {
+			t.Fatalf("%q: expected %v but got %v", test.value, test.expected, d)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/env"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// default configuration of the API key cache
+const (
+	defaultAPIKeyCacheTTL  = 5 * time.Second
+	defaultAPIKeyCacheSize = 10000
+)
+
+var (
+	// APIKeys is an active store of API keys
+	APIKeys APIKeyStore
+
+	// ErrAPIKeyNotFound is returned when there is no API key matching the hash or the ID.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKeyStore interface represents the storage of API keys
+// and defines methods that can be implemented by various database providers.
+type APIKeyStore interface {
+	// StoreAPIKey stores the API key and sets its ID.
+	StoreAPIKey(ctx context.Context, key *dto.APIKey) error
+	// GetAPIKey returns the API key matching the hash (see HashAPIKey).
+	GetAPIKey(ctx context.Context, hash string) (*dto.APIKey, error)
+	// DeleteAPIKey revokes the API key matching the ID.
+	DeleteAPIKey(ctx context.Context, ID int64) error
+	// CountAPIKeys returns the number of API keys with the scope.
+	CountAPIKeys(ctx context.Context, scope string) (int, error)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of the key, which is stored instead of the key.
+//
+// Keys are long random strings, so a fast hash is enough and lets them be looked up by their hash.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// CachedAPIKeys implements APIKeyStore interface and wraps another APIKeyStore to cache the results of GetAPIKey,
+// so that the API key of every request doesn't have to be read from the database.
+//
+// The cache holds at most size keys (least recently used keys are evicted first) which expire after ttl.
+// Keys revoked through the cache are removed from it, and OnRevoke is called so that other service instances
+// can remove them with Invalidate. Keys of a deleted account should be removed with InvalidateAccount.
+// Unknown keys aren't cached, so a new key can be used right away.
+type CachedAPIKeys struct {
+	APIKeyStore
+
+	// OnRevoke is called with the ID of the API key that was revoked.
+	OnRevoke func(ID int64)
+
+	ttl  time.Duration
+	size int
+
+	mu         sync.Mutex
+	entries    map[string]*list.Element // entries by the key's hash
+	order      *list.List               // front is the most recently used entry
+	generation uint64                   // incremented on every invalidation
+}
+
+// apiKeyEntry is a cached API key.
+type apiKeyEntry struct {
+	key     dto.APIKey
+	expires time.Time
+}
+
+// NewAPIKeyCache wraps the active API key store with a CachedAPIKeys store and sets it as the active store.
+//
+// Entry TTL and maximum number of entries can be set with API_KEY_CACHE_TTL (e.g. 10s) and API_KEY_CACHE_SIZE
+// environment variables.
+func NewAPIKeyCache() (*CachedAPIKeys, error) {
+	ttl, err := env.Duration("API_KEY_CACHE_TTL", defaultAPIKeyCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := env.Int("API_KEY_CACHE_SIZE", defaultAPIKeyCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCachedAPIKeys(APIKeys, ttl, size)
+	APIKeys = c
+
+	return c, nil
+}
+
+// NewCachedAPIKeys creates a new CachedAPIKeys store that wraps store.
+func NewCachedAPIKeys(store APIKeyStore, ttl time.Duration, size int) *CachedAPIKeys {
+	return &CachedAPIKeys{
+		APIKeyStore: store,
+		ttl:         ttl,
+		size:        size,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+	}
+}
+
+// GetAPIKey returns the API key matching the hash.
+//
+// The key is read from the cache if possible.
+func (c *CachedAPIKeys) GetAPIKey(ctx context.Context, hash string) (*dto.APIKey, error) {
+	c.mu.Lock()
+	if key, ok := c.lookup(hash); ok {
+		c.mu.Unlock()
+
+		return key, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	key, err := c.APIKeyStore.GetAPIKey(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store(generation, key)
+
+	return key, nil
+}
+
+// DeleteAPIKey revokes the API key matching the ID.
+func (c *CachedAPIKeys) DeleteAPIKey(ctx context.Context, ID int64) error {
+	err := c.APIKeyStore.DeleteAPIKey(ctx, ID)
+	if err == nil {
+		c.Invalidate(ID)
+
+		if c.OnRevoke != nil {
+			c.OnRevoke(ID)
+		}
+	}
+
+	return err
+}
+
+// Invalidate removes the API key matching the ID from the cache.
+func (c *CachedAPIKeys) Invalidate(ID int64) {
+	c.removeIf(func(key *dto.APIKey) bool {
+		return key.ID == ID
+	})
+}
+
+// InvalidateAccount removes the API keys of the account from the cache.
+func (c *CachedAPIKeys) InvalidateAccount(accountID int) {
+	c.removeIf(func(key *dto.APIKey) bool {
+		return key.Scope == dto.ScopeAccount && key.AccountID == accountID
+	})
+}
+
+// removeIf removes the cached keys matching the condition.
+//
+// Keys are only invalidated when they are revoked, which is rare, so all the entries are checked.
+func (c *CachedAPIKeys) removeIf(matches func(key *dto.APIKey) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if matches(&element.Value.(*apiKeyEntry).key) {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// lookup returns a copy of the cached API key if it didn't expire yet, the caller has to hold the lock.
+func (c *CachedAPIKeys) lookup(hash string) (*dto.APIKey, bool) {
+	element, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*apiKeyEntry)
+	if time.Now().Before(entry.expires) {
+		c.order.MoveToFront(element)
+		key := entry.key
+
+		return &key, true
+	}
+
+	c.remove(element)
+
+	return nil, false
+}
+
+// store caches a copy of the API key that was read from the store in the given generation,
+// the caller has to hold the lock.
+func (c *CachedAPIKeys) store(generation uint64, key *dto.APIKey) {
+	// don't store the key if something was invalidated while it was being read, it might be revoked already
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[key.Hash]; ok {
+		c.remove(element)
+	}
+
+	c.entries[key.Hash] = c.order.PushFront(&apiKeyEntry{
+		key:     *key,
+		expires: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the element from the cache, the caller has to hold the lock.
+func (c *CachedAPIKeys) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*apiKeyEntry).key.Hash)
+}
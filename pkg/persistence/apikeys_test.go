@@ -0,0 +1,205 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAPIKeyStore stores, gets and revokes API keys with the store,
+// the database is used to check that the keys of a deleted account are revoked.
+func testAPIKeyStore(t *testing.T, db Database, store APIKeyStore) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	account, err := db.CreateAccount(context.Background(), "API key account", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	admins, err := store.CountAPIKeys(context.Background(), dto.ScopeAdmin)
+	if err != nil {
+		t.Fatalf("failed to count API keys: %v", err)
+	}
+
+	admin := &dto.APIKey{Hash: HashAPIKey("admin key"), Scope: dto.ScopeAdmin, CreatedAt: now}
+	scoped := &dto.APIKey{Hash: HashAPIKey("account key"), Scope: dto.ScopeAccount, AccountID: account.ID, CreatedAt: now}
+
+	for _, key := range []*dto.APIKey{admin, scoped} {
+		if err := store.StoreAPIKey(context.Background(), key); err != nil {
+			t.Fatalf("failed to store API key: %v", err)
+		}
+
+		if key.ID == 0 {
+			t.Fatalf("API key ID was not set")
+		}
+	}
+
+	for _, expected := range []*dto.APIKey{admin, scoped} {
+		key, err := store.GetAPIKey(context.Background(), expected.Hash)
+		if err != nil {
+			t.Fatalf("failed to get API key: %v", err)
+		}
+
+		if key.ID != expected.ID || key.Scope != expected.Scope || key.AccountID != expected.AccountID || !key.CreatedAt.Equal(now) {
+			t.Fatalf("API key, expected %+v, was %+v", expected, key)
+		}
+	}
+
+	if _, err := store.GetAPIKey(context.Background(), HashAPIKey("unknown key")); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+
+	// only the keys with the scope are counted
+	if count, err := store.CountAPIKeys(context.Background(), dto.ScopeAdmin); err != nil || count != admins+1 {
+		t.Fatalf("expected %d admin API keys, got %d (%v)", admins+1, count, err)
+	}
+
+	if err := store.DeleteAPIKey(context.Background(), admin.ID); err != nil {
+		t.Fatalf("failed to delete API key: %v", err)
+	}
+
+	if _, err := store.GetAPIKey(context.Background(), admin.Hash); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+
+	if err := store.DeleteAPIKey(context.Background(), admin.ID); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+
+	// keys of a deleted account are revoked
+	if err := db.DeleteAccount(context.Background(), account.ID); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+
+	if _, err := store.GetAPIKey(context.Background(), scoped.Hash); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+}
+
+func Test_MemoryAPIKeys(t *testing.T) {
+	m := newMemory(0)
+	testAPIKeyStore(t, m, m)
+}
+
+func Test_HashAPIKey(t *testing.T) {
+	hash := HashAPIKey("key")
+	if len(hash) != 64 || hash == HashAPIKey("other key") || hash != HashAPIKey("key") {
+		t.Fatalf("unexpected hash %s", hash)
+	}
+}
+
+// countingAPIKeys wraps an APIKeyStore and counts the GetAPIKey calls.
+type countingAPIKeys struct {
+	APIKeyStore
+	calls int64
+}
+
+func (c *countingAPIKeys) GetAPIKey(ctx context.Context, hash string) (*dto.APIKey, error) {
+	atomic.AddInt64(&c.calls, 1)
+
+	return c.APIKeyStore.GetAPIKey(ctx, hash)
+}
+
+func Test_CachedAPIKeys(t *testing.T) {
+	m := newMemory(10)
+	store := &countingAPIKeys{APIKeyStore: m}
+	c := NewCachedAPIKeys(store, time.Hour, 100)
+
+	revoked := []int64{}
+	c.OnRevoke = func(ID int64) {
+		revoked = append(revoked, ID)
+	}
+
+	keys := []*dto.APIKey{
+		{Hash: HashAPIKey("first key"), Scope: dto.ScopeAccount, AccountID: 1},
+		{Hash: HashAPIKey("second key"), Scope: dto.ScopeAccount, AccountID: 2},
+		{Hash: HashAPIKey("third key"), Scope: dto.ScopeAdmin},
+	}
+	for _, key := range keys {
+		if err := c.StoreAPIKey(context.Background(), key); err != nil {
+			t.Fatalf("failed to store API key: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, expected := range keys {
+			key, err := c.GetAPIKey(context.Background(), expected.Hash)
+			if err != nil {
+				t.Fatalf("failed to get API key: %v", err)
+			}
+
+			if key.ID != expected.ID {
+				t.Fatalf("API key, expected %+v, was %+v", expected, key)
+			}
+		}
+	}
+
+	if store.calls != 3 {
+		t.Fatalf("store calls, expected %d, was %d", 3, store.calls)
+	}
+
+	// revoking through the cache removes the key
+	if err := c.DeleteAPIKey(context.Background(), keys[0].ID); err != nil {
+		t.Fatalf("failed to delete API key: %v", err)
+	}
+
+	if _, err := c.GetAPIKey(context.Background(), keys[0].Hash); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+
+	if len(revoked) != 1 || revoked[0] != keys[0].ID {
+		t.Fatalf("revoked API keys, expected [%d], was %v", keys[0].ID, revoked)
+	}
+
+	// keys revoked by another instance are cached until they are invalidated
+	if err := m.DeleteAPIKey(context.Background(), keys[2].ID); err != nil {
+		t.Fatalf("failed to delete API key: %v", err)
+	}
+
+	if _, err := c.GetAPIKey(context.Background(), keys[2].Hash); err != nil {
+		t.Fatalf("expected a cached API key, got %v", err)
+	}
+
+	c.Invalidate(keys[2].ID)
+
+	if _, err := c.GetAPIKey(context.Background(), keys[2].Hash); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+
+	// keys of a deleted account are revoked with it
+	if err := m.DeleteAccount(context.Background(), 2); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+
+	c.InvalidateAccount(2)
+
+	if _, err := c.GetAPIKey(context.Background(), keys[1].Hash); err != ErrAPIKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrAPIKeyNotFound, err)
+	}
+}
+
+func Test_CachedAPIKeysExpiration(t *testing.T) {
+	m := newMemory(0)
+	store := &countingAPIKeys{APIKeyStore: m}
+	c := NewCachedAPIKeys(store, 10*time.Millisecond, 100)
+
+	key := &dto.APIKey{Hash: HashAPIKey("key"), Scope: dto.ScopeAdmin}
+	if err := c.StoreAPIKey(context.Background(), key); err != nil {
+		t.Fatalf("failed to store API key: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetAPIKey(context.Background(), key.Hash); err != nil {
+			t.Fatalf("failed to get API key: %v", err)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if store.calls != 2 {
+		t.Fatalf("store calls, expected %d, was %d", 2, store.calls)
+	}
+}
@@ -0,0 +1,251 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/env"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// default configuration of the account cache
+const (
+	defaultCacheTTL  = 10 * time.Second
+	defaultCacheSize = 10000
+)
+
+// Cached implements Database interface and wraps another Database to cache the results of IsActiveAccount(s),
+// so that the active state of frequently used accounts doesn't have to be read from the database for every event.
+//
+// The cache holds at most size entries (least recently used entries are evicted first) which expire after ttl.
+// Entries are invalidated when the account is changed through the cache, and OnChange is called
+// so that other service instances can invalidate their entries with Invalidate.
+type Cached struct {
+	Database
+
+	// OnChange is called with the ID of the account that was changed or deleted.
+	OnChange func(ID int)
+
+	ttl  time.Duration
+	size int
+
+	mu         sync.Mutex
+	entries    map[int]*list.Element
+	order      *list.List // front is the most recently used entry
+	generation uint64     // incremented on every invalidation
+}
+
+// cacheEntry is the cached active state of an account.
+type cacheEntry struct {
+	ID       int
+	isActive bool
+	expires  time.Time
+}
+
+// NewCache wraps the active database with a Cached database and sets it as the active DB.
+//
+// Entry TTL and maximum number of entries can be set with ACCOUNT_CACHE_TTL (e.g. 30s) and ACCOUNT_CACHE_SIZE
+// environment variables.
+func NewCache() (*Cached, error) {
+	ttl, err := env.Duration("ACCOUNT_CACHE_TTL", defaultCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := env.Int("ACCOUNT_CACHE_SIZE", defaultCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCached(DB, ttl, size)
+	DB = c
+
+	return c, nil
+}
+
+// NewCached creates a new Cached database that wraps db.
+func NewCached(db Database, ttl time.Duration, size int) *Cached {
+	return &Cached{
+		Database: db,
+		ttl:      ttl,
+		size:     size,
+		entries:  map[int]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// IsActiveAccount check if a given account ID is active or not.
+//
+// The result is read from the cache if possible.
+func (c *Cached) IsActiveAccount(ctx context.Context, ID int) (bool, error) {
+	c.mu.Lock()
+	if isActive, ok := c.lookup(ID); ok {
+		c.mu.Unlock()
+
+		return isActive, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	isActive, err := c.Database.IsActiveAccount(ctx, ID)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store(generation, ID, isActive)
+
+	return isActive, nil
+}
+
+// IsActiveAccounts checks which of the accounts are active,
+// accounts that don't exist are missing from the returned map.
+//
+// Cached results are used where possible and the rest is read with a single lookup.
+func (c *Cached) IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error) {
+	active := make(map[int]bool, len(IDs))
+	missing := []int{}
+
+	c.mu.Lock()
+	for _, ID := range IDs {
+		if isActive, ok := c.lookup(ID); ok {
+			active[ID] = isActive
+		} else {
+			missing = append(missing, ID)
+		}
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		return active, nil
+	}
+
+	fetched, err := c.Database.IsActiveAccounts(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ID, isActive := range fetched {
+		active[ID] = isActive
+		c.store(generation, ID, isActive)
+	}
+
+	return active, nil
+}
+
+// UpdateAccount changes the name of the account matching the ID and returns the updated account.
+func (c *Cached) UpdateAccount(ctx context.Context, ID int, name string) (*dto.Account, error) {
+	account, err := c.Database.UpdateAccount(ctx, ID, name)
+	if err == nil {
+		c.changed(ID)
+	}
+
+	return account, err
+}
+
+// SetActive activates or deactivates the account matching the ID.
+func (c *Cached) SetActive(ctx context.Context, ID int, isActive bool) error {
+	err := c.Database.SetActive(ctx, ID, isActive)
+	if err == nil {
+		c.changed(ID)
+	}
+
+	return err
+}
+
+// PatchAccount changes the name and the active state of the account matching the ID in a single operation
+// and returns the updated account. Nil values aren't changed.
+func (c *Cached) PatchAccount(ctx context.Context, ID int, name *string, isActive *bool) (*dto.Account, error) {
+	account, err := c.Database.PatchAccount(ctx, ID, name, isActive)
+	if err == nil {
+		c.changed(ID)
+	}
+
+	return account, err
+}
+
+// DeleteAccount removes the account matching the ID.
+func (c *Cached) DeleteAccount(ctx context.Context, ID int) error {
+	err := c.Database.DeleteAccount(ctx, ID)
+	if err == nil {
+		c.changed(ID)
+	}
+
+	return err
+}
+
+// Invalidate removes the cached data of the account matching the ID.
+func (c *Cached) Invalidate(ID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if element, ok := c.entries[ID]; ok {
+		c.remove(element)
+	}
+}
+
+// changed invalidates the account and notifies other instances about the change.
+func (c *Cached) changed(ID int) {
+	c.Invalidate(ID)
+
+	if c.OnChange != nil {
+		c.OnChange(ID)
+	}
+}
+
+// lookup returns the cached active state of the account if it didn't expire yet, the caller has to hold the lock.
+func (c *Cached) lookup(ID int) (bool, bool) {
+	element, ok := c.entries[ID]
+	if !ok {
+		return false, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().Before(entry.expires) {
+		c.order.MoveToFront(element)
+
+		return entry.isActive, true
+	}
+
+	c.remove(element)
+
+	return false, false
+}
+
+// store caches the active state of the account that was read from the database in the given generation,
+// the caller has to hold the lock.
+func (c *Cached) store(generation uint64, ID int, isActive bool) {
+	// don't store the result if something was invalidated while it was being read, it might be stale already
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[ID]; ok {
+		c.remove(element)
+	}
+
+	c.entries[ID] = c.order.PushFront(&cacheEntry{
+		ID:       ID,
+		isActive: isActive,
+		expires:  time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the element from the cache, the caller has to hold the lock.
+func (c *Cached) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).ID)
+}
@@ -0,0 +1,217 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDB wraps a Database and counts the IsActiveAccount(s) calls.
+type countingDB struct {
+	Database
+	calls int64
+}
+
+func (c *countingDB) IsActiveAccount(ctx context.Context, ID int) (bool, error) {
+	atomic.AddInt64(&c.calls, 1)
+
+	return c.Database.IsActiveAccount(ctx, ID)
+}
+
+func (c *countingDB) IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error) {
+	atomic.AddInt64(&c.calls, 1)
+
+	return c.Database.IsActiveAccounts(ctx, IDs)
+}
+
+func Test_CachedIsActiveAccount(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, time.Hour, 100)
+
+	for i := 0; i < 5; i++ {
+		isActive, err := c.IsActiveAccount(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("failed to get account: %v", err)
+		}
+
+		if !isActive {
+			t.Fatalf("account isActive, expected %t, was %t", true, isActive)
+		}
+	}
+
+	if db.calls != 1 {
+		t.Fatalf("database calls, expected %d, was %d", 1, db.calls)
+	}
+
+	// missing accounts aren't cached
+	for i := 0; i < 2; i++ {
+		if _, err := c.IsActiveAccount(context.Background(), 9999); err != ErrAccountNotFound {
+			t.Fatalf("IsActiveAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+		}
+	}
+
+	if db.calls != 3 {
+		t.Fatalf("database calls, expected %d, was %d", 3, db.calls)
+	}
+}
+
+func Test_CachedChanges(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, time.Hour, 100)
+
+	changed := []int{}
+	c.OnChange = func(ID int) {
+		changed = append(changed, ID)
+	}
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	// deactivating through the cache invalidates the entry
+	if err := c.SetActive(context.Background(), 1, false); err != nil {
+		t.Fatalf("failed to deactivate account: %v", err)
+	}
+
+	isActive, err := c.IsActiveAccount(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if isActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, isActive)
+	}
+
+	// patching through the cache invalidates the entry
+	isActive = true
+	if _, err := c.PatchAccount(context.Background(), 1, nil, &isActive); err != nil {
+		t.Fatalf("failed to patch account: %v", err)
+	}
+
+	if isActive, _ := c.IsActiveAccount(context.Background(), 1); !isActive {
+		t.Fatalf("account isActive, expected %t, was %t", true, isActive)
+	}
+
+	// deleting through the cache invalidates the entry
+	if err := c.DeleteAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != ErrAccountNotFound {
+		t.Fatalf("IsActiveAccount(1), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	// failed changes aren't reported
+	if err := c.SetActive(context.Background(), 9999, false); err != ErrAccountNotFound {
+		t.Fatalf("SetActive(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if len(changed) != 3 || changed[0] != 1 || changed[1] != 1 || changed[2] != 1 {
+		t.Fatalf("changed accounts, expected [1 1 1], was %v", changed)
+	}
+}
+
+func Test_CachedInvalidate(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, time.Hour, 100)
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	// account changed by another instance
+	if err := db.SetActive(context.Background(), 1, false); err != nil {
+		t.Fatalf("failed to deactivate account: %v", err)
+	}
+
+	if isActive, _ := c.IsActiveAccount(context.Background(), 1); !isActive {
+		t.Fatalf("expected a cached value")
+	}
+
+	c.Invalidate(1)
+
+	if isActive, _ := c.IsActiveAccount(context.Background(), 1); isActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, isActive)
+	}
+}
+
+func Test_CachedExpiration(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, 10*time.Millisecond, 100)
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if db.calls != 2 {
+		t.Fatalf("database calls, expected %d, was %d", 2, db.calls)
+	}
+}
+
+func Test_CachedSize(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, time.Hour, 3)
+
+	for _, id := range []int{1, 2, 3, 1, 4} {
+		if _, err := c.IsActiveAccount(context.Background(), id); err != nil {
+			t.Fatalf("failed to get account: %v", err)
+		}
+	}
+
+	if c.order.Len() != 3 {
+		t.Fatalf("cache size, expected %d, was %d", 3, c.order.Len())
+	}
+
+	// 2 was the least recently used account
+	if _, ok := c.entries[2]; ok {
+		t.Fatalf("account 2 should have been evicted")
+	}
+
+	if _, ok := c.entries[1]; !ok {
+		t.Fatalf("account 1 should still be cached")
+	}
+}
+
+func Test_CachedIsActiveAccounts(t *testing.T) {
+	db := &countingDB{Database: newMemory(10)}
+	c := NewCached(db, time.Hour, 100)
+
+	if _, err := c.IsActiveAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to check account: %v", err)
+	}
+
+	if err := db.SetActive(context.Background(), 3, false); err != nil {
+		t.Fatalf("failed to deactivate account: %v", err)
+	}
+
+	// account 1 is cached, the rest is read with one lookup and accounts that don't exist are missing
+	active, err := c.IsActiveAccounts(context.Background(), []int{1, 2, 3, 100})
+	if err != nil {
+		t.Fatalf("failed to check accounts: %v", err)
+	}
+
+	if len(active) != 3 || !active[1] || !active[2] || active[3] {
+		t.Fatalf("expected map[1:true 2:true 3:false] but got %v", active)
+	}
+
+	if calls := atomic.LoadInt64(&db.calls); calls != 2 {
+		t.Fatalf("expected %d but got %d", 2, calls)
+	}
+
+	// all the accounts are cached now
+	if _, err := c.IsActiveAccounts(context.Background(), []int{1, 2, 3}); err != nil {
+		t.Fatalf("failed to check accounts: %v", err)
+	}
+
+	if calls := atomic.LoadInt64(&db.calls); calls != 2 {
+		t.Fatalf("expected %d but got %d", 2, calls)
+	}
+}
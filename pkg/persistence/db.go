@@ -1,24 +1,75 @@
 // Package persistence contains database logic.
 package persistence
 
-import "celtra-programming-assigment/pkg/dto"
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"errors"
+	"strings"
+)
 
-// DB is an active database connection
-var DB Database
+var (
+	// DB is an active database connection
+	DB Database
+
+	// ErrAccountNotFound is returned when there is no account matching the ID.
+	ErrAccountNotFound = errors.New("account not found")
+)
 
 // Database interface represents the connection to the database
 // and defines methods that can be implemented by various database providers.
 //
+// All methods accept a context which cancels the operation when it's done.
+//
 // It can also be used to create a mocked implementation for testing purposes.
 type Database interface {
 	// IsActiveAccount check if a given account ID is active or not
-	IsActiveAccount(ID int) (bool, error)
+	IsActiveAccount(ctx context.Context, ID int) (bool, error)
+	// IsActiveAccounts checks which of the accounts are active with a single lookup,
+	// accounts that don't exist are missing from the returned map.
+	IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error)
 	// CreateAccount creates a new account.
 	//
 	// - name     - required
 	//
 	// - isActive - optional (default: false)
-	CreateAccount(name string, isActive bool) (*dto.Account, error)
+	CreateAccount(ctx context.Context, name string, isActive bool) (*dto.Account, error)
 	// GetAccount returns an account record matching the ID.
-	GetAccount(ID int) (*dto.Account, error)
+	GetAccount(ctx context.Context, ID int) (*dto.Account, error)
+	// UpdateAccount changes the name of the account matching the ID and returns the updated account.
+	UpdateAccount(ctx context.Context, ID int, name string) (*dto.Account, error)
+	// SetActive activates or deactivates the account matching the ID.
+	SetActive(ctx context.Context, ID int, isActive bool) error
+	// PatchAccount changes the name and the active state of the account matching the ID in a single operation,
+	// so either both or none of them are changed, and returns the updated account. Nil values aren't changed.
+	PatchAccount(ctx context.Context, ID int, name *string, isActive *bool) (*dto.Account, error)
+	// DeleteAccount removes the account matching the ID.
+	DeleteAccount(ctx context.Context, ID int) error
+	// ListAccounts returns accounts matching the filter ordered by their ID.
+	ListAccounts(ctx context.Context, filter AccountFilter) ([]*dto.Account, error)
+}
+
+// AccountFilter defines which accounts are returned by ListAccounts.
+type AccountFilter struct {
+	// Active returns only active or inactive accounts, nil returns both.
+	Active *bool
+	// NamePrefix returns only accounts with a name starting with the prefix.
+	NamePrefix string
+	// AfterID returns only accounts with a greater ID and is used for keyset pagination.
+	AfterID int
+	// Limit is the maximum number of returned accounts.
+	Limit int
+}
+
+// matches checks if the account matches the filter (limit is not taken into account).
+func (f AccountFilter) matches(account dto.Account) bool {
+	if account.ID <= f.AfterID {
+		return false
+	}
+
+	if f.Active != nil && account.IsActive != *f.Active {
+		return false
+	}
+
+	return strings.HasPrefix(account.Name, f.NamePrefix)
 }
@@ -0,0 +1,48 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"errors"
+)
+
+var (
+	// DeadLetters is an active store of events that couldn't be published
+	DeadLetters DeadLetterStore
+
+	// ErrDeadLetterNotFound is returned when there is no dead letter matching the ID.
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// DeadLetterStore interface represents the storage of events that couldn't be published
+// and defines methods that can be implemented by various database providers.
+type DeadLetterStore interface {
+	// StoreDeadLetter stores the dead letter and sets its ID.
+	StoreDeadLetter(ctx context.Context, deadLetter *dto.DeadLetter) error
+	// GetDeadLetter returns the dead letter matching the ID.
+	GetDeadLetter(ctx context.Context, ID int64) (*dto.DeadLetter, error)
+	// DeleteDeadLetter removes the dead letter matching the ID.
+	DeleteDeadLetter(ctx context.Context, ID int64) error
+	// ListDeadLetters returns dead letters matching the filter ordered by their ID.
+	ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*dto.DeadLetter, error)
+}
+
+// DeadLetterFilter defines which dead letters are returned by ListDeadLetters.
+type DeadLetterFilter struct {
+	// AccountID returns only dead letters of the account, zero value returns dead letters of all accounts.
+	AccountID int
+	// AfterID returns only dead letters with a greater ID and is used for keyset pagination.
+	AfterID int64
+	// Limit is the maximum number of returned dead letters.
+	Limit int
+}
+
+// matches checks if the dead letter matches the filter (limit is not taken into account).
+func (f DeadLetterFilter) matches(deadLetter dto.DeadLetter) bool {
+	if f.AccountID != 0 && deadLetter.AccountID != f.AccountID {
+		return false
+	}
+
+	return deadLetter.ID > f.AfterID
+}
@@ -0,0 +1,84 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testDeadLetterStore stores, lists, gets and deletes dead letters of the account with the store.
+func testDeadLetterStore(t *testing.T, store DeadLetterStore, accountID int) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	stored := []*dto.DeadLetter{}
+	for i := 0; i < 3; i++ {
+		deadLetter := &dto.DeadLetter{
+			EventID:   fmt.Sprintf("00000000-0000-4000-8000-00000000000%d", i),
+			AccountID: accountID,
+			Event:     []byte(fmt.Sprintf(`{"Version":1,"Data":"%d"}`, i)),
+			Error:     "publishing failed",
+			FailedAt:  now,
+		}
+
+		if err := store.StoreDeadLetter(context.Background(), deadLetter); err != nil {
+			t.Fatalf("failed to store dead letter: %v", err)
+		}
+
+		if deadLetter.ID == 0 {
+			t.Fatalf("dead letter ID was not set")
+		}
+
+		stored = append(stored, deadLetter)
+	}
+
+	// dead letters of other accounts aren't listed
+	if err := store.StoreDeadLetter(context.Background(), &dto.DeadLetter{AccountID: accountID + 1, Event: []byte("{}"), FailedAt: now}); err != nil {
+		t.Fatalf("failed to store dead letter: %v", err)
+	}
+
+	page, err := store.ListDeadLetters(context.Background(), DeadLetterFilter{AccountID: accountID, Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list dead letters: %v", err)
+	}
+
+	if len(page) != 2 || page[0].ID != stored[0].ID || page[1].ID != stored[1].ID {
+		t.Fatalf("expected dead letters %d and %d, was %v", stored[0].ID, stored[1].ID, page)
+	}
+
+	page, err = store.ListDeadLetters(context.Background(), DeadLetterFilter{AccountID: accountID, AfterID: page[1].ID, Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list dead letters: %v", err)
+	}
+
+	if len(page) != 1 || page[0].ID != stored[2].ID {
+		t.Fatalf("expected dead letter %d, was %v", stored[2].ID, page)
+	}
+
+	deadLetter, err := store.GetDeadLetter(context.Background(), stored[1].ID)
+	if err != nil {
+		t.Fatalf("failed to get dead letter: %v", err)
+	}
+
+	if deadLetter.EventID != stored[1].EventID || string(deadLetter.Event) != string(stored[1].Event) || deadLetter.Error != stored[1].Error || !deadLetter.FailedAt.Equal(now) {
+		t.Fatalf("dead letter, expected %+v, was %+v", stored[1], deadLetter)
+	}
+
+	if err := store.DeleteDeadLetter(context.Background(), stored[1].ID); err != nil {
+		t.Fatalf("failed to delete dead letter: %v", err)
+	}
+
+	if _, err := store.GetDeadLetter(context.Background(), stored[1].ID); err != ErrDeadLetterNotFound {
+		t.Fatalf("expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+
+	if err := store.DeleteDeadLetter(context.Background(), stored[1].ID); err != ErrDeadLetterNotFound {
+		t.Fatalf("expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+}
+
+func Test_MemoryDeadLetters(t *testing.T) {
+	testDeadLetterStore(t, newMemory(0), 1)
+}
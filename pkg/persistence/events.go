@@ -0,0 +1,216 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/env"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// default configuration of the event log
+const (
+	defaultEventBatchSize     = 100
+	defaultEventFlushInterval = time.Second
+	defaultEventQueueSize     = 10000
+)
+
+var (
+	// Events is an active event store
+	Events EventStore
+	// EventLog is an active writer that asynchronously stores events to Events
+	EventLog *EventWriter
+
+	errEventLogClosed = errors.New("event log is closed")
+	errEventLogFull   = errors.New("event log queue is full")
+)
+
+// EventStore interface represents the storage of received events
+// and defines methods that can be implemented by various database providers.
+type EventStore interface {
+	// StoreEvents stores a batch of events.
+	StoreEvents(ctx context.Context, events []*dto.Event) error
+	// ListEvents returns events matching the filter ordered by their timestamp and ID.
+	ListEvents(ctx context.Context, filter EventFilter) ([]*dto.Event, error)
+}
+
+// EventFilter defines which events are returned by ListEvents.
+type EventFilter struct {
+	// AccountID returns only events of the account.
+	AccountID int
+	// From returns only events with the same or later timestamp, zero value means no lower bound.
+	From time.Time
+	// To returns only events with an earlier timestamp, zero value means no upper bound.
+	To time.Time
+	// AfterTimestamp and AfterID return only events ordered after the event with the timestamp and ID
+	// and are used for keyset pagination.
+	AfterTimestamp time.Time
+	AfterID        int64
+	// Limit is the maximum number of returned events.
+	Limit int
+}
+
+// matches checks if the event matches the filter (limit is not taken into account).
+func (f EventFilter) matches(event dto.Event) bool {
+	if event.AccountID != f.AccountID {
+		return false
+	}
+
+	if !f.From.IsZero() && event.Timestamp.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !event.Timestamp.Before(f.To) {
+		return false
+	}
+
+	return eventBefore(dto.Event{Timestamp: f.AfterTimestamp, ID: f.AfterID}, event)
+}
+
+// eventBefore checks if event a is ordered before event b.
+func eventBefore(a dto.Event, b dto.Event) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.ID < b.ID
+	}
+
+	return a.Timestamp.Before(b.Timestamp)
+}
+
+// EventWriter collects events and writes them to an EventStore in batches from a background goroutine,
+// so that storing an event doesn't slow down its ingestion.
+type EventWriter struct {
+	store         EventStore
+	queue         chan *dto.Event
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewEventLog creates a new EventWriter for the active event store and sets it as the active EventLog.
+//
+// Batch size, flush interval and queue size can be set with EVENT_BATCH_SIZE, EVENT_FLUSH_INTERVAL (e.g. 500ms)
+// and EVENT_QUEUE_SIZE environment variables.
+func NewEventLog() error {
+	if Events == nil {
+		return errors.New("event store is not initialized")
+	}
+
+	batchSize, err := env.Int("EVENT_BATCH_SIZE", defaultEventBatchSize)
+	if err != nil {
+		return err
+	}
+
+	queueSize, err := env.Int("EVENT_QUEUE_SIZE", defaultEventQueueSize)
+	if err != nil {
+		return err
+	}
+
+	flushInterval, err := env.Duration("EVENT_FLUSH_INTERVAL", defaultEventFlushInterval)
+	if err != nil {
+		return err
+	}
+
+	EventLog = NewEventWriter(Events, batchSize, flushInterval, queueSize)
+
+	return nil
+}
+
+// NewEventWriter creates a new EventWriter and starts its background goroutine.
+//
+// Events are written when batchSize events are collected or when flushInterval passes, whichever comes first.
+// At most queueSize events can wait to be written.
+func NewEventWriter(store EventStore, batchSize int, flushInterval time.Duration, queueSize int) *EventWriter {
+	w := &EventWriter{
+		store:         store,
+		queue:         make(chan *dto.Event, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// Write queues the event to be stored.
+//
+// It never blocks, so it returns an error if the queue is full or if the writer was already closed.
+func (w *EventWriter) Write(event *dto.Event) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return errEventLogClosed
+	}
+
+	select {
+	case w.queue <- event:
+		return nil
+	default:
+		return errEventLogFull
+	}
+}
+
+// Close stops accepting new events and waits until all the queued events are written.
+func (w *EventWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+}
+
+// run collects the queued events and writes them in batches until the writer is closed.
+func (w *EventWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*dto.Event, 0, w.batchSize)
+
+	for {
+		select {
+		case event, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+
+				return
+			}
+
+			batch = append(batch, event)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = make([]*dto.Event, 0, w.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = make([]*dto.Event, 0, w.batchSize)
+			}
+		}
+	}
+}
+
+// flush writes the batch to the event store.
+func (w *EventWriter) flush(batch []*dto.Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// events are written in the background, so there is no request context to use
+	if err := w.store.StoreEvents(context.Background(), batch); err != nil {
+		log.Error().Msgf("storing %d events: %v", len(batch), err)
+	}
+}
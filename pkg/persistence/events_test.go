@@ -0,0 +1,212 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStore implements EventStore interface and records the stored batches.
+type recordingStore struct {
+	mu      sync.Mutex
+	batches [][]*dto.Event
+	err     error
+}
+
+func (s *recordingStore) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches = append(s.batches, events)
+
+	return s.err
+}
+
+func (s *recordingStore) ListEvents(ctx context.Context, filter EventFilter) ([]*dto.Event, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *recordingStore) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := []int{}
+	for _, batch := range s.batches {
+		sizes = append(sizes, len(batch))
+	}
+
+	return sizes
+}
+
+func Test_EventWriterBatchSize(t *testing.T) {
+	store := &recordingStore{}
+	w := NewEventWriter(store, 3, time.Hour, 100)
+
+	for i := 1; i <= 7; i++ {
+		if err := w.Write(&dto.Event{AccountID: i, Data: "test data"}); err != nil {
+			t.Fatalf("failed to write event: %v", err)
+		}
+	}
+
+	// closing flushes the remaining event
+	w.Close()
+
+	sizes := store.batchSizes()
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("batch sizes, expected [3 3 1], was %v", sizes)
+	}
+
+	// events are written in order
+	if store.batches[1][0].AccountID != 4 {
+		t.Fatalf("account id, expected %d, was %d", 4, store.batches[1][0].AccountID)
+	}
+
+	if err := w.Write(&dto.Event{AccountID: 1}); err != errEventLogClosed {
+		t.Fatalf("expected %v, was %v", errEventLogClosed, err)
+	}
+}
+
+func Test_EventWriterFlushInterval(t *testing.T) {
+	store := &recordingStore{}
+	w := NewEventWriter(store, 100, 10*time.Millisecond, 100)
+	defer w.Close()
+
+	if err := w.Write(&dto.Event{AccountID: 1, Data: "test data"}); err != nil {
+		t.Fatalf("failed to write event: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(store.batchSizes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("event wasn't flushed")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_EventWriterFullQueue(t *testing.T) {
+	// store blocks until the test is done so the queue fills up
+	block := make(chan struct{})
+	store := &blockingStore{block: block}
+	w := NewEventWriter(store, 1, time.Hour, 1)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = w.Write(&dto.Event{AccountID: 1})
+	}
+
+	if err != errEventLogFull {
+		t.Fatalf("expected %v, was %v", errEventLogFull, err)
+	}
+
+	close(block)
+	w.Close()
+}
+
+func Test_EventWriterStoreError(t *testing.T) {
+	store := &recordingStore{err: errors.New("bad database")}
+	w := NewEventWriter(store, 1, time.Hour, 10)
+
+	// failed batches are dropped and the writer keeps going
+	for i := 0; i < 3; i++ {
+		if err := w.Write(&dto.Event{AccountID: 1}); err != nil {
+			t.Fatalf("failed to write event: %v", err)
+		}
+	}
+
+	w.Close()
+
+	if sizes := store.batchSizes(); len(sizes) != 3 {
+		t.Fatalf("batch count, expected %d, was %d", 3, len(sizes))
+	}
+}
+
+func Test_MemoryStoreEvents(t *testing.T) {
+	m := newMemory(0)
+
+	events := []*dto.Event{
+		{AccountID: 1, Timestamp: time.Now().UTC(), Data: "first", Source: "test"},
+		{AccountID: 2, Timestamp: time.Now().UTC(), Data: "second", Source: "test"},
+	}
+
+	if err := m.StoreEvents(context.Background(), events); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	if len(m.events) != 2 {
+		t.Fatalf("event count, expected %d, was %d", 2, len(m.events))
+	}
+
+	if m.events[1].ID != 2 || m.events[1].Data != "second" {
+		t.Fatalf("event, expected {2 second}, was %v", m.events[1])
+	}
+
+	// stored events are copies
+	if events[0].ID != 0 {
+		t.Fatalf("stored event was modified")
+	}
+}
+
+// blockingStore implements EventStore interface and blocks until the block channel is closed.
+type blockingStore struct {
+	block chan struct{}
+}
+
+func (s *blockingStore) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	<-s.block
+
+	return nil
+}
+
+func (s *blockingStore) ListEvents(ctx context.Context, filter EventFilter) ([]*dto.Event, error) {
+	return nil, errors.New("not implemented")
+}
+
+func Test_MemoryListEvents(t *testing.T) {
+	m := newMemory(0)
+
+	start := time.Date(2021, 2, 6, 17, 0, 0, 0, time.UTC)
+
+	// store events out of order and for two accounts
+	stored := []*dto.Event{}
+	for _, minute := range []int{3, 1, 4, 0, 2} {
+		stored = append(stored, &dto.Event{AccountID: 500, Timestamp: start.Add(time.Duration(minute) * time.Minute), Data: fmt.Sprint(minute), Source: "test"})
+		stored = append(stored, &dto.Event{AccountID: 501, Timestamp: start.Add(time.Duration(minute) * time.Minute), Data: fmt.Sprint(minute), Source: "test"})
+	}
+
+	if err := m.StoreEvents(context.Background(), stored); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	events, err := m.ListEvents(context.Background(), EventFilter{AccountID: 500, From: start.Add(time.Minute), To: start.Add(4 * time.Minute), Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+
+	if len(events) != 2 || events[0].Data != "1" || events[1].Data != "2" {
+		t.Fatalf("expected events 1 and 2, was %v", events)
+	}
+
+	// next page
+	events, err = m.ListEvents(context.Background(), EventFilter{
+		AccountID:      500,
+		From:           start.Add(time.Minute),
+		To:             start.Add(4 * time.Minute),
+		AfterTimestamp: events[1].Timestamp,
+		AfterID:        events[1].ID,
+		Limit:          2,
+	})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Data != "3" || events[0].AccountID != 500 || events[0].Source != "test" {
+		t.Fatalf("expected event 3, was %v", events)
+	}
+}
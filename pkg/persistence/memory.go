@@ -0,0 +1,385 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// seedAccounts is the number of accounts with random names that are created when a new database is set up.
+const seedAccounts = 1000
+
+// Memory implements Database, EventStore, DeadLetterStore and APIKeyStore interfaces and keeps all the records in memory.
+//
+// It is safe for concurrent use and can be used to run the tracker or tests without any external services.
+// Its operations never block, so the contexts passed to them are ignored.
+type Memory struct {
+	mu       sync.RWMutex
+	accounts map[int]dto.Account
+	lastID   int
+	events   []dto.Event
+
+	deadLetters      []dto.DeadLetter
+	lastDeadLetterID int64
+
+	apiKeys      []dto.APIKey
+	lastAPIKeyID int64
+}
+
+// IsActiveAccount check if a given account ID is active or not.
+func (m *Memory) IsActiveAccount(ctx context.Context, ID int) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	account, ok := m.accounts[ID]
+	if !ok {
+		return false, ErrAccountNotFound
+	}
+
+	return account.IsActive, nil
+}
+
+// IsActiveAccounts checks which of the accounts are active,
+// accounts that don't exist are missing from the returned map.
+func (m *Memory) IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	active := make(map[int]bool, len(IDs))
+	for _, ID := range IDs {
+		if account, ok := m.accounts[ID]; ok {
+			active[ID] = account.IsActive
+		}
+	}
+
+	return active, nil
+}
+
+// CreateAccount creates a new account.
+//
+// - name     - required
+//
+// - isActive - optional (default: false)
+func (m *Memory) CreateAccount(ctx context.Context, name string, isActive bool) (*dto.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	account := dto.Account{
+		ID:       m.lastID,
+		Name:     name,
+		IsActive: isActive,
+	}
+	m.accounts[account.ID] = account
+
+	return &account, nil
+}
+
+// GetAccount returns an account record matching the ID.
+func (m *Memory) GetAccount(ctx context.Context, ID int) (*dto.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	account, ok := m.accounts[ID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	return &account, nil
+}
+
+// UpdateAccount changes the name of the account matching the ID and returns the updated account.
+func (m *Memory) UpdateAccount(ctx context.Context, ID int, name string) (*dto.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[ID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	account.Name = name
+	m.accounts[ID] = account
+
+	return &account, nil
+}
+
+// SetActive activates or deactivates the account matching the ID.
+func (m *Memory) SetActive(ctx context.Context, ID int, isActive bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[ID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	account.IsActive = isActive
+	m.accounts[ID] = account
+
+	return nil
+}
+
+// PatchAccount changes the name and the active state of the account matching the ID in a single operation
+// and returns the updated account. Nil values aren't changed.
+func (m *Memory) PatchAccount(ctx context.Context, ID int, name *string, isActive *bool) (*dto.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account, ok := m.accounts[ID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	if name != nil {
+		account.Name = *name
+	}
+	if isActive != nil {
+		account.IsActive = *isActive
+	}
+	m.accounts[ID] = account
+
+	return &account, nil
+}
+
+// DeleteAccount removes the account matching the ID.
+func (m *Memory) DeleteAccount(ctx context.Context, ID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.accounts[ID]; !ok {
+		return ErrAccountNotFound
+	}
+
+	// IDs of deleted accounts are never reused, just like with a SERIAL column
+	delete(m.accounts, ID)
+
+	// API keys of the account are revoked, just like with ON DELETE CASCADE
+	apiKeys := m.apiKeys[:0]
+	for _, key := range m.apiKeys {
+		if key.AccountID != ID {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	m.apiKeys = apiKeys
+
+	return nil
+}
+
+// ListAccounts returns accounts matching the filter ordered by their ID.
+func (m *Memory) ListAccounts(ctx context.Context, filter AccountFilter) ([]*dto.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	accounts := []*dto.Account{}
+	for _, account := range m.accounts {
+		if filter.matches(account) {
+			account := account
+			accounts = append(accounts, &account)
+		}
+	}
+
+	sort.Slice(accounts, func(i int, j int) bool {
+		return accounts[i].ID < accounts[j].ID
+	})
+
+	if len(accounts) > filter.Limit {
+		accounts = accounts[:filter.Limit]
+	}
+
+	return accounts, nil
+}
+
+// StoreEvents stores a batch of events.
+func (m *Memory) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, event := range events {
+		stored := *event
+		stored.ID = int64(len(m.events) + 1)
+		m.events = append(m.events, stored)
+	}
+
+	return nil
+}
+
+// ListEvents returns events matching the filter ordered by their timestamp and ID.
+func (m *Memory) ListEvents(ctx context.Context, filter EventFilter) ([]*dto.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []*dto.Event{}
+	for _, event := range m.events {
+		if filter.matches(event) {
+			event := event
+			events = append(events, &event)
+		}
+	}
+
+	sort.Slice(events, func(i int, j int) bool {
+		return eventBefore(*events[i], *events[j])
+	})
+
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
+	return events, nil
+}
+
+// StoreDeadLetter stores the dead letter and sets its ID.
+func (m *Memory) StoreDeadLetter(ctx context.Context, deadLetter *dto.DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastDeadLetterID++
+	deadLetter.ID = m.lastDeadLetterID
+	m.deadLetters = append(m.deadLetters, *deadLetter)
+
+	return nil
+}
+
+// GetDeadLetter returns the dead letter matching the ID.
+func (m *Memory) GetDeadLetter(ctx context.Context, ID int64) (*dto.DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, deadLetter := range m.deadLetters {
+		if deadLetter.ID == ID {
+			return &deadLetter, nil
+		}
+	}
+
+	return nil, ErrDeadLetterNotFound
+}
+
+// DeleteDeadLetter removes the dead letter matching the ID.
+func (m *Memory) DeleteDeadLetter(ctx context.Context, ID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, deadLetter := range m.deadLetters {
+		if deadLetter.ID == ID {
+			m.deadLetters = append(m.deadLetters[:i], m.deadLetters[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return ErrDeadLetterNotFound
+}
+
+// ListDeadLetters returns dead letters matching the filter ordered by their ID.
+func (m *Memory) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*dto.DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// dead letters are appended with increasing IDs, so they are already ordered
+	deadLetters := []*dto.DeadLetter{}
+	for _, deadLetter := range m.deadLetters {
+		if len(deadLetters) == filter.Limit {
+			break
+		}
+
+		if filter.matches(deadLetter) {
+			deadLetter := deadLetter
+			deadLetters = append(deadLetters, &deadLetter)
+		}
+	}
+
+	return deadLetters, nil
+}
+
+// StoreAPIKey stores the API key and sets its ID.
+func (m *Memory) StoreAPIKey(ctx context.Context, key *dto.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastAPIKeyID++
+	key.ID = m.lastAPIKeyID
+	m.apiKeys = append(m.apiKeys, *key)
+
+	return nil
+}
+
+// GetAPIKey returns the API key matching the hash.
+func (m *Memory) GetAPIKey(ctx context.Context, hash string) (*dto.APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.apiKeys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+
+	return nil, ErrAPIKeyNotFound
+}
+
+// DeleteAPIKey revokes the API key matching the ID.
+func (m *Memory) DeleteAPIKey(ctx context.Context, ID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, key := range m.apiKeys {
+		if key.ID == ID {
+			m.apiKeys = append(m.apiKeys[:i], m.apiKeys[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return ErrAPIKeyNotFound
+}
+
+// CountAPIKeys returns the number of API keys with the scope.
+func (m *Memory) CountAPIKeys(ctx context.Context, scope string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, key := range m.apiKeys {
+		if key.Scope == scope {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// NewMemory creates a new instance of Memory.
+//
+// Just like NewPostgres, it populates the database with seedAccounts active accounts with random names.
+func NewMemory() error {
+	m := newMemory(seedAccounts)
+	DB = m
+	Events = m
+	DeadLetters = m
+	APIKeys = m
+
+	return nil
+}
+
+// newMemory creates a new instance of Memory populated with the given number of active accounts with random names.
+func newMemory(seed int) *Memory {
+	m := &Memory{
+		accounts: map[int]dto.Account{},
+	}
+
+	for i := 0; i < seed; i++ {
+		m.lastID++
+		m.accounts[m.lastID] = dto.Account{
+			ID:       m.lastID,
+			Name:     fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(rand.Float64())))),
+			IsActive: true,
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,238 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func Test_Memory(t *testing.T) {
+	m := newMemory(seedAccounts)
+
+	// test insert
+	account, err := m.CreateAccount(context.Background(), "test account", false)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	// we already populated the database with 1000 records
+	if account.ID != 1001 {
+		t.Fatalf("account id, expected %d, was %d", 1001, account.ID)
+	}
+
+	if account.Name != "test account" {
+		t.Fatalf("account name, expected %s, was %s", "test account", account.Name)
+	}
+
+	if account.IsActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, account.IsActive)
+	}
+
+	// test select
+	account, err = m.GetAccount(context.Background(), account.ID)
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if account.ID != 1001 {
+		t.Fatalf("account id, expected %d, was %d", 1001, account.ID)
+	}
+
+	if account.Name != "test account" {
+		t.Fatalf("account name, expected %s, was %s", "test account", account.Name)
+	}
+
+	// returned account must be a copy
+	account.IsActive = true
+
+	// test isActive check
+	isActive, err := m.IsActiveAccount(context.Background(), account.ID)
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if isActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, isActive)
+	}
+
+	// test get active account
+	isActive, err = m.IsActiveAccount(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if !isActive {
+		t.Fatalf("account isActive, expected %t, was %t", true, isActive)
+	}
+
+	// test get unknown account
+	if _, err = m.IsActiveAccount(context.Background(), 9999); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("IsActiveAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if _, err = m.GetAccount(context.Background(), 9999); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("GetAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_MemoryConcurrentCreate(t *testing.T) {
+	m := newMemory(0)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := m.CreateAccount(context.Background(), "test account", true); err != nil {
+				t.Errorf("failed to create account: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// IDs are assigned sequentially without gaps
+	for id := 1; id <= 100; id++ {
+		if _, err := m.GetAccount(context.Background(), id); err != nil {
+			t.Fatalf("failed to get account %d: %v", id, err)
+		}
+	}
+}
+
+func Test_MemoryUpdateAccount(t *testing.T) {
+	m := newMemory(seedAccounts)
+
+	// test rename
+	updated, err := m.UpdateAccount(context.Background(), 1, "renamed account")
+	if err != nil {
+		t.Fatalf("failed to update account: %v", err)
+	}
+
+	if updated.ID != 1 || updated.Name != "renamed account" || !updated.IsActive {
+		t.Fatalf("updated account, expected {1 renamed account true}, was %v", *updated)
+	}
+
+	// test deactivate
+	if err := m.SetActive(context.Background(), 1, false); err != nil {
+		t.Fatalf("failed to deactivate account: %v", err)
+	}
+
+	if isActive, _ := m.IsActiveAccount(context.Background(), 1); isActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, isActive)
+	}
+
+	// test delete
+	if err := m.DeleteAccount(context.Background(), 1); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+
+	if _, err := m.GetAccount(context.Background(), 1); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("GetAccount(1), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	// IDs of deleted accounts are not reused
+	account, err := m.CreateAccount(context.Background(), "test account", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	if account.ID != seedAccounts+1 {
+		t.Fatalf("account id, expected %d, was %d", seedAccounts+1, account.ID)
+	}
+
+	// test unknown account
+	if _, err := m.UpdateAccount(context.Background(), 9999, "name"); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("UpdateAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if err := m.SetActive(context.Background(), 9999, true); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("SetActive(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if err := m.DeleteAccount(context.Background(), 9999); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("DeleteAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_MemoryPatchAccount(t *testing.T) {
+	m := newMemory(seedAccounts)
+
+	name, isActive := "patched account", false
+	patched, err := m.PatchAccount(context.Background(), 1, &name, &isActive)
+	if err != nil {
+		t.Fatalf("failed to patch account: %v", err)
+	}
+
+	if patched.ID != 1 || patched.Name != "patched account" || patched.IsActive {
+		t.Fatalf("patched account, expected {1 patched account false}, was %v", *patched)
+	}
+
+	// nil values aren't changed
+	patched, err = m.PatchAccount(context.Background(), 1, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to patch account: %v", err)
+	}
+
+	if patched.Name != "patched account" || patched.IsActive {
+		t.Fatalf("patched account, expected {1 patched account false}, was %v", *patched)
+	}
+
+	if _, err := m.PatchAccount(context.Background(), 9999, &name, nil); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("PatchAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_MemoryListAccounts(t *testing.T) {
+	m := newMemory(seedAccounts)
+
+	// deactivate every other seeded account
+	for id := 2; id <= seedAccounts; id += 2 {
+		if err := m.SetActive(context.Background(), id, false); err != nil {
+			t.Fatalf("failed to deactivate account %d: %v", id, err)
+		}
+	}
+	defer func() {
+		for id := 2; id <= seedAccounts; id += 2 {
+			m.SetActive(context.Background(), id, true)
+		}
+	}()
+
+	inactive := false
+	accounts, err := m.ListAccounts(context.Background(), AccountFilter{Active: &inactive, AfterID: 10, Limit: 3})
+	if err != nil {
+		t.Fatalf("failed to list accounts: %v", err)
+	}
+
+	if len(accounts) != 3 {
+		t.Fatalf("account count, expected %d, was %d", 3, len(accounts))
+	}
+
+	for i, id := range []int{12, 14, 16} {
+		if accounts[i].ID != id || accounts[i].IsActive {
+			t.Fatalf("account, expected {%d inactive}, was %v", id, *accounts[i])
+		}
+	}
+
+	// wildcards in the prefix are matched literally
+	created, err := m.CreateAccount(context.Background(), "foo_%bar", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	defer m.DeleteAccount(context.Background(), created.ID)
+
+	if _, err := m.CreateAccount(context.Background(), "fooXbar", true); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	accounts, err = m.ListAccounts(context.Background(), AccountFilter{NamePrefix: "foo_%", Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list accounts: %v", err)
+	}
+
+	if len(accounts) != 1 || accounts[0].ID != created.ID {
+		t.Fatalf("expected only account %d, was %v", created.ID, accounts)
+	}
+}
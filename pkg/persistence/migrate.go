@@ -0,0 +1,209 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// migrationLockID is the key of the PostgreSQL advisory lock that is held while migrations are running,
+// so multiple tracker instances starting at the same time don't apply the same migration twice.
+const migrationLockID = 7311
+
+// migration is a single versioned change of the database schema.
+type migration struct {
+	version int
+	up      string
+	down    string
+}
+
+// migrations contains all schema migrations ordered by version.
+//
+// Applied migrations must never be changed, add a new migration instead.
+var migrations = []migration{
+	{
+		version: 1,
+		// account table might already exist if it was created before migrations were introduced
+		up: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS account (
+			id       SERIAL        PRIMARY KEY,
+			name     VARCHAR (255) NOT NULL,
+			isActive BOOLEAN       DEFAULT TRUE
+		);
+
+		INSERT INTO account (name) SELECT md5(RANDOM()::TEXT) FROM generate_series(1, %d)
+		WHERE NOT EXISTS (SELECT 1 FROM account);
+		`, seedAccounts),
+		down: `DROP TABLE IF EXISTS account;`,
+	},
+	{
+		version: 2,
+		up: `
+		CREATE TABLE events (
+			id         BIGSERIAL     PRIMARY KEY,
+			account_id INTEGER       NOT NULL,
+			timestamp  TIMESTAMPTZ   NOT NULL,
+			data       TEXT          NOT NULL,
+			source     VARCHAR (255) NOT NULL
+		);
+
+		CREATE INDEX events_account_id_timestamp_idx ON events (account_id, timestamp, id);
+		`,
+		down: `DROP TABLE IF EXISTS events;`,
+	},
+	{
+		version: 3,
+		// events stored before the event envelope don't have an ID or event time
+		up: `
+		ALTER TABLE events
+			ADD COLUMN event_id     VARCHAR (36),
+			ADD COLUMN event_time   TIMESTAMPTZ,
+			ADD COLUMN content_type VARCHAR (255) NOT NULL DEFAULT 'text/plain';
+		`,
+		down: `
+		ALTER TABLE events
+			DROP COLUMN IF EXISTS event_id,
+			DROP COLUMN IF EXISTS event_time,
+			DROP COLUMN IF EXISTS content_type;
+		`,
+	},
+	{
+		version: 4,
+		up: `
+		CREATE TABLE dead_letters (
+			id         BIGSERIAL    PRIMARY KEY,
+			event_id   VARCHAR (36) NOT NULL,
+			account_id INTEGER      NOT NULL,
+			event      TEXT         NOT NULL,
+			error      TEXT         NOT NULL,
+			failed_at  TIMESTAMPTZ  NOT NULL
+		);
+		`,
+		down: `DROP TABLE IF EXISTS dead_letters;`,
+	},
+	{
+		version: 5,
+		// keys of deleted accounts are revoked with them
+		up: `
+		CREATE TABLE api_keys (
+			id         BIGSERIAL    PRIMARY KEY,
+			hash       CHAR (64)    NOT NULL UNIQUE,
+			scope      VARCHAR (16) NOT NULL,
+			account_id INTEGER      REFERENCES account (id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ  NOT NULL
+		);
+		`,
+		down: `DROP TABLE IF EXISTS api_keys;`,
+	},
+}
+
+// latestVersion returns the version of the last known migration.
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate migrates the database schema up or down to the given version.
+//
+// Version 0 reverts all the migrations. Schemas newer than the latest known version are rejected.
+func (pg *Postgres) Migrate(version int) error {
+	return migrate(pg.db, version)
+}
+
+// migrate applies or reverts migrations until the schema matches the target version.
+//
+// Applied versions are stored in the schema_version table and every migration runs in its own transaction.
+func migrate(db *sql.DB, target int) error {
+	if target < 0 || target > latestVersion() {
+		return fmt.Errorf("unknown schema version %d (latest: %d)", target, latestVersion())
+	}
+
+	ctx := context.Background()
+
+	// advisory locks belong to a session, so all the statements need to use the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("acquiring migration lock: %v", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Error().Msgf("releasing migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version    INTEGER     PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("creating schema_version table: %v", err)
+	}
+
+	var current int
+	row := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+
+	if current > latestVersion() {
+		// schema was migrated by a newer version of the service, whose migrations this one can't revert
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d, "+
+			"revert the newer migrations with the newer version of the service first", current, latestVersion())
+	}
+
+	// apply missing migrations in ascending order
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+
+		log.Info().Msgf("applying migration %d", m.version)
+		if err := runMigration(ctx, conn, m.up, "INSERT INTO schema_version (version) VALUES ($1)", m.version); err != nil {
+			return fmt.Errorf("applying migration %d: %v", m.version, err)
+		}
+	}
+
+	// revert newer migrations in descending order
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+
+		log.Info().Msgf("reverting migration %d", m.version)
+		if err := runMigration(ctx, conn, m.down, "DELETE FROM schema_version WHERE version = $1", m.version); err != nil {
+			return fmt.Errorf("reverting migration %d: %v", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// runMigration executes the migration statements and updates the schema_version table in a single transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, statements string, versionQuery string, version int) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, versionQuery, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
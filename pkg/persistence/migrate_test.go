@@ -0,0 +1,106 @@
+// Package persistence contains database logic.
+package persistence
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_Migrate(t *testing.T) {
+	pg, ok := DB.(*Postgres)
+	if !ok {
+		t.Fatalf("expected DB to be *Postgres, was %T", DB)
+	}
+
+	version := func() int {
+		var v int
+		if err := pg.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&v); err != nil {
+			t.Fatalf("reading schema version: %v", err)
+		}
+
+		return v
+	}
+
+	if v := version(); v != latestVersion() {
+		t.Fatalf("schema version, expected %d, was %d", latestVersion(), v)
+	}
+
+	// revert all migrations
+	if err := pg.Migrate(0); err != nil {
+		t.Fatalf("failed to revert migrations: %v", err)
+	}
+
+	if v := version(); v != 0 {
+		t.Fatalf("schema version, expected %d, was %d", 0, v)
+	}
+
+	if _, err := pg.db.Exec("SELECT * FROM account LIMIT 1"); err == nil {
+		t.Fatalf("account table should have been dropped")
+	}
+
+	// several instances migrating at the same time must apply every migration exactly once
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := pg.Migrate(latestVersion()); err != nil {
+				t.Errorf("failed to apply migrations: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := version(); v != latestVersion() {
+		t.Fatalf("schema version, expected %d, was %d", latestVersion(), v)
+	}
+
+	var count int
+	if err := pg.db.QueryRow("SELECT COUNT(*) FROM account").Scan(&count); err != nil {
+		t.Fatalf("counting accounts: %v", err)
+	}
+
+	if count != seedAccounts {
+		t.Fatalf("account count, expected %d, was %d", seedAccounts, count)
+	}
+
+	if err := pg.Migrate(latestVersion() + 1); err == nil {
+		t.Fatalf("Migrate(%d) should have returned an error", latestVersion()+1)
+	}
+
+	// a schema migrated by a newer version of the service is rejected instead of being used or reverted
+	if _, err := pg.db.Exec("INSERT INTO schema_version (version) VALUES ($1)", latestVersion()+1); err != nil {
+		t.Fatalf("inserting newer schema version: %v", err)
+	}
+
+	if err := pg.Migrate(latestVersion()); err == nil {
+		t.Fatalf("Migrate(%d) should have rejected the newer schema", latestVersion())
+	}
+
+	if _, err := pg.db.Exec("DELETE FROM schema_version WHERE version = $1", latestVersion()+1); err != nil {
+		t.Fatalf("deleting newer schema version: %v", err)
+	}
+}
+
+func Test_NewPostgresSchemaVersion(t *testing.T) {
+	db := DB
+	defer func() { DB = db }()
+
+	// the service never reverts migrations at startup, even if a rollback version is left in the environment
+	os.Setenv("DB_SCHEMA_VERSION", "0")
+	defer os.Unsetenv("DB_SCHEMA_VERSION")
+
+	if err := NewPostgres(); err == nil {
+		t.Fatalf("NewPostgres should have refused to start with DB_SCHEMA_VERSION")
+	}
+
+	// the tables weren't dropped
+	pg := db.(*Postgres)
+
+	var count int
+	if err := pg.db.QueryRow("SELECT COUNT(*) FROM account").Scan(&count); err != nil {
+		t.Fatalf("counting accounts: %v", err)
+	}
+}
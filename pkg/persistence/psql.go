@@ -3,11 +3,26 @@ package persistence
 
 import (
 	"celtra-programming-assigment/pkg/dto"
+	"celtra-programming-assigment/pkg/env"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq" // postgres database driver
+	"github.com/lib/pq" // postgres database driver
+)
+
+const (
+	// defaultTimeout is the maximum duration of a single database operation if DB_TIMEOUT isn't set.
+	defaultTimeout = 5 * time.Second
+	// eventColumns is the number of inserted columns of an event
+	eventColumns = 7
+	// maxInsertedEvents is the maximum number of events inserted with a single statement,
+	// so the statement stays below the limit of 65535 parameters
+	maxInsertedEvents = 1000
 )
 
 // variables defining information to successfully connect to the database
@@ -19,32 +34,70 @@ var (
 	dbPort string // DB_PORT
 )
 
-// Postgres implements Database interface and represents a connection to the PostgreSQL database.
+// Postgres implements Database, EventStore, DeadLetterStore and APIKeyStore interfaces and represents a connection to the PostgreSQL database.
 type Postgres struct {
-	db *sql.DB
+	db      *sql.DB
+	timeout time.Duration // DB_TIMEOUT
 }
 
 // IsActiveAccount check if a given account ID is active or not.
-func (pg *Postgres) IsActiveAccount(ID int) (bool, error) {
+func (pg *Postgres) IsActiveAccount(ctx context.Context, ID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
 	var isActive bool
 
-	row := pg.db.QueryRow("SELECT isActive FROM account WHERE id = $1", ID)
+	row := pg.db.QueryRowContext(ctx, "SELECT isActive FROM account WHERE id = $1", ID)
 
 	if err := row.Scan(&isActive); err != nil {
-		return false, err
+		return false, notFound(err)
 	}
 
 	return isActive, nil
 }
 
+// IsActiveAccounts checks which of the accounts are active with a single query,
+// accounts that don't exist are missing from the returned map.
+func (pg *Postgres) IsActiveAccounts(ctx context.Context, IDs []int) (map[int]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	arrayIDs := make(pq.Int64Array, 0, len(IDs))
+	for _, ID := range IDs {
+		arrayIDs = append(arrayIDs, int64(ID))
+	}
+
+	rows, err := pg.db.QueryContext(ctx, "SELECT id, isActive FROM account WHERE id = ANY($1)", arrayIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	active := make(map[int]bool, len(IDs))
+	for rows.Next() {
+		var ID int
+		var isActive bool
+		if err := rows.Scan(&ID, &isActive); err != nil {
+			return nil, err
+		}
+
+		active[ID] = isActive
+	}
+
+	return active, rows.Err()
+}
+
 // CreateAccount creates a new account.
 //
 // - name     - required
 //
 // - isActive - optional (default: false)
-func (pg *Postgres) CreateAccount(name string, isActive bool) (*dto.Account, error) {
+func (pg *Postgres) CreateAccount(ctx context.Context, name string, isActive bool) (*dto.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
 	var id int
-	row := pg.db.QueryRow("INSERT INTO account (name, isActive) VALUES ($1, $2) RETURNING id", name, isActive)
+	row := pg.db.QueryRowContext(ctx, "INSERT INTO account (name, isActive) VALUES ($1, $2) RETURNING id", name, isActive)
 
 	if err := row.Scan(&id); err != nil {
 		return nil, err
@@ -58,56 +111,488 @@ func (pg *Postgres) CreateAccount(name string, isActive bool) (*dto.Account, err
 }
 
 // GetAccount returns an account record matching the ID.
-func (pg *Postgres) GetAccount(ID int) (*dto.Account, error) {
+func (pg *Postgres) GetAccount(ctx context.Context, ID int) (*dto.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
 	account := dto.Account{}
 
-	row := pg.db.QueryRow("SELECT * FROM account WHERE id = $1", ID)
+	row := pg.db.QueryRowContext(ctx, "SELECT * FROM account WHERE id = $1", ID)
 
 	if err := row.Scan(&(account.ID), &(account.Name), &(account.IsActive)); err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	return &account, nil
 }
 
-// NewPostgres creates a new instance of Postgres.
-func NewPostgres() error {
-	dbName = os.Getenv("DB_NAME")
-	dbUser = os.Getenv("DB_USER")
-	dbPwd = os.Getenv("DB_PWD")
-	dbAddr = os.Getenv("DB_ADDR")
-	dbPort = os.Getenv("DB_PORT")
+// UpdateAccount changes the name of the account matching the ID and returns the updated account.
+func (pg *Postgres) UpdateAccount(ctx context.Context, ID int, name string) (*dto.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
 
-	pg := &Postgres{}
-	dataSource := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbUser, dbPwd, dbAddr, dbPort, dbName)
-	db, err := sql.Open("postgres", dataSource)
+	account := dto.Account{}
+
+	row := pg.db.QueryRowContext(ctx, "UPDATE account SET name = $2 WHERE id = $1 RETURNING id, name, isActive", ID, name)
+
+	if err := row.Scan(&(account.ID), &(account.Name), &(account.IsActive)); err != nil {
+		return nil, notFound(err)
+	}
+
+	return &account, nil
+}
+
+// SetActive activates or deactivates the account matching the ID.
+func (pg *Postgres) SetActive(ctx context.Context, ID int, isActive bool) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	result, err := pg.db.ExecContext(ctx, "UPDATE account SET isActive = $2 WHERE id = $1", ID, isActive)
 	if err != nil {
 		return err
 	}
 
-	pg.db = db
+	return checkAffected(result)
+}
+
+// PatchAccount changes the name and the active state of the account matching the ID with a single statement
+// and returns the updated account. Nil values aren't changed.
+func (pg *Postgres) PatchAccount(ctx context.Context, ID int, name *string, isActive *bool) (*dto.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	account := dto.Account{}
+
+	row := pg.db.QueryRowContext(ctx, `
+	UPDATE account SET name = COALESCE($2, name), isActive = COALESCE($3, isActive)
+	WHERE id = $1
+	RETURNING id, name, isActive
+	`, ID, name, isActive)
+
+	if err := row.Scan(&(account.ID), &(account.Name), &(account.IsActive)); err != nil {
+		return nil, notFound(err)
+	}
+
+	return &account, nil
+}
+
+// DeleteAccount removes the account matching the ID.
+func (pg *Postgres) DeleteAccount(ctx context.Context, ID int) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
 
-	// query the database to see if it has the account table
-	rows, err := pg.db.Query("SELECT * FROM account LIMIT 1")
+	result, err := pg.db.ExecContext(ctx, "DELETE FROM account WHERE id = $1", ID)
 	if err != nil {
-		// database isn't set up yet, lets create an account table and populate it with data
-		_, err = pg.db.Exec(`
-		CREATE TABLE IF NOT EXISTS account (
-			id       SERIAL        PRIMARY KEY,
-			name     VARCHAR (255) NOT NULL,
-			isActive BOOLEAN       DEFAULT TRUE
-		);
+		return err
+	}
 
-		INSERT INTO account (name) SELECT md5(RANDOM()::TEXT) FROM generate_series(1, 1000);
-		`)
-		if err != nil {
+	return checkAffected(result)
+}
+
+// ListAccounts returns accounts matching the filter ordered by their ID.
+func (pg *Postgres) ListAccounts(ctx context.Context, filter AccountFilter) ([]*dto.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	// escape LIKE wildcards so the prefix is matched literally
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.NamePrefix)
+
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, name, isActive FROM account
+	WHERE id > $1 AND ($2::BOOLEAN IS NULL OR isActive = $2) AND name LIKE $3
+	ORDER BY id
+	LIMIT $4
+	`, filter.AfterID, filter.Active, prefix+"%", filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*dto.Account{}
+	for rows.Next() {
+		account := &dto.Account{}
+		if err := rows.Scan(&(account.ID), &(account.Name), &(account.IsActive)); err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+// StoreEvents stores a batch of events in a single transaction.
+//
+// PostgreSQL allows at most 65535 parameters per statement, so the events are inserted
+// with one statement for every maxInsertedEvents events.
+func (pg *Postgres) StoreEvents(ctx context.Context, events []*dto.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	// a single statement doesn't need a transaction
+	if len(events) <= maxInsertedEvents {
+		return insertEvents(ctx, pg.db, events)
+	}
+
+	tx, err := pg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(events); start += maxInsertedEvents {
+		end := start + maxInsertedEvents
+		if end > len(events) {
+			end = len(events)
+		}
+
+		if err := insertEvents(ctx, tx, events[start:end]); err != nil {
+			tx.Rollback()
 			return err
 		}
-	} else {
-		rows.Close()
 	}
 
-	DB = pg
+	return tx.Commit()
+}
+
+// insertEvents inserts the events with a single statement.
+func insertEvents(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}, events []*dto.Event) error {
+	values := make([]string, 0, len(events))
+	args := make([]interface{}, 0, len(events)*eventColumns)
+	for i, event := range events {
+		placeholders := make([]string, 0, eventColumns)
+		for j := 1; j <= eventColumns; j++ {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", i*eventColumns+j))
+		}
+
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, nullString(event.EventID), event.AccountID, event.Timestamp, event.EventTime, event.Data, event.Source, contentType(event.ContentType))
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT INTO events (event_id, account_id, timestamp, event_time, data, source, content_type) VALUES "+strings.Join(values, ", "), args...)
 
 	return err
 }
+
+// ListEvents returns events matching the filter ordered by their timestamp and ID.
+func (pg *Postgres) ListEvents(ctx context.Context, filter EventFilter) ([]*dto.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, COALESCE(event_id, ''), account_id, timestamp, event_time, data, source, content_type FROM events
+	WHERE account_id = $1
+	AND ($2::TIMESTAMPTZ IS NULL OR timestamp >= $2)
+	AND ($3::TIMESTAMPTZ IS NULL OR timestamp < $3)
+	AND (timestamp, id) > ($4, $5)
+	ORDER BY timestamp, id
+	LIMIT $6
+	`, filter.AccountID, nullTime(filter.From), nullTime(filter.To), filter.AfterTimestamp, filter.AfterID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*dto.Event{}
+	for rows.Next() {
+		event := &dto.Event{}
+		var eventTime sql.NullTime
+		if err := rows.Scan(&(event.ID), &(event.EventID), &(event.AccountID), &(event.Timestamp), &eventTime, &(event.Data), &(event.Source), &(event.ContentType)); err != nil {
+			return nil, err
+		}
+
+		event.Timestamp = event.Timestamp.UTC()
+		if eventTime.Valid {
+			t := eventTime.Time.UTC()
+			event.EventTime = &t
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// StoreDeadLetter stores the dead letter and sets its ID.
+func (pg *Postgres) StoreDeadLetter(ctx context.Context, deadLetter *dto.DeadLetter) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	row := pg.db.QueryRowContext(ctx, "INSERT INTO dead_letters (event_id, account_id, event, error, failed_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		deadLetter.EventID, deadLetter.AccountID, string(deadLetter.Event), deadLetter.Error, deadLetter.FailedAt)
+
+	return row.Scan(&(deadLetter.ID))
+}
+
+// GetDeadLetter returns the dead letter matching the ID.
+func (pg *Postgres) GetDeadLetter(ctx context.Context, ID int64) (*dto.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	row := pg.db.QueryRowContext(ctx, "SELECT id, event_id, account_id, event, error, failed_at FROM dead_letters WHERE id = $1", ID)
+
+	deadLetter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	return deadLetter, err
+}
+
+// DeleteDeadLetter removes the dead letter matching the ID.
+func (pg *Postgres) DeleteDeadLetter(ctx context.Context, ID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	result, err := pg.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = $1", ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrDeadLetterNotFound
+	}
+
+	return nil
+}
+
+// ListDeadLetters returns dead letters matching the filter ordered by their ID.
+func (pg *Postgres) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*dto.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, event_id, account_id, event, error, failed_at FROM dead_letters
+	WHERE ($1 = 0 OR account_id = $1) AND id > $2
+	ORDER BY id
+	LIMIT $3
+	`, filter.AccountID, filter.AfterID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []*dto.DeadLetter{}
+	for rows.Next() {
+		deadLetter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// scanDeadLetter reads a dead letter from the row.
+func scanDeadLetter(row interface {
+	Scan(dest ...interface{}) error
+}) (*dto.DeadLetter, error) {
+	deadLetter := &dto.DeadLetter{}
+
+	var event string
+	if err := row.Scan(&(deadLetter.ID), &(deadLetter.EventID), &(deadLetter.AccountID), &event, &(deadLetter.Error), &(deadLetter.FailedAt)); err != nil {
+		return nil, err
+	}
+
+	deadLetter.Event = []byte(event)
+	deadLetter.FailedAt = deadLetter.FailedAt.UTC()
+
+	return deadLetter, nil
+}
+
+// StoreAPIKey stores the API key and sets its ID.
+func (pg *Postgres) StoreAPIKey(ctx context.Context, key *dto.APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	// admin keys don't belong to any account
+	accountID := sql.NullInt64{Int64: int64(key.AccountID), Valid: key.AccountID != 0}
+
+	row := pg.db.QueryRowContext(ctx, "INSERT INTO api_keys (hash, scope, account_id, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		key.Hash, key.Scope, accountID, key.CreatedAt)
+
+	return row.Scan(&(key.ID))
+}
+
+// GetAPIKey returns the API key matching the hash.
+func (pg *Postgres) GetAPIKey(ctx context.Context, hash string) (*dto.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	row := pg.db.QueryRowContext(ctx, "SELECT id, hash, scope, account_id, created_at FROM api_keys WHERE hash = $1", hash)
+
+	key := &dto.APIKey{}
+	var accountID sql.NullInt64
+	if err := row.Scan(&(key.ID), &(key.Hash), &(key.Scope), &accountID, &(key.CreatedAt)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+
+		return nil, err
+	}
+
+	key.AccountID = int(accountID.Int64)
+	key.CreatedAt = key.CreatedAt.UTC()
+
+	return key, nil
+}
+
+// DeleteAPIKey revokes the API key matching the ID.
+func (pg *Postgres) DeleteAPIKey(ctx context.Context, ID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	result, err := pg.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id = $1", ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// CountAPIKeys returns the number of API keys with the scope.
+func (pg *Postgres) CountAPIKeys(ctx context.Context, scope string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, pg.timeout)
+	defer cancel()
+
+	var count int
+	err := pg.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys WHERE scope = $1", scope).Scan(&count)
+
+	return count, err
+}
+
+// nullTime returns nil for the zero time, so it can be used as a NULL query parameter.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// nullString returns nil for the empty string, so it can be used as a NULL query parameter.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// contentType returns the content type of the event data, events without it contain text.
+func contentType(contentType string) string {
+	if contentType == "" {
+		return "text/plain"
+	}
+
+	return contentType
+}
+
+// checkAffected returns ErrAccountNotFound if the statement didn't change any rows.
+func checkAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrAccountNotFound
+	}
+
+	return nil
+}
+
+// notFound replaces sql.ErrNoRows with ErrAccountNotFound and returns other errors unchanged.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAccountNotFound
+	}
+
+	return err
+}
+
+// NewPostgres creates a new instance of Postgres.
+//
+// The database schema is migrated to the latest version, migrations are never reverted at startup.
+// If the schema is newer than the latest version known to the service, it refuses to start.
+func NewPostgres() error {
+	// a leftover rollback version would revert the migrations on every start
+	if schemaVersion := os.Getenv("DB_SCHEMA_VERSION"); schemaVersion != "" {
+		return fmt.Errorf("DB_SCHEMA_VERSION is set to %s, but the service only migrates the schema to the latest version, "+
+			"roll the schema back with the -migrate flag instead", schemaVersion)
+	}
+
+	pg, err := openPostgres()
+	if err != nil {
+		return err
+	}
+
+	if err = pg.Migrate(latestVersion()); err != nil {
+		return err
+	}
+
+	DB = pg
+	Events = pg
+	DeadLetters = pg
+	APIKeys = pg
+
+	return nil
+}
+
+// MigratePostgres migrates the database schema up or down to the given version without starting the service.
+//
+// It is the only way to revert migrations, e.g. before rolling back to an older version of the service.
+func MigratePostgres(version int) error {
+	pg, err := openPostgres()
+	if err != nil {
+		return err
+	}
+	defer pg.db.Close()
+
+	return pg.Migrate(version)
+}
+
+// openPostgres connects to the database at DB_ADDR.
+func openPostgres() (*Postgres, error) {
+	dbName = os.Getenv("DB_NAME")
+	dbUser = os.Getenv("DB_USER")
+	dbPwd = os.Getenv("DB_PWD")
+	dbAddr = os.Getenv("DB_ADDR")
+	dbPort = os.Getenv("DB_PORT")
+
+	timeout, err := env.Duration("DB_TIMEOUT", defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSource := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbUser, dbPwd, dbAddr, dbPort, dbName)
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Postgres{
+		db:      db,
+		timeout: timeout,
+	}, nil
+}
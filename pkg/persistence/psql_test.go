@@ -2,9 +2,13 @@
 package persistence
 
 import (
+	"celtra-programming-assigment/pkg/dto"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
@@ -79,7 +83,7 @@ func TestMain(m *testing.M) {
 
 func Test_Account(t *testing.T) {
 	// test insert
-	account, err := DB.CreateAccount("test account", false)
+	account, err := DB.CreateAccount(context.Background(), "test account", false)
 	if err != nil {
 		t.Fatalf("failed to create account: %v", err)
 	}
@@ -98,7 +102,7 @@ func Test_Account(t *testing.T) {
 	}
 
 	// test select
-	account, err = DB.GetAccount(account.ID)
+	account, err = DB.GetAccount(context.Background(), account.ID)
 	if err != nil {
 		t.Fatalf("failed to get account: %v", err)
 	}
@@ -116,7 +120,7 @@ func Test_Account(t *testing.T) {
 	}
 
 	// test isActive check
-	isActive, err := DB.IsActiveAccount(account.ID)
+	isActive, err := DB.IsActiveAccount(context.Background(), account.ID)
 	if err != nil {
 		t.Fatalf("failed to get account: %v", err)
 	}
@@ -126,7 +130,7 @@ func Test_Account(t *testing.T) {
 	}
 
 	// test get active account
-	isActive, err = DB.IsActiveAccount(1)
+	isActive, err = DB.IsActiveAccount(context.Background(), 1)
 	if err != nil {
 		t.Fatalf("failed to get account: %v", err)
 	}
@@ -136,13 +140,314 @@ func Test_Account(t *testing.T) {
 	}
 
 	// test get unknown account
-	isActive, err = DB.IsActiveAccount(9999)
-	if err == nil {
-		t.Fatalf("IsActiveAccount(9999) should have returned an error")
+	isActive, err = DB.IsActiveAccount(context.Background(), 9999)
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("IsActiveAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
 	}
 
-	account, err = DB.GetAccount(9999)
-	if err == nil {
-		t.Fatalf("GetAccount(9999) should have returned an error")
+	account, err = DB.GetAccount(context.Background(), 9999)
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("GetAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_UpdateAccount(t *testing.T) {
+	account, err := DB.CreateAccount(context.Background(), "test account", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	// test rename
+	updated, err := DB.UpdateAccount(context.Background(), account.ID, "renamed account")
+	if err != nil {
+		t.Fatalf("failed to update account: %v", err)
+	}
+
+	if updated.ID != account.ID || updated.Name != "renamed account" || !updated.IsActive {
+		t.Fatalf("updated account, expected {%d renamed account true}, was %v", account.ID, *updated)
+	}
+
+	// test deactivate
+	if err := DB.SetActive(context.Background(), account.ID, false); err != nil {
+		t.Fatalf("failed to deactivate account: %v", err)
+	}
+
+	isActive, err := DB.IsActiveAccount(context.Background(), account.ID)
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+
+	if isActive {
+		t.Fatalf("account isActive, expected %t, was %t", false, isActive)
+	}
+
+	// test delete
+	if err := DB.DeleteAccount(context.Background(), account.ID); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+
+	if _, err := DB.GetAccount(context.Background(), account.ID); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("GetAccount(%d), expected %v, was %v", account.ID, ErrAccountNotFound, err)
+	}
+
+	// test unknown account
+	if _, err := DB.UpdateAccount(context.Background(), 9999, "name"); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("UpdateAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if err := DB.SetActive(context.Background(), 9999, true); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("SetActive(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+
+	if err := DB.DeleteAccount(context.Background(), 9999); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("DeleteAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_PatchAccount(t *testing.T) {
+	account, err := DB.CreateAccount(context.Background(), "test account", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	name, isActive := "patched account", false
+	patched, err := DB.PatchAccount(context.Background(), account.ID, &name, &isActive)
+	if err != nil {
+		t.Fatalf("failed to patch account: %v", err)
+	}
+
+	if patched.ID != account.ID || patched.Name != "patched account" || patched.IsActive {
+		t.Fatalf("patched account, expected {%d patched account false}, was %v", account.ID, *patched)
+	}
+
+	// nil values aren't changed
+	isActive = true
+	patched, err = DB.PatchAccount(context.Background(), account.ID, nil, &isActive)
+	if err != nil {
+		t.Fatalf("failed to patch account: %v", err)
+	}
+
+	if patched.Name != "patched account" || !patched.IsActive {
+		t.Fatalf("patched account, expected {%d patched account true}, was %v", account.ID, *patched)
+	}
+
+	if _, err := DB.PatchAccount(context.Background(), 9999, &name, nil); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("PatchAccount(9999), expected %v, was %v", ErrAccountNotFound, err)
+	}
+}
+
+func Test_ListAccounts(t *testing.T) {
+	// deactivate every other seeded account
+	for id := 2; id <= seedAccounts; id += 2 {
+		if err := DB.SetActive(context.Background(), id, false); err != nil {
+			t.Fatalf("failed to deactivate account %d: %v", id, err)
+		}
+	}
+	defer func() {
+		for id := 2; id <= seedAccounts; id += 2 {
+			DB.SetActive(context.Background(), id, true)
+		}
+	}()
+
+	inactive := false
+	accounts, err := DB.ListAccounts(context.Background(), AccountFilter{Active: &inactive, AfterID: 10, Limit: 3})
+	if err != nil {
+		t.Fatalf("failed to list accounts: %v", err)
+	}
+
+	if len(accounts) != 3 {
+		t.Fatalf("account count, expected %d, was %d", 3, len(accounts))
+	}
+
+	for i, id := range []int{12, 14, 16} {
+		if accounts[i].ID != id || accounts[i].IsActive {
+			t.Fatalf("account, expected {%d inactive}, was %v", id, *accounts[i])
+		}
+	}
+
+	// wildcards in the prefix are matched literally
+	created, err := DB.CreateAccount(context.Background(), "foo_%bar", true)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	defer DB.DeleteAccount(context.Background(), created.ID)
+
+	if _, err := DB.CreateAccount(context.Background(), "fooXbar", true); err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	accounts, err = DB.ListAccounts(context.Background(), AccountFilter{NamePrefix: "foo_%", Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list accounts: %v", err)
+	}
+
+	if len(accounts) != 1 || accounts[0].ID != created.ID {
+		t.Fatalf("expected only account %d, was %v", created.ID, accounts)
+	}
+}
+
+func Test_StoreEvents(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	events := []*dto.Event{
+		{AccountID: 1, Timestamp: now, Data: "first", Source: "test"},
+		{AccountID: 2, Timestamp: now, Data: "second", Source: "test"},
+	}
+
+	if err := Events.StoreEvents(context.Background(), events); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	pg := Events.(*Postgres)
+
+	var count int
+	if err := pg.db.QueryRow("SELECT COUNT(*) FROM events WHERE source = 'test'").Scan(&count); err != nil {
+		t.Fatalf("counting events: %v", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("event count, expected %d, was %d", 2, count)
+	}
+
+	var data string
+	var timestamp time.Time
+	if err := pg.db.QueryRow("SELECT data, timestamp FROM events WHERE account_id = 2").Scan(&data, &timestamp); err != nil {
+		t.Fatalf("reading event: %v", err)
+	}
+
+	if data != "second" || !timestamp.Equal(now) {
+		t.Fatalf("event, expected {second %s}, was {%s %s}", now, data, timestamp)
+	}
+}
+
+func Test_StoreEventsLargeBatch(t *testing.T) {
+	// a single statement with all the events would exceed the limit of 65535 parameters
+	now := time.Now().UTC()
+	events := make([]*dto.Event, 0, 65535/eventColumns+1)
+	for i := 0; i < cap(events); i++ {
+		events = append(events, &dto.Event{AccountID: 503, Timestamp: now, Data: "large batch", Source: "test"})
+	}
+
+	if err := Events.StoreEvents(context.Background(), events); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	var count int
+	if err := Events.(*Postgres).db.QueryRow("SELECT COUNT(*) FROM events WHERE account_id = 503").Scan(&count); err != nil {
+		t.Fatalf("counting events: %v", err)
+	}
+
+	if count != len(events) {
+		t.Fatalf("event count, expected %d, was %d", len(events), count)
+	}
+}
+
+func Test_StoreEventEnvelope(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	eventTime := now.Add(-time.Minute)
+	events := []*dto.Event{
+		{EventID: "6f1c1f3e-5a4e-4c8b-9b1e-3c2a1d0e9f8a", AccountID: 502, Timestamp: now, EventTime: &eventTime, Data: `{"key":1}`, Source: "test", ContentType: "application/json"},
+		{AccountID: 502, Timestamp: now.Add(time.Second), Data: "legacy", Source: "test"},
+	}
+
+	if err := Events.StoreEvents(context.Background(), events); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	listed, err := Events.ListEvents(context.Background(), EventFilter{AccountID: 502, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("event count, expected %d, was %d", 2, len(listed))
+	}
+
+	if listed[0].EventID != events[0].EventID || listed[0].ContentType != "application/json" || listed[0].EventTime == nil || !listed[0].EventTime.Equal(eventTime) {
+		t.Fatalf("unexpected event %+v", listed[0])
+	}
+
+	// events without the envelope fields contain text
+	if listed[1].EventID != "" || listed[1].ContentType != "text/plain" || listed[1].EventTime != nil {
+		t.Fatalf("unexpected event %+v", listed[1])
+	}
+}
+
+func Test_ListEvents(t *testing.T) {
+	start := time.Date(2021, 2, 6, 17, 0, 0, 0, time.UTC)
+
+	// store events out of order and for two accounts
+	stored := []*dto.Event{}
+	for _, minute := range []int{3, 1, 4, 0, 2} {
+		stored = append(stored, &dto.Event{AccountID: 500, Timestamp: start.Add(time.Duration(minute) * time.Minute), Data: fmt.Sprint(minute), Source: "test"})
+		stored = append(stored, &dto.Event{AccountID: 501, Timestamp: start.Add(time.Duration(minute) * time.Minute), Data: fmt.Sprint(minute), Source: "test"})
+	}
+
+	if err := Events.StoreEvents(context.Background(), stored); err != nil {
+		t.Fatalf("failed to store events: %v", err)
+	}
+
+	events, err := Events.ListEvents(context.Background(), EventFilter{AccountID: 500, From: start.Add(time.Minute), To: start.Add(4 * time.Minute), Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+
+	if len(events) != 2 || events[0].Data != "1" || events[1].Data != "2" {
+		t.Fatalf("expected events 1 and 2, was %v", events)
+	}
+
+	// next page
+	events, err = Events.ListEvents(context.Background(), EventFilter{
+		AccountID:      500,
+		From:           start.Add(time.Minute),
+		To:             start.Add(4 * time.Minute),
+		AfterTimestamp: events[1].Timestamp,
+		AfterID:        events[1].ID,
+		Limit:          2,
+	})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Data != "3" || events[0].AccountID != 500 || events[0].Source != "test" {
+		t.Fatalf("expected event 3, was %v", events)
+	}
+}
+
+func Test_CancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := DB.GetAccount(ctx, 1); err == nil {
+		t.Fatalf("GetAccount with a cancelled context should have returned an error")
+	}
+
+	if _, err := Events.ListEvents(ctx, EventFilter{AccountID: 1, Limit: 1}); err == nil {
+		t.Fatalf("ListEvents with a cancelled context should have returned an error")
+	}
+}
+
+func Test_DeadLetters(t *testing.T) {
+	testDeadLetterStore(t, DeadLetters, 600)
+}
+
+func Test_APIKeys(t *testing.T) {
+	testAPIKeyStore(t, DB, APIKeys)
+}
+
+func Test_IsActiveAccounts(t *testing.T) {
+	inactive, err := DB.CreateAccount(context.Background(), "inactive account", false)
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	defer DB.DeleteAccount(context.Background(), inactive.ID)
+
+	active, err := DB.IsActiveAccounts(context.Background(), []int{1, inactive.ID, -1})
+	if err != nil {
+		t.Fatalf("failed to check accounts: %v", err)
+	}
+
+	// accounts that don't exist are missing
+	if len(active) != 2 || !active[1] || active[inactive.ID] {
+		t.Fatalf("expected map[1:true %d:false] but got %v", inactive.ID, active)
 	}
 }
@@ -0,0 +1,146 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventVersion is the version of the event envelope schema.
+//
+// Events published before the envelope was versioned (legacy events) don't have a version.
+const EventVersion = 1
+
+// content types of the event payload
+const (
+	ContentTypeText = "text/plain"
+	ContentTypeJSON = "application/json"
+)
+
+// Event struct is the envelope of the data that is received when subscribing to an account event stream.
+type Event struct {
+	Version     int             // version of the envelope schema
+	ID          string          // unique ID of the event
+	AccountID   int             // ID of the account the event belongs to
+	Timestamp   time.Time       // time when the event was ingested
+	EventTime   *time.Time      `json:",omitempty"` // time when the event happened, if it was supplied by the client
+	Source      string          // hostname of the tracker instance that ingested the event
+	ContentType string          // content type of the payload
+	Data        json.RawMessage // payload, text is encoded as a JSON string
+	Cursor      string          `json:"-"` // position of the event in the messaging bus log, empty if the bus doesn't store events
+}
+
+// legacyEvent is the event schema used before the envelope was versioned,
+// when the hostname of the source was appended to the data.
+type legacyEvent struct {
+	ID        int // account ID
+	Timestamp time.Time
+	Data      string // "DATA [HOSTNAME]"
+}
+
+// NewEvent creates a new event with a unique ID for the account's payload, ingested now by the source.
+//
+// Text payloads are encoded as a JSON string, JSON payloads have to be valid JSON.
+func NewEvent(accountID int, source string, contentType string, payload []byte) (*Event, error) {
+	var data []byte
+	switch contentType {
+	case ContentTypeText:
+		var err error
+		if data, err = json.Marshal(string(payload)); err != nil {
+			return nil, err
+		}
+	case ContentTypeJSON:
+		buffer := &bytes.Buffer{}
+		if err := json.Compact(buffer, payload); err != nil {
+			return nil, fmt.Errorf("invalid JSON payload: %v", err)
+		}
+
+		data = buffer.Bytes()
+	default:
+		return nil, fmt.Errorf("unsupported content type: %s", contentType)
+	}
+
+	ID, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		Version:     EventVersion,
+		ID:          ID,
+		AccountID:   accountID,
+		Timestamp:   time.Now().UTC(),
+		Source:      source,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// Text returns the payload as text, JSON payloads are returned as they are.
+func (e *Event) Text() string {
+	if e.ContentType == ContentTypeText {
+		var text string
+		if err := json.Unmarshal(e.Data, &text); err == nil {
+			return text
+		}
+	}
+
+	return string(e.Data)
+}
+
+// UnmarshalJSON decodes the event from the versioned envelope or from the legacy schema.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	version := struct{ Version int }{}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return err
+	}
+
+	if version.Version > 0 {
+		// envelope has the same fields as Event, but without this method
+		type envelope Event
+
+		return json.Unmarshal(data, (*envelope)(e))
+	}
+
+	legacy := legacyEvent{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	text, source := legacy.Data, ""
+	if i := strings.LastIndex(text, " ["); i >= 0 && strings.HasSuffix(text, "]") {
+		text, source = text[:i], text[i+2:len(text)-1]
+	}
+
+	payload, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+
+	*e = Event{
+		AccountID:   legacy.ID,
+		Timestamp:   legacy.Timestamp,
+		Source:      source,
+		ContentType: ContentTypeText,
+		Data:        payload,
+	}
+
+	return nil
+}
+
+// newEventID returns a random (version 4) UUID.
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating event ID: %v", err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
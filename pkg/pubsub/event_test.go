@@ -0,0 +1,106 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_NewEvent(t *testing.T) {
+	event, err := NewEvent(1, "host", ContentTypeText, []byte(`test "data" [brackets]`))
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+
+	other, err := NewEvent(1, "host", ContentTypeText, []byte("test data"))
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+
+	if event.ID == "" || event.ID == other.ID {
+		t.Fatalf("expected unique event IDs, got %q and %q", event.ID, other.ID)
+	}
+
+	if event.Version != EventVersion {
+		t.Fatalf("expected version %d, got %d", EventVersion, event.Version)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to serialize event: %v", err)
+	}
+
+	decoded := &Event{}
+	if err := json.Unmarshal(payload, decoded); err != nil {
+		t.Fatalf("failed to deserialize event: %v", err)
+	}
+
+	if decoded.ID != event.ID || decoded.AccountID != 1 || decoded.Source != "host" || decoded.ContentType != ContentTypeText {
+		t.Fatalf("unexpected event %+v", decoded)
+	}
+
+	if decoded.Text() != `test "data" [brackets]` {
+		t.Fatalf("expected %s, got %s", `test "data" [brackets]`, decoded.Text())
+	}
+
+	if !decoded.Timestamp.Equal(event.Timestamp) {
+		t.Fatalf("expected %s, got %s", event.Timestamp, decoded.Timestamp)
+	}
+}
+
+func Test_NewEventJSON(t *testing.T) {
+	event, err := NewEvent(1, "host", ContentTypeJSON, []byte(`{ "key": [1, 2] }`))
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+
+	if string(event.Data) != `{"key":[1,2]}` {
+		t.Fatalf("expected %s, got %s", `{"key":[1,2]}`, event.Data)
+	}
+
+	if event.Text() != `{"key":[1,2]}` {
+		t.Fatalf("expected %s, got %s", `{"key":[1,2]}`, event.Text())
+	}
+
+	if _, err := NewEvent(1, "host", ContentTypeJSON, []byte(`{"key":`)); err == nil {
+		t.Fatalf("invalid JSON payload should not be accepted")
+	}
+
+	if _, err := NewEvent(1, "host", "image/png", []byte("data")); err == nil {
+		t.Fatalf("unsupported content type should not be accepted")
+	}
+}
+
+func Test_EventLegacy(t *testing.T) {
+	for _, test := range []struct {
+		payload string
+		text    string
+		source  string
+	}{
+		{`{"ID":3,"Timestamp":"2021-02-06T17:35:30Z","Data":"test data [290ad619a440]"}`, "test data", "290ad619a440"},
+		{`{"ID":3,"Timestamp":"2021-02-06T17:35:30Z","Data":"[x] test data [290ad619a440]"}`, "[x] test data", "290ad619a440"},
+		{`{"ID":3,"Timestamp":"2021-02-06T17:35:30Z","Data":"test data"}`, "test data", ""},
+	} {
+		event := &Event{}
+		if err := json.Unmarshal([]byte(test.payload), event); err != nil {
+			t.Fatalf("failed to deserialize legacy event: %v", err)
+		}
+
+		if event.AccountID != 3 {
+			t.Fatalf("expected %d, got %d", 3, event.AccountID)
+		}
+
+		if event.Version != 0 || event.ContentType != ContentTypeText {
+			t.Fatalf("unexpected legacy event %+v", event)
+		}
+
+		if event.Text() != test.text || event.Source != test.source {
+			t.Fatalf("expected %q from %q, got %q from %q", test.text, test.source, event.Text(), event.Source)
+		}
+
+		if !event.Timestamp.Equal(time.Date(2021, 2, 6, 17, 35, 30, 0, time.UTC)) {
+			t.Fatalf("unexpected timestamp %s", event.Timestamp)
+		}
+	}
+}
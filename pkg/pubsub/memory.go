@@ -0,0 +1,220 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// subscriberBuffer is the number of events that can wait in a subscriber's channel
+// before new events for that subscriber start being dropped.
+const subscriberBuffer = 100
+
+// Memory struct is an implementation of PubSub interface
+// and delivers published events to all their subscribers inside the same process.
+type Memory struct {
+	mu          sync.RWMutex
+	subscribers map[string][]chan []byte // subscribers of each channel
+}
+
+// NewMemory creates a new PubSub client that publishes and subscribes to events in memory.
+func NewMemory() error {
+	Bus = &Memory{}
+
+	return nil
+}
+
+// Publish publishes the event to all subscribers of its account.
+//
+// Publishing never blocks, so the context is ignored.
+func (m *Memory) Publish(ctx context.Context, event *Event) error {
+	eventData, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	m.publish(accountChannel(event.AccountID), eventData)
+
+	return nil
+}
+
+// Subscribe is used to subscribe to one or multiple accounts.
+//
+// Every subscriber receives its own copy of every published event of those accounts.
+// Events aren't stored, so they can't be replayed.
+//
+// Returns a Subscription where you can receive those events.
+func (m *Memory) Subscribe(ctx context.Context, replay Replay, accountIDs ...int) (*Subscription, error) {
+	if !replay.IsZero() {
+		return nil, ErrReplayNotSupported
+	}
+
+	sub := newSubscription(ctx, accountIDs)
+	msgChan := make(chan []byte, subscriberBuffer)
+	m.subscribe(msgChan, accountChannels(accountIDs)...)
+
+	sub.add = func(ctx context.Context, accountIDs []int) error {
+		m.subscribe(msgChan, accountChannels(accountIDs)...)
+
+		return nil
+	}
+	sub.remove = func(ctx context.Context, accountIDs []int) error {
+		m.unsubscribe(msgChan, accountChannels(accountIDs)...)
+
+		return nil
+	}
+
+	go func() {
+		defer sub.finish()
+		defer m.unsubscribeAll(msgChan)
+
+		for {
+			select {
+			case payload := <-msgChan:
+				if !sub.deliver(payload, "") {
+					return
+				}
+			case <-sub.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+// PublishControl publishes the control message to all subscribers of control messages.
+//
+// Publishing never blocks, so the context is ignored.
+func (m *Memory) PublishControl(ctx context.Context, message *ControlMessage) error {
+	messageData, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	m.publish(controlChannel, messageData)
+
+	return nil
+}
+
+// SubscribeControl is used to subscribe to control messages.
+//
+// Returns a channel where you can receive those messages, it is closed when the context is cancelled.
+func (m *Memory) SubscribeControl(ctx context.Context) chan *ControlMessage {
+	messageChan := make(chan *ControlMessage)
+	msgChan := make(chan []byte, subscriberBuffer)
+	m.subscribe(msgChan, controlChannel)
+
+	go func() {
+		defer close(messageChan)
+		defer m.unsubscribe(msgChan, controlChannel)
+
+		for {
+			select {
+			case payload := <-msgChan:
+				message := &ControlMessage{}
+				if err := json.Unmarshal(payload, message); err != nil {
+					log.Warn().Msgf("error while deserializing control message, skipping it: %v", err)
+
+					continue
+				}
+
+				select {
+				case messageChan <- message:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return messageChan
+}
+
+// publish sends the payload to all subscribers of the channel.
+func (m *Memory) publish(channel string, payload []byte) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, subscriber := range m.subscribers[channel] {
+		select {
+		case subscriber <- payload:
+		default:
+			// like Redis, a slow subscriber doesn't block the publisher
+			log.Warn().Msgf("subscriber buffer is full, dropping message on %s channel", channel)
+		}
+	}
+}
+
+// subscribe registers the subscriber's channel, where the published payloads are sent, as a subscriber of the channels.
+func (m *Memory) subscribe(msgChan chan []byte, channels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.subscribers == nil {
+		m.subscribers = map[string][]chan []byte{}
+	}
+
+	for _, channel := range channels {
+		// like Redis, subscribing to the same channel twice doesn't duplicate the messages
+		if !containsSubscriber(m.subscribers[channel], msgChan) {
+			m.subscribers[channel] = append(m.subscribers[channel], msgChan)
+		}
+	}
+}
+
+// unsubscribe removes the subscriber from the channels.
+//
+// The subscriber's channel isn't closed, because a publisher might still be sending to it.
+func (m *Memory) unsubscribe(msgChan chan []byte, channels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, channel := range channels {
+		m.removeSubscriber(channel, msgChan)
+	}
+}
+
+// unsubscribeAll removes the subscriber from all the channels it is subscribed to.
+func (m *Memory) unsubscribeAll(msgChan chan []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for channel := range m.subscribers {
+		m.removeSubscriber(channel, msgChan)
+	}
+}
+
+// removeSubscriber removes the subscriber from the channel, the caller has to hold the lock.
+func (m *Memory) removeSubscriber(channel string, msgChan chan []byte) {
+	subscribers := m.subscribers[channel]
+	for i, subscriber := range subscribers {
+		if subscriber == msgChan {
+			subscribers = append(subscribers[:i], subscribers[i+1:]...)
+
+			break
+		}
+	}
+
+	if len(subscribers) == 0 {
+		delete(m.subscribers, channel)
+	} else {
+		m.subscribers[channel] = subscribers
+	}
+}
+
+// containsSubscriber checks if the subscriber's channel is one of the subscribers.
+func containsSubscriber(subscribers []chan []byte, msgChan chan []byte) bool {
+	for _, subscriber := range subscribers {
+		if subscriber == msgChan {
+			return true
+		}
+	}
+
+	return false
+}
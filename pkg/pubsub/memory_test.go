@@ -0,0 +1,325 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// textEvent creates a new text event of the account, it panics if the event can't be created.
+func textEvent(accountID int, text string) *Event {
+	event, err := NewEvent(accountID, "test", ContentTypeText, []byte(text))
+	if err != nil {
+		panic(err)
+	}
+
+	return event
+}
+
+func Test_MemoryPubSub(t *testing.T) {
+	bus := &Memory{}
+
+	// every subscriber should receive every event of its accounts
+	subscribers := []*Subscription{}
+	for _, accountIDs := range [][]int{{1, 2}, {1, 2}, {2, 1, 3}} {
+		sub, err := bus.Subscribe(context.Background(), Replay{}, accountIDs...)
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		subscribers = append(subscribers, sub)
+	}
+
+	if err := bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	if err := bus.Publish(context.Background(), textEvent(2, "more data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	for i, sub := range subscribers {
+		for _, expected := range []struct {
+			AccountID int
+			Data      string
+		}{{1, "test data"}, {2, "more data"}} {
+			select {
+			case event := <-sub.Events():
+				if event == nil {
+					t.Fatalf("subscriber %d: expected a published event", i)
+				}
+				if event.AccountID != expected.AccountID {
+					t.Fatalf("subscriber %d: expected %d, got %d", i, expected.AccountID, event.AccountID)
+				}
+				if event.Text() != expected.Data {
+					t.Fatalf("subscriber %d: expected %s, got %s", i, expected.Data, event.Text())
+				}
+				if event.Timestamp.Location() != time.UTC {
+					t.Fatalf("subscriber %d: expected UTC timestamp, got %s", i, event.Timestamp.Location())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("subscriber %d: timed out", i)
+			}
+		}
+	}
+}
+
+func Test_MemoryPubSubSlowSubscriber(t *testing.T) {
+	bus := &Memory{}
+
+	// nobody reads from this subscription
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriberBuffer*2; i++ {
+			if err := bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+				t.Errorf("failed to publish: %v", err)
+			}
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishing was blocked by a slow subscriber")
+	}
+}
+
+func Test_MemoryControl(t *testing.T) {
+	bus := &Memory{}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 7)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	subscribers := []chan *ControlMessage{bus.SubscribeControl(context.Background()), bus.SubscribeControl(context.Background())}
+
+	if err := bus.PublishControl(context.Background(), &ControlMessage{Type: InvalidateAccount, AccountID: 7}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	for i, messages := range subscribers {
+		select {
+		case message := <-messages:
+			if message.Type != InvalidateAccount || message.AccountID != 7 {
+				t.Fatalf("subscriber %d: unexpected message %+v", i, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d: timed out", i)
+		}
+	}
+
+	// control messages aren't events
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_MemoryPubSubAccounts(t *testing.T) {
+	bus := &Memory{}
+
+	// subscribing to the same account twice doesn't duplicate events
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 2, 2)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	for _, accountID := range []int{1, 2, 3, 2} {
+		if err := bus.Publish(context.Background(), textEvent(accountID, "test data")); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-sub.Events():
+			if event.AccountID != 2 {
+				t.Fatalf("expected %d, got %d", 2, event.AccountID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_MemorySubscriptionAddRemove(t *testing.T) {
+	bus := &Memory{}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	if err := sub.Add(context.Background(), 2, 1); err != nil {
+		t.Fatalf("failed to add accounts: %v", err)
+	}
+
+	if err := sub.Remove(context.Background(), 1, 3); err != nil {
+		t.Fatalf("failed to remove accounts: %v", err)
+	}
+
+	// the last account can't be removed
+	if err := sub.Remove(context.Background(), 2); err != ErrNoAccounts {
+		t.Fatalf("expected %v, got %v", ErrNoAccounts, err)
+	}
+
+	for _, accountID := range []int{1, 2, 3} {
+		if err := bus.Publish(context.Background(), textEvent(accountID, "test data")); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	select {
+	case event := <-sub.Events():
+		if event.AccountID != 2 {
+			t.Fatalf("expected %d, got %d", 2, event.AccountID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the removed account isn't subscribed to anymore and closing the subscription unsubscribes from all accounts
+	sub.Close()
+
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	if len(bus.subscribers) != 0 {
+		t.Fatalf("expected no subscribers, got %v", bus.subscribers)
+	}
+}
+
+func Test_MemorySubscriptionClose(t *testing.T) {
+	bus := &Memory{}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1, 2)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	sub.Close()
+
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("expected a closed event channel")
+	}
+
+	if len(bus.subscribers) != 0 {
+		t.Fatalf("expected no subscribers, got %d channels", len(bus.subscribers))
+	}
+
+	// publishing after the subscription ended doesn't block or panic
+	if err := bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+}
+
+func Test_MemorySubscriptionCancel(t *testing.T) {
+	bus := &Memory{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sub, err := bus.Subscribe(ctx, Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	messages := bus.SubscribeControl(ctx)
+
+	// an event nobody receives doesn't keep the subscription alive
+	if err := bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for range sub.Events() {
+		}
+		for range messages {
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("subscriptions weren't closed after the context was cancelled")
+	}
+
+	// closing an ended subscription doesn't block
+	sub.Close()
+}
+
+func Test_MemoryReplay(t *testing.T) {
+	bus := &Memory{}
+
+	if _, err := bus.Subscribe(context.Background(), Replay{Since: time.Now().Add(-time.Minute)}, 1); err != ErrReplayNotSupported {
+		t.Fatalf("expected %v, got %v", ErrReplayNotSupported, err)
+	}
+}
+
+func Test_MemorySubscriptionStatus(t *testing.T) {
+	bus := &Memory{}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// payloads that can't be deserialized are reported and skipped
+	bus.publish(accountChannel(1), []byte("not an event"))
+
+	if err := bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case event := <-sub.Events():
+		if event.Text() != "test data" {
+			t.Fatalf("expected %s, got %s", "test data", event.Text())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+
+	select {
+	case status := <-sub.Status():
+		if status.Type != StatusError || status.Err == nil {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+
+	sub.Close()
+
+	if _, ok := <-sub.Status(); ok {
+		t.Fatalf("expected a closed status channel")
+	}
+}
@@ -0,0 +1,312 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"celtra-programming-assigment/pkg/env"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// default configuration of the publish queue
+const (
+	defaultPublishWorkers   = 10
+	defaultPublishQueueSize = 10000
+
+	spoolRetryDelay = time.Second
+)
+
+var (
+	// Queue is an active publisher that asynchronously publishes events to Bus
+	Queue *Publisher
+
+	// ErrQueueFull is returned when the event can't be queued because the publish queue is full.
+	ErrQueueFull = errors.New("publish queue is full")
+	// ErrQueueClosed is returned when the event can't be queued because the publisher was closed.
+	ErrQueueClosed = errors.New("publish queue is closed")
+)
+
+// Publisher queues events and publishes them to a PubSub with a fixed number of worker goroutines,
+// so that a slow messaging bus can't pile up an unbounded number of goroutines.
+//
+// If the publisher has a spool, events that can't be published are spooled and published again
+// in the same order from a background goroutine once the messaging bus is available.
+type Publisher struct {
+	// OnPublish is called after the event was published.
+	OnPublish func(event *Event)
+	// OnDeadLetter is called when the event couldn't be published or spooled, so it can be published later.
+	OnDeadLetter func(event *Event, err error)
+
+	bus   PubSub
+	queue chan *Event
+	spool *Spool
+	stop  chan struct{} // stops draining the spool
+	done  chan struct{} // closed when the spool stops draining
+
+	dropped int64 // events that weren't queued because the queue was full
+	failed  int64 // events that couldn't be published
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// QueueStats struct contains the metrics of the publish queue.
+type QueueStats struct {
+	Depth   int   // number of events waiting to be published
+	Dropped int64 // number of events that weren't accepted because the queue was full
+	Failed  int64 // number of events that couldn't be published
+
+	Spooled    int64 // number of events that were spooled because they couldn't be published
+	SpoolDepth int64 // number of events waiting in the spool
+}
+
+// NewQueue creates a new Publisher for the active Bus wrapped with retries (see NewRetrying)
+// and sets it as the active Queue.
+//
+// Number of workers and queue size can be set with PUBLISH_WORKERS and PUBLISH_QUEUE_SIZE environment variables.
+// Events that can't be published are spooled to the SPOOL_DIR directory if it is set, the size of its segments
+// and its maximum size (in bytes) can be set with SPOOL_SEGMENT_SIZE and SPOOL_MAX_SIZE environment variables.
+func NewQueue() error {
+	if Bus == nil {
+		return errors.New("messaging bus is not initialized")
+	}
+
+	workers, err := env.Int("PUBLISH_WORKERS", defaultPublishWorkers)
+	if err != nil {
+		return err
+	}
+
+	queueSize, err := env.Int("PUBLISH_QUEUE_SIZE", defaultPublishQueueSize)
+	if err != nil {
+		return err
+	}
+
+	// only the queue retries, synchronous publishing fails fast
+	bus, err := NewRetrying(Bus)
+	if err != nil {
+		return err
+	}
+
+	var spool *Spool
+	if dir := os.Getenv("SPOOL_DIR"); dir != "" {
+		segmentSize, err := env.Int("SPOOL_SEGMENT_SIZE", defaultSpoolSegmentSize)
+		if err != nil {
+			return err
+		}
+
+		maxSize, err := env.Int("SPOOL_MAX_SIZE", defaultSpoolMaxSize)
+		if err != nil {
+			return err
+		}
+
+		if spool, err = OpenSpool(dir, int64(segmentSize), int64(maxSize)); err != nil {
+			return err
+		}
+	}
+
+	Queue = NewPublisher(bus, workers, queueSize, spool)
+
+	return nil
+}
+
+// NewPublisher creates a new Publisher and starts its workers.
+//
+// At most queueSize events can wait to be published. If spool is nil, events that can't be published are dropped.
+func NewPublisher(bus PubSub, workers int, queueSize int, spool *Spool) *Publisher {
+	p := &Publisher{
+		bus:   bus,
+		queue: make(chan *Event, queueSize),
+		spool: spool,
+	}
+
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+
+	if spool != nil {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+
+		go p.drain()
+	}
+
+	return p
+}
+
+// Publish queues the event to be published.
+//
+// It never blocks, so it returns ErrQueueFull if the queue is full or ErrQueueClosed if the publisher was closed.
+func (p *Publisher) Publish(event *Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case p.queue <- event:
+		return nil
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+
+		return ErrQueueFull
+	}
+}
+
+// Stats returns the current metrics of the publish queue.
+func (p *Publisher) Stats() QueueStats {
+	stats := QueueStats{
+		Depth:   len(p.queue),
+		Dropped: atomic.LoadInt64(&p.dropped),
+		Failed:  atomic.LoadInt64(&p.failed),
+	}
+
+	if p.spool != nil {
+		stats.Spooled = p.spool.Spooled()
+		stats.SpoolDepth = p.spool.Pending()
+	}
+
+	return stats
+}
+
+// Close stops accepting new events and waits until all the queued events are published or spooled.
+//
+// Events that are still in the spool are published when the spool is opened again.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+
+		if p.stop != nil {
+			close(p.stop)
+		}
+	}
+	p.mu.Unlock()
+
+	p.workers.Wait()
+
+	if p.spool != nil {
+		<-p.done
+
+		if err := p.spool.Close(); err != nil {
+			log.Error().Msgf("closing spool: %v", err)
+		}
+	}
+}
+
+// run publishes the queued events until the publisher is closed.
+func (p *Publisher) run() {
+	defer p.workers.Done()
+
+	for event := range p.queue {
+		// spooled events have to be published first to keep the order
+		if p.spool != nil && p.spool.Pending() > 0 {
+			p.spoolEvent(event)
+
+			continue
+		}
+
+		// events are published in the background, so there is no request context to use
+		if err := p.bus.Publish(context.Background(), event); err != nil {
+			if p.spool != nil && !errors.Is(err, ErrInvalidEvent) {
+				p.spoolEvent(event)
+
+				continue
+			}
+
+			p.fail(event, fmt.Errorf("publishing: %w", err))
+
+			continue
+		}
+
+		if p.OnPublish != nil {
+			p.OnPublish(event)
+		}
+	}
+}
+
+// spoolEvent appends the event to the spool, so it is published later.
+func (p *Publisher) spoolEvent(event *Event) {
+	if err := p.spool.Append(event); err != nil {
+		p.fail(event, fmt.Errorf("spooling: %w", err))
+	}
+}
+
+// fail counts the event that couldn't be published and passes it on to OnDeadLetter.
+func (p *Publisher) fail(event *Event, err error) {
+	atomic.AddInt64(&p.failed, 1)
+	log.Error().Msgf("event %s for accoundID %d failed: %v", event.ID, event.AccountID, err)
+
+	if p.OnDeadLetter != nil {
+		p.OnDeadLetter(event, err)
+	}
+}
+
+// drain publishes the spooled events in order until the publisher is closed.
+//
+// When an event can't be published, it is retried after a delay, so the order is kept.
+func (p *Publisher) drain() {
+	defer close(p.done)
+
+	unavailable := false
+	for {
+		event, err := p.spool.Next()
+		if err != nil {
+			log.Error().Msgf("reading spooled event: %v", err)
+		}
+
+		if event == nil {
+			select {
+			case <-p.spool.Appended():
+			case <-time.After(spoolRetryDelay):
+			case <-p.stop:
+				return
+			}
+
+			continue
+		}
+
+		if err := p.bus.Publish(context.Background(), event); err != nil {
+			if errors.Is(err, ErrInvalidEvent) {
+				p.spool.Remove()
+				p.fail(event, fmt.Errorf("publishing spooled event: %w", err))
+
+				continue
+			}
+
+			if !unavailable {
+				unavailable = true
+				log.Warn().Msgf("publishing spooled events failed, retrying every %v: %v", spoolRetryDelay, err)
+			}
+
+			select {
+			case <-time.After(spoolRetryDelay):
+			case <-p.stop:
+				return
+			}
+
+			continue
+		}
+
+		if unavailable {
+			unavailable = false
+			log.Info().Msg("publishing spooled events again")
+		}
+
+		p.spool.Remove()
+
+		if p.OnPublish != nil {
+			p.OnPublish(event)
+		}
+	}
+}
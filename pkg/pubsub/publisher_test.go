@@ -0,0 +1,122 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingBus is a PubSub that blocks publishing until it is released.
+type blockingBus struct {
+	Memory
+	release chan struct{}
+}
+
+func (b *blockingBus) Publish(ctx context.Context, event *Event) error {
+	<-b.release
+
+	return b.Memory.Publish(ctx, event)
+}
+
+func Test_Publisher(t *testing.T) {
+	bus := &Memory{}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	var published int64
+	p := NewPublisher(bus, 3, 10, nil)
+	p.OnPublish = func(event *Event) {
+		atomic.AddInt64(&published, 1)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := p.Publish(textEvent(1, "test data")); err != nil {
+			t.Fatalf("failed to queue event: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-sub.Events():
+		case <-time.After(time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+
+	// closing waits for the workers, so all events were counted
+	p.Close()
+
+	if published != 5 {
+		t.Fatalf("published events, expected %d, was %d", 5, published)
+	}
+
+	if err := p.Publish(textEvent(1, "test data")); err != ErrQueueClosed {
+		t.Fatalf("expected %v, got %v", ErrQueueClosed, err)
+	}
+}
+
+func Test_PublisherFull(t *testing.T) {
+	bus := &blockingBus{release: make(chan struct{})}
+	p := NewPublisher(bus, 1, 2, nil)
+
+	if err := p.Publish(textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to queue event: %v", err)
+	}
+
+	// wait until the worker takes the event
+	for deadline := time.Now().Add(time.Second); p.Stats().Depth > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// two events wait in the queue and the rest are dropped
+	for i := 0; i < 4; i++ {
+		err := p.Publish(textEvent(1, "test data"))
+		if i < 2 && err != nil {
+			t.Fatalf("failed to queue event: %v", err)
+		}
+		if i >= 2 && err != ErrQueueFull {
+			t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+		}
+	}
+
+	stats := p.Stats()
+	if stats.Dropped != 2 || stats.Depth != 2 {
+		t.Fatalf("queue stats, expected {Depth:2 Dropped:2}, was %+v", stats)
+	}
+
+	// queued events are published before closing finishes
+	close(bus.release)
+	p.Close()
+
+	if depth := p.Stats().Depth; depth != 0 {
+		t.Fatalf("queue depth, expected %d, was %d", 0, depth)
+	}
+}
+
+func Test_PublisherFailed(t *testing.T) {
+	bus := &Memory{}
+	p := NewPublisher(bus, 1, 10, nil)
+
+	// events that can't be serialized can't be published
+	event := textEvent(1, "test data")
+	event.Data = []byte("{")
+
+	if err := p.Publish(event); err != nil {
+		t.Fatalf("failed to queue event: %v", err)
+	}
+
+	p.Close()
+
+	if failed := p.Stats().Failed; failed != 1 {
+		t.Fatalf("failed events, expected %d, was %d", 1, failed)
+	}
+}
@@ -2,17 +2,95 @@
 package pubsub
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// names of the messaging bus channels, events of each account are published to "events:ACCOUNT_ID"
+const (
+	eventsChannel  = "events"
+	controlChannel = "control"
+)
+
+// types of the control messages
+const (
+	// InvalidateAccount control message tells the service instances that the account was changed
+	// and that they should discard any cached data about it.
+	InvalidateAccount = "invalidate_account"
+	// InvalidateAPIKey control message tells the service instances that the API key was revoked
+	// and that they should discard the cached key and close its open sessions.
+	InvalidateAPIKey = "invalidate_api_key"
+)
+
 // Bus is an active messaging bus connection
 var Bus PubSub
 
-// Event struct wraps the data that is received when subscribing to an account event stream.
-type Event struct {
-	ID        int
-	Timestamp time.Time
-	Data      string
+// ErrReplayNotSupported is returned when replaying events is requested from a messaging bus that doesn't store them.
+var ErrReplayNotSupported = errors.New("replaying events is not supported by the messaging bus")
+
+// ErrInvalidEvent is returned when the event can't be published because it can't be serialized,
+// so publishing it again would fail as well.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// Replay defines the point in the past from which a subscription starts receiving the stored events,
+// before continuing with the newly published ones. The zero value doesn't replay any events.
+type Replay struct {
+	Since time.Time // replay the events published at or after Since
+	After string    // replay the events published after the event with this Cursor, takes precedence over Since
+	// Cursors replay the events of each account after the last received event of that account
+	// and take precedence over After and Since. Cursors of different accounts can't be compared,
+	// so resuming multiple accounts needs a cursor per account.
+	Cursors map[int]string
+}
+
+// IsZero reports whether no events should be replayed.
+func (r Replay) IsZero() bool {
+	return r.Since.IsZero() && r.After == "" && len(r.Cursors) == 0
+}
+
+// ControlMessage struct wraps internal messages that are exchanged between the service instances.
+type ControlMessage struct {
+	Type      string
+	AccountID int
+	APIKeyID  int64
+}
+
+// marshalEvent serializes the event the same way for all messaging buses, so subscribers receive identical values.
+//
+// Returns an error wrapping ErrInvalidEvent if the event can't be serialized.
+func marshalEvent(event *Event) ([]byte, error) {
+	eventData, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+
+	return eventData, nil
+}
+
+// accountChannel returns the name of the channel where the account's events are published.
+func accountChannel(accountID int) string {
+	return fmt.Sprintf("%s:%d", eventsChannel, accountID)
+}
+
+// accountChannels returns the names of the channels where the accounts' events are published.
+//
+// Every channel is returned only once, even if the account is repeated.
+func accountChannels(accountIDs []int) []string {
+	channels := make([]string, 0, len(accountIDs))
+	added := map[int]struct{}{}
+	for _, accountID := range accountIDs {
+		if _, ok := added[accountID]; ok {
+			continue
+		}
+
+		added[accountID] = struct{}{}
+		channels = append(channels, accountChannel(accountID))
+	}
+
+	return channels
 }
 
 // PubSub interface represents the connection to the messaging bus
@@ -20,10 +98,24 @@ type Event struct {
 //
 // It can also be used to create a mocked implementation for testing purposes.
 type PubSub interface {
-	// Publish publishes the account's data to the "events" subscriptiono.
-	Publish(accountID int, data string) error
-	// Subscribe is used to subscribe to an "events" channel.
+	// Publish publishes the event to the "events:ACCOUNT_ID" channel of the event's account.
+	//
+	// The context cancels publishing if it takes too long.
+	// ErrInvalidEvent is returned if the event can't be serialized.
+	Publish(ctx context.Context, event *Event) error
+	// Subscribe is used to subscribe to the "events:ACCOUNT_ID" channels of the given accounts.
+	//
+	// The subscription lasts until it's closed or the context is cancelled.
+	// If replay isn't zero, the stored events since that point are received first.
+	// ErrReplayNotSupported is returned if the messaging bus doesn't store the events.
+	//
+	// Returns a Subscription where you can receive the events of those accounts.
+	Subscribe(ctx context.Context, replay Replay, accountIDs ...int) (*Subscription, error)
+	// PublishControl publishes the control message to the "control" channel.
+	PublishControl(ctx context.Context, message *ControlMessage) error
+	// SubscribeControl is used to subscribe to the "control" channel until the context is cancelled.
 	//
-	// Returns a channel where you can receive those events.
-	Subscribe() chan *Event
+	// Returns a channel where you can receive control messages, it is closed when the context is cancelled.
+	// Messages that can't be deserialized are skipped.
+	SubscribeControl(ctx context.Context) chan *ControlMessage
 }
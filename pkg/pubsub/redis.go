@@ -2,90 +2,449 @@
 package pubsub
 
 import (
+	"celtra-programming-assigment/pkg/env"
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// defaultTimeout is the maximum duration of a single Redis operation if REDIS_TIMEOUT isn't set.
+	defaultTimeout = 5 * time.Second
+	// healthCheckInterval is how long a subscription waits for a message before it checks the connection with a ping.
+	healthCheckInterval = 30 * time.Second
+	// reconnectDelay is how long a subscription waits before reconnecting after the connection was lost.
+	reconnectDelay = time.Second
+)
+
 var redisAddr string // REDIS_ADDR
 
 // Redis struct is an implementation of PubSub interface 
 // and is using a Redis client for publishing and subscribing.
 type Redis struct {
-	client *redis.Client
+	client      *redis.Client
+	timeout     time.Duration // REDIS_TIMEOUT
+	healthCheck time.Duration // how long subscriptions wait for a message before they check the connection
 }
 
 // NewRedis creates a new PubSub client that uses Redis for publishing and subscribing to events.
 func NewRedis() error {
+	r, err := newRedis()
+	if err != nil {
+		return err
+	}
+
+	Bus = r
+
+	return nil
+}
+
+// newRedis connects to Redis at REDIS_ADDR.
+func newRedis() (*Redis, error) {
 	redisAddr = os.Getenv("REDIS_ADDR")
 
+	timeout, err := env.Duration("REDIS_TIMEOUT", defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	redisBus := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 		DB:   0,
 	})
 
-	status := redisBus.Ping(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status := redisBus.Ping(ctx)
 	if status.Err() != nil {
-		return status.Err()
+		return nil, status.Err()
 	}
 
-	Bus = &Redis{
-		client: redisBus,
+	return &Redis{
+		client:      redisBus,
+		timeout:     timeout,
+		healthCheck: healthCheckInterval,
+	}, nil
+}
+
+// Publish publishes the event to the Bus.
+func (r *Redis) Publish(ctx context.Context, event *Event) error {
+	eventData, err := marshalEvent(event)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	return r.client.Publish(ctx, accountChannel(event.AccountID), string(eventData)).Err()
 }
 
-// Publish publishes the account's data to the Bus.
-func (r *Redis) Publish(accountID int, data string) error {
-	event := Event{
-		ID:        accountID,
-		Timestamp: time.Now().UTC(),
-		Data:      data,
+// Subscribe is used to subscribe to one or multiple accounts.
+//
+// The subscription is confirmed by Redis before Subscribe returns, so no events published afterwards are missed.
+// Closing the subscription closes its Redis connection. Redis doesn't store published events, so they can't be replayed.
+// Lost connections are reported on the Status channel and the subscription reconnects until it is closed.
+//
+// Returns a Subscription where you can receive those events.
+func (r *Redis) Subscribe(ctx context.Context, replay Replay, accountIDs ...int) (*Subscription, error) {
+	if !replay.IsZero() {
+		return nil, ErrReplayNotSupported
+	}
+
+	channels := accountChannels(accountIDs)
+
+	pubsub, err := r.subscribe(ctx, channels...)
+	if err != nil {
+		return nil, err
 	}
 
-	eventData, err := json.Marshal(event)
+	sub := &redisSubscription{
+		Subscription: newSubscription(ctx, accountIDs),
+		redis:        r,
+		channels:     channels,
+		pubsub:       pubsub,
+		confirms:     map[string]chan struct{}{},
+	}
+	sub.Subscription.add = sub.add
+	sub.Subscription.remove = sub.remove
+	sub.receive = func(payload string) bool {
+		return sub.deliver([]byte(payload), "")
+	}
+
+	// closing the Redis subscription interrupts the blocked receive
+	go func() {
+		<-sub.ctx.Done()
+		sub.close()
+	}()
+
+	go sub.run()
+
+	return sub.Subscription, nil
+}
+
+// PublishControl publishes the control message to all service instances.
+func (r *Redis) PublishControl(ctx context.Context, message *ControlMessage) error {
+	messageData, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Publish(context.Background(), "events", string(eventData)).Err()
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	return r.client.Publish(ctx, controlChannel, string(messageData)).Err()
 }
 
-// Subscribe is used to subscribe to one or multiple accounts.
+// SubscribeControl is used to subscribe to control messages.
 //
-// Returns a channel where you can receive those events.
-func (r *Redis) Subscribe() chan *Event {
-	eventChan := make(chan *Event)
+// Like event subscriptions, the control subscription subscribes again when the connection is lost or a ping
+// isn't answered. Control messages published while it is disconnected are lost, so the disconnects are logged.
+//
+// Returns a channel where you can receive those messages, it is closed when the context is cancelled.
+func (r *Redis) SubscribeControl(ctx context.Context) chan *ControlMessage {
+	messageChan := make(chan *ControlMessage)
+
+	// the subscription isn't confirmed before returning, so Redis being unavailable doesn't block the caller
+	sub := &redisSubscription{
+		Subscription: newSubscription(ctx, nil),
+		redis:        r,
+		channels:     []string{controlChannel},
+		pubsub:       r.client.Subscribe(ctx, controlChannel),
+		confirms:     map[string]chan struct{}{},
+	}
+	sub.receive = func(payload string) bool {
+		message := &ControlMessage{}
+		if err := json.Unmarshal([]byte(payload), message); err != nil {
+			log.Warn().Msgf("error while deserializing control message, skipping it: %v", err)
+
+			return true
+		}
+
+		select {
+		case messageChan <- message:
+			return true
+		case <-sub.ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		<-sub.ctx.Done()
+		sub.close()
+	}()
 
-	sub := r.client.Subscribe(context.Background(), "events")
+	go sub.run()
 
+	// the status channel is closed once run stops sending messages
 	go func() {
-		msgChan := sub.Channel()
+		defer close(messageChan)
 
-		for msg := range msgChan {
-			payload := []byte(msg.Payload)
+		for status := range sub.Status() {
+			switch status.Type {
+			case StatusDisconnected:
+				log.Warn().Msgf("control subscription disconnected, control messages are missed until it reconnects: %v", status.Err)
+			case StatusReconnected:
+				log.Info().Msg("control subscription reconnected")
+			}
+		}
+	}()
 
-			event := &Event{}
-			if err := json.Unmarshal(payload, event); err != nil {
-				log.Warn().Msgf("error while deserializing event, sending error on event chan: %v", err)
+	return messageChan
+}
 
-				eventChan <- &Event{
-					ID:        -1,
-					Timestamp: time.Now().UTC(),
-					Data:      err.Error(),
+// subscribe subscribes to the channels and waits until Redis confirms the subscription.
+func (r *Redis) subscribe(ctx context.Context, channels ...string) (*redis.PubSub, error) {
+	pubsub := r.client.Subscribe(ctx, channels...)
+
+	receiveCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if _, err := pubsub.Receive(receiveCtx); err != nil {
+		pubsub.Close()
+
+		return nil, err
+	}
+
+	return pubsub, nil
+}
+
+// redisSubscription receives the events or control messages of a Redis subscription
+// and subscribes again when the connection is lost.
+type redisSubscription struct {
+	*Subscription
+	redis *Redis
+
+	mu       sync.Mutex // guards the fields below, pubsub is replaced when the subscription reconnects
+	channels []string
+	pubsub   *redis.PubSub
+	closed   bool
+	confirms map[string]chan struct{} // closed when Redis confirms the subscription of the channel
+
+	// receive handles the payload of a received message, it returns false if the subscription ended meanwhile
+	receive func(payload string) bool
+}
+
+// run receives the events until the subscription ends.
+//
+// go-redis reconnects by itself when the connection is closed, but not when it is half-open and just stops
+// responding, so the subscription is closed and subscribed again when a ping isn't answered.
+func (s *redisSubscription) run() {
+	defer s.finish()
+
+	// stale is set when a ping isn't answered and stays set until the subscription is subscribed again
+	disconnected, pinged, stale := false, false, false
+	for {
+		msg, err := s.current().ReceiveTimeout(context.Background(), s.redis.healthCheck)
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if !pinged {
+				// nothing was received for a while, the pong shows that the connection is still alive
+				pinged = true
+				err = s.current().Ping(context.Background())
+				if err == nil {
+					continue
 				}
+			} else {
+				err = errors.New("redis didn't respond to a ping")
+				stale = true
+			}
+		}
 
-				continue
+		if err != nil {
+			// the error is only logged once, not on every retry
+			if !disconnected {
+				log.Warn().Msgf("error while receiving messages, reconnecting: %v", err)
+
+				disconnected = true
+				s.report(StatusDisconnected, err)
+			}
+
+			select {
+			case <-time.After(reconnectDelay):
+			case <-s.ctx.Done():
+				return
+			}
+
+			if stale {
+				if err := s.resubscribe(); err != nil {
+					if s.ctx.Err() != nil {
+						return
+					}
+
+					log.Warn().Msgf("error while subscribing again: %v", err)
+
+					continue
+				}
+
+				disconnected, pinged, stale = false, false, false
+				s.report(StatusReconnected, nil)
 			}
 
-			eventChan <- event
+			continue
 		}
-	}()
 
-	return eventChan
+		// go-redis reconnects and subscribes again by itself, any message means that the connection works
+		pinged = false
+		if disconnected {
+			disconnected = false
+			s.report(StatusReconnected, nil)
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Message:
+			if !s.receive(msg.Payload) {
+				return
+			}
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				s.confirm(msg.Channel)
+			}
+		}
+	}
+}
+
+// add subscribes to the channels of the accounts and waits until Redis confirms the subscription.
+//
+// The confirmation is received by run, because the Redis subscription can't be received from concurrently.
+func (s *redisSubscription) add(ctx context.Context, accountIDs []int) error {
+	channels := accountChannels(accountIDs)
+
+	s.mu.Lock()
+	s.channels = append(s.channels, channels...)
+	confirms := make([]chan struct{}, len(channels))
+	for i, channel := range channels {
+		confirms[i] = make(chan struct{})
+		s.confirms[channel] = confirms[i]
+	}
+	pubsub := s.pubsub
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.redis.timeout)
+	defer cancel()
+
+	err := pubsub.Subscribe(ctx, channels...)
+	for i := 0; err == nil && i < len(confirms); i++ {
+		select {
+		case <-confirms[i]:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if err != nil {
+		// the context might be done already, so the channels are unsubscribed with a new one
+		ctx, cancel := context.WithTimeout(context.Background(), s.redis.timeout)
+		defer cancel()
+
+		s.unsubscribe(ctx, pubsub, channels)
+
+		return err
+	}
+
+	return nil
+}
+
+// remove unsubscribes from the channels of the accounts.
+func (s *redisSubscription) remove(ctx context.Context, accountIDs []int) error {
+	s.mu.Lock()
+	pubsub := s.pubsub
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.redis.timeout)
+	defer cancel()
+
+	return s.unsubscribe(ctx, pubsub, accountChannels(accountIDs))
+}
+
+// unsubscribe removes the channels from the subscription and unsubscribes the Redis subscription from them.
+func (s *redisSubscription) unsubscribe(ctx context.Context, pubsub *redis.PubSub, channels []string) error {
+	removed := map[string]bool{}
+	for _, channel := range channels {
+		removed[channel] = true
+	}
+
+	s.mu.Lock()
+	remaining := make([]string, 0, len(s.channels))
+	for _, channel := range s.channels {
+		if !removed[channel] {
+			remaining = append(remaining, channel)
+		}
+	}
+	s.channels = remaining
+
+	for _, channel := range channels {
+		delete(s.confirms, channel)
+	}
+	s.mu.Unlock()
+
+	// the channels aren't subscribed again after reconnecting even if this fails
+	return pubsub.Unsubscribe(ctx, channels...)
+}
+
+// confirm marks the subscription of the channel as confirmed by Redis.
+func (s *redisSubscription) confirm(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if confirmed, ok := s.confirms[channel]; ok {
+		close(confirmed)
+		delete(s.confirms, channel)
+	}
+}
+
+// resubscribe closes the current Redis subscription and its connection and subscribes to the channels again.
+func (s *redisSubscription) resubscribe() error {
+	s.current().Close()
+
+	s.mu.Lock()
+	channels := append([]string{}, s.channels...)
+	s.mu.Unlock()
+
+	pubsub, err := s.redis.subscribe(s.ctx, channels...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the subscription could have ended while subscribing again
+	if s.closed {
+		pubsub.Close()
+
+		return s.ctx.Err()
+	}
+	s.pubsub = pubsub
+
+	return nil
+}
+
+// current returns the current Redis subscription.
+func (s *redisSubscription) current() *redis.PubSub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pubsub
+}
+
+// close closes the current Redis subscription and its connection.
+func (s *redisSubscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.pubsub.Close()
 }
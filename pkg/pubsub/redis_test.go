@@ -2,6 +2,7 @@
 package pubsub
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -65,29 +66,613 @@ func TestMain(m *testing.M) {
 }
 
 func Test_PubSub(t *testing.T) {
-	eventChan := Bus.Subscribe()
+	sub, err := Bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
 
-	// need to wait a bit for Redis to register the subscription before we can publish or the event is lost
-	time.Sleep(3 * time.Second)
+	// events of other accounts aren't received
+	if err := Bus.Publish(context.Background(), textEvent(2, "other data")); err != nil {
+		fmt.Printf("failed to publish\n: %v", err)
+	}
 
-	err := Bus.Publish(1, "test data")
-	if err != nil {
+	if err := Bus.Publish(context.Background(), textEvent(1, "test data")); err != nil {
 		fmt.Printf("failed to publish\n: %v", err)
 	}
 
 	select {
-	case event := <-eventChan:
+	case event := <-sub.Events():
 		if event == nil {
 			t.Fatalf("expected a published event")
 		}
-		if event.ID != 1 {
-			t.Fatalf("expected %d, got %d", 1, event.ID)
+		if event.AccountID != 1 {
+			t.Fatalf("expected %d, got %d", 1, event.AccountID)
+		}
+		if event.Text() != "test data" {
+			t.Fatalf("expected %s, got %s", "test data", event.Text())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+
+}
+
+func Test_SubscriptionClose(t *testing.T) {
+	sub, err := Bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sub.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out closing the subscription")
+	}
+
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("expected a closed event channel")
+	}
+}
+
+func Test_SubscribeCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Bus.Subscribe(ctx, Replay{}, 1); err == nil {
+		t.Fatalf("Subscribe with a cancelled context should have returned an error")
+	}
+}
+
+func Test_PublishCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Bus.Publish(ctx, textEvent(1, "test data")); err == nil {
+		t.Fatalf("Publish with a cancelled context should have returned an error")
+	}
+}
+
+func Test_Control(t *testing.T) {
+	messages := Bus.SubscribeControl(context.Background())
+
+	// need to wait a bit for Redis to register the subscription before we can publish or the message is lost
+	time.Sleep(3 * time.Second)
+
+	if err := Bus.PublishControl(context.Background(), &ControlMessage{Type: InvalidateAccount, AccountID: 1}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case message := <-messages:
+		if message.Type != InvalidateAccount || message.AccountID != 1 {
+			t.Fatalf("unexpected message %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+}
+
+func Test_Streams(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100}
+
+	// events published before subscribing aren't received
+	if err := streams.Publish(context.Background(), textEvent(11, "old data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	sub, err := streams.Subscribe(context.Background(), Replay{}, 11, 12)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	// unlike publish/subscribe, there's no need to wait before publishing
+	for _, accountID := range []int{11, 13, 12} {
+		if err := streams.Publish(context.Background(), textEvent(accountID, "test data")); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	received := map[int]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-sub.Events():
+			if event.Text() != "test data" {
+				t.Fatalf("expected %s, got %s", "test data", event.Text())
+			}
+			received[event.AccountID]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+
+	if received[11] != 1 || received[12] != 1 {
+		t.Fatalf("expected one event of accounts 11 and 12, got %v", received)
+	}
+
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_StreamsMaxLen(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 10}
+
+	for i := 0; i < 1000; i++ {
+		if err := streams.Publish(context.Background(), textEvent(14, "test data")); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// trimming is approximate, so the stream can be a bit longer than maxLen
+	length, err := streams.client.XLen(context.Background(), accountChannel(14)).Result()
+	if err != nil {
+		t.Fatalf("failed to get stream length: %v", err)
+	}
+
+	if length >= 1000 {
+		t.Fatalf("expected a trimmed stream, got %d entries", length)
+	}
+}
+
+func Test_StreamsGroup(t *testing.T) {
+	first := &Streams{Redis: Bus.(*Redis), maxLen: 100, group: "test", consumer: "first"}
+	second := &Streams{Redis: Bus.(*Redis), maxLen: 100, group: "test", consumer: "second"}
+
+	subscribers := []*Subscription{}
+	for _, streams := range []*Streams{first, second} {
+		sub, err := streams.Subscribe(context.Background(), Replay{}, 15)
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		subscribers = append(subscribers, sub)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := first.Publish(context.Background(), textEvent(15, fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("failed to publish: %v", err)
 		}
-		if event.Data != "test data" {
-			t.Fatalf("expected %s, got %s", "test data", event.Data)
+	}
+
+	// every event is delivered to only one of the group's subscribers
+	received := map[string]int{}
+	for len(received) < 10 {
+		select {
+		case event := <-subscribers[0].Events():
+			received[event.Text()]++
+		case event := <-subscribers[1].Events():
+			received[event.Text()]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, received %v", received)
+		}
+	}
+
+	select {
+	case event := <-subscribers[0].Events():
+		t.Fatalf("unexpected event %+v", event)
+	case event := <-subscribers[1].Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_StreamsPending(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100, group: "test", consumer: "pending"}
+
+	sub, err := streams.Subscribe(context.Background(), Replay{}, 16)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// nobody receives the event before the subscription is closed, so it isn't acknowledged
+	if err := streams.Publish(context.Background(), textEvent(16, "pending data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	sub.Close()
+
+	// the event is delivered again after subscribing with the same consumer
+	sub, err = streams.Subscribe(context.Background(), Replay{}, 16)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	select {
+	case event := <-sub.Events():
+		if event.Text() != "pending data" {
+			t.Fatalf("expected %s, got %s", "pending data", event.Text())
 		}
 	case <-time.After(5 * time.Second):
 		t.Fatalf("timed out")
 	}
+}
+
+func Test_ReplayNotSupported(t *testing.T) {
+	if _, err := Bus.Subscribe(context.Background(), Replay{After: "0-0"}, 1); err != ErrReplayNotSupported {
+		t.Fatalf("expected %v, got %v", ErrReplayNotSupported, err)
+	}
+
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100, group: "test", consumer: "replay"}
+	if _, err := streams.Subscribe(context.Background(), Replay{After: "0-0"}, 1); err != ErrReplayNotSupported {
+		t.Fatalf("expected %v, got %v", ErrReplayNotSupported, err)
+	}
+}
+
+func Test_StreamsReplay(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100}
+
+	if err := streams.Publish(context.Background(), textEvent(17, "before")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+
+	for _, data := range []string{"first", "second"} {
+		if err := streams.Publish(context.Background(), textEvent(17, data)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// events since the time are replayed before the new ones
+	sub, err := streams.Subscribe(context.Background(), Replay{Since: since}, 17)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	if err := streams.Publish(context.Background(), textEvent(17, "live")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
 
+	received := []*Event{}
+	for _, expected := range []string{"first", "second", "live"} {
+		select {
+		case event := <-sub.Events():
+			if event.Text() != expected {
+				t.Fatalf("expected %s, got %s", expected, event.Text())
+			}
+			if event.Cursor == "" {
+				t.Fatalf("expected event cursor")
+			}
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+
+	// events after the cursor are replayed
+	after, err := streams.Subscribe(context.Background(), Replay{After: received[0].Cursor}, 17)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer after.Close()
+
+	for _, expected := range []string{"second", "live"} {
+		select {
+		case event := <-after.Events():
+			if event.Text() != expected {
+				t.Fatalf("expected %s, got %s", expected, event.Text())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out")
+		}
+	}
+
+	if _, err := streams.Subscribe(context.Background(), Replay{After: "not a cursor"}, 17); err == nil {
+		t.Fatalf("Subscribe with an invalid cursor should have returned an error")
+	}
+}
+
+// receiveCursor subscribes to the account, publishes an event and returns the cursor of the received event.
+func receiveCursor(t *testing.T, streams *Streams, accountID int) string {
+	sub, err := streams.Subscribe(context.Background(), Replay{}, accountID)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	if err := streams.Publish(context.Background(), textEvent(accountID, "received")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case event := <-sub.Events():
+		return event.Cursor
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+
+	return ""
+}
+
+func Test_StreamsReplayCursors(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100}
+
+	cursors := map[int]string{22: receiveCursor(t, streams, 22)}
+
+	// the missed event of account 22 is older than the last received event of account 21
+	if err := streams.Publish(context.Background(), textEvent(22, "missed")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	cursors[21] = receiveCursor(t, streams, 21)
+
+	if err := streams.Publish(context.Background(), textEvent(21, "missed")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	// every account resumes after its own cursor
+	sub, err := streams.Subscribe(context.Background(), Replay{Cursors: cursors}, 21, 22)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	missed := map[int]bool{}
+	for len(missed) < 2 {
+		select {
+		case event := <-sub.Events():
+			if event.Text() != "missed" {
+				t.Fatalf("expected %s, got %s", "missed", event.Text())
+			}
+			missed[event.AccountID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, received the missed events of %v", missed)
+		}
+	}
+}
+
+func Test_StreamsSubscriptionCursors(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100}
+
+	sub, err := streams.Subscribe(context.Background(), Replay{}, 61, 62)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// the subscription starts at the current position of every account
+	cursors := sub.Cursors()
+	if len(cursors) != 2 || cursors[61] == "" || cursors[62] == "" {
+		t.Fatalf("expected the cursors of accounts 61 and 62, got %v", cursors)
+	}
+
+	if err := streams.Publish(context.Background(), textEvent(61, "received")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case event := <-sub.Events():
+		cursors[event.AccountID] = event.Cursor
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+	sub.Close()
+
+	// no events of account 62 were received before disconnecting, so only its start cursor resumes it
+	if err := streams.Publish(context.Background(), textEvent(62, "missed")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	sub, err = streams.Subscribe(context.Background(), Replay{Cursors: cursors}, 61, 62)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	select {
+	case event := <-sub.Events():
+		if event.AccountID != 62 || event.Text() != "missed" {
+			t.Fatalf("expected the missed event of account 62, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+
+	// buses that don't store the events have no cursors
+	memory := &Memory{}
+	memorySub, err := memory.Subscribe(context.Background(), Replay{}, 61, 62)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer memorySub.Close()
+
+	if cursors := memorySub.Cursors(); cursors != nil {
+		t.Fatalf("expected no cursors, got %v", cursors)
+	}
+}
+
+func Test_SubscriptionStatus(t *testing.T) {
+	sub, err := Bus.Subscribe(context.Background(), Replay{}, 18)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	// payloads that can't be deserialized are reported instead of being sent as events
+	if err := Bus.(*Redis).client.Publish(context.Background(), accountChannel(18), "not an event").Err(); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case status := <-sub.Status():
+		if status.Type != StatusError {
+			t.Fatalf("expected %s, got %s", StatusError, status.Type)
+		}
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+}
+
+// expectStatus waits for the status change of the subscription.
+func expectStatus(t *testing.T, sub *Subscription, statusType string) {
+	select {
+	case status := <-sub.Status():
+		if status.Type != statusType {
+			t.Fatalf("expected %s, got %s", statusType, status.Type)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s status", statusType)
+	}
+}
+
+// expectEvent publishes an event and waits until the subscription receives it.
+func expectEvent(t *testing.T, sub *Subscription, accountID int) {
+	if err := Bus.Publish(context.Background(), textEvent(accountID, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case event := <-sub.Events():
+		if event.AccountID != accountID {
+			t.Fatalf("expected %d, got %d", accountID, event.AccountID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+}
+
+func Test_SubscriptionReconnect(t *testing.T) {
+	sub, err := Bus.Subscribe(context.Background(), Replay{}, 19)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	// closing the connection from the server reports the disconnect until the subscription is subscribed again
+	if err := Bus.(*Redis).client.ClientKillByFilter(context.Background(), "TYPE", "pubsub").Err(); err != nil {
+		t.Fatalf("failed to kill the connection: %v", err)
+	}
+
+	expectStatus(t, sub, StatusDisconnected)
+	expectStatus(t, sub, StatusReconnected)
+	expectEvent(t, sub, 19)
+}
+
+func Test_SubscriptionUnansweredPing(t *testing.T) {
+	r := &Redis{
+		client:      Bus.(*Redis).client,
+		timeout:     5 * time.Second,
+		healthCheck: 100 * time.Millisecond,
+	}
+
+	sub, err := r.Subscribe(context.Background(), Replay{}, 20)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	// paused Redis doesn't answer the ping, like a half-open connection, so the subscription subscribes again
+	if err := r.client.Do(context.Background(), "CLIENT", "PAUSE", 1500).Err(); err != nil {
+		t.Fatalf("failed to pause the clients: %v", err)
+	}
+
+	expectStatus(t, sub, StatusDisconnected)
+	expectStatus(t, sub, StatusReconnected)
+	expectEvent(t, sub, 20)
+}
+
+func Test_ControlUnansweredPing(t *testing.T) {
+	r := &Redis{
+		client:      Bus.(*Redis).client,
+		timeout:     5 * time.Second,
+		healthCheck: 100 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := r.SubscribeControl(ctx)
+
+	// paused Redis doesn't answer the ping, like a half-open connection, so the control subscription subscribes again
+	if err := r.client.Do(context.Background(), "CLIENT", "PAUSE", 1500).Err(); err != nil {
+		t.Fatalf("failed to pause the clients: %v", err)
+	}
+
+	// need to wait a bit for the subscription to reconnect before we can publish or the message is lost
+	time.Sleep(4 * time.Second)
+
+	if err := r.PublishControl(context.Background(), &ControlMessage{Type: InvalidateAPIKey, APIKeyID: 2}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case message := <-messages:
+		if message.Type != InvalidateAPIKey || message.APIKeyID != 2 {
+			t.Fatalf("unexpected message %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+
+	// the channel is closed when the context is cancelled
+	cancel()
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatalf("expected the channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out")
+	}
+}
+
+func Test_SubscriptionAddRemove(t *testing.T) {
+	streams := &Streams{Redis: Bus.(*Redis), maxLen: 100}
+
+	for _, bus := range []PubSub{Bus, streams} {
+		sub, err := bus.Subscribe(context.Background(), Replay{}, 21)
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		// the events published after Add returns are received
+		if err := sub.Add(context.Background(), 22); err != nil {
+			t.Fatalf("failed to add account: %v", err)
+		}
+
+		if err := sub.Remove(context.Background(), 21); err != nil {
+			t.Fatalf("failed to remove account: %v", err)
+		}
+
+		for _, accountID := range []int{21, 22} {
+			if err := bus.Publish(context.Background(), textEvent(accountID, "test data")); err != nil {
+				t.Fatalf("failed to publish: %v", err)
+			}
+		}
+
+		select {
+		case event := <-sub.Events():
+			if event.AccountID != 22 {
+				t.Fatalf("expected %d, got %d", 22, event.AccountID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out")
+		}
+
+		select {
+		case event := <-sub.Events():
+			t.Fatalf("unexpected event %+v", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		sub.Close()
+	}
 }
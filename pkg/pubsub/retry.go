@@ -0,0 +1,78 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"celtra-programming-assigment/pkg/env"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+)
+
+// default configuration of the retries
+const (
+	defaultRetryInterval   = 100 * time.Millisecond
+	defaultRetryMaxElapsed = 5 * time.Second
+)
+
+// Retrying wraps a PubSub and retries publishing events with an exponential backoff.
+//
+// All the other methods are passed on to the wrapped PubSub.
+type Retrying struct {
+	PubSub
+
+	interval   time.Duration // interval before the first retry
+	maxElapsed time.Duration // time after which publishing is given up
+}
+
+// NewRetrying wraps the messaging bus with retries.
+//
+// Interval before the first retry and time after which the publishing is given up can be set
+// with RETRY_INTERVAL and RETRY_MAX_ELAPSED (e.g. 10s) environment variables.
+// Only the publish queue retries, so synchronous publishing doesn't block a request for RETRY_MAX_ELAPSED.
+func NewRetrying(bus PubSub) (*Retrying, error) {
+	interval, err := env.Duration("RETRY_INTERVAL", defaultRetryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	maxElapsed, err := env.Duration("RETRY_MAX_ELAPSED", defaultRetryMaxElapsed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Retrying{
+		PubSub:     bus,
+		interval:   interval,
+		maxElapsed: maxElapsed,
+	}, nil
+}
+
+// Publish publishes the event and retries until it succeeds, the retries take longer than the maximum elapsed time
+// or the context is done.
+//
+// Invalid events aren't retried and return ErrInvalidEvent.
+func (r *Retrying) Publish(ctx context.Context, event *Event) error {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = r.interval
+	b.MaxElapsedTime = r.maxElapsed
+
+	attempts := 0
+	err := backoff.Retry(func() error {
+		attempts++
+
+		err := r.PubSub.Publish(ctx, event)
+		if errors.Is(err, ErrInvalidEvent) {
+			return backoff.Permanent(err)
+		}
+
+		return err
+	}, backoff.WithContext(b, ctx))
+	if err != nil {
+		return fmt.Errorf("publishing failed after %d attempts: %w", attempts, err)
+	}
+
+	return nil
+}
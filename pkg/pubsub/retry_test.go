@@ -0,0 +1,108 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyBus is a PubSub that fails publishing the given number of times.
+type flakyBus struct {
+	Memory
+	failures int32
+	attempts int32
+}
+
+func (b *flakyBus) Publish(ctx context.Context, event *Event) error {
+	if atomic.AddInt32(&b.attempts, 1) <= b.failures {
+		return errors.New("bus is down")
+	}
+
+	return b.Memory.Publish(ctx, event)
+}
+
+func Test_Retrying(t *testing.T) {
+	bus := &flakyBus{failures: 2}
+	retrying := &Retrying{PubSub: bus, interval: time.Millisecond, maxElapsed: time.Second}
+
+	if err := retrying.Publish(context.Background(), textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	if bus.attempts != 3 {
+		t.Fatalf("expected %d but got %d", 3, bus.attempts)
+	}
+}
+
+func Test_RetryingGivesUp(t *testing.T) {
+	bus := &flakyBus{failures: 1000}
+	retrying := &Retrying{PubSub: bus, interval: time.Millisecond, maxElapsed: 20 * time.Millisecond}
+
+	if err := retrying.Publish(context.Background(), textEvent(1, "test data")); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if bus.attempts < 2 {
+		t.Fatalf("expected at least %d attempts but got %d", 2, bus.attempts)
+	}
+
+	// retries stop when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	retrying.maxElapsed = time.Hour
+	atomic.StoreInt32(&bus.attempts, 0)
+	if err := retrying.Publish(ctx, textEvent(1, "test data")); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if bus.attempts != 1 {
+		t.Fatalf("expected %d but got %d", 1, bus.attempts)
+	}
+}
+
+func Test_RetryingInvalidEvent(t *testing.T) {
+	bus := &flakyBus{}
+	retrying := &Retrying{PubSub: bus, interval: time.Millisecond, maxElapsed: time.Second}
+
+	event := textEvent(1, "test data")
+	event.Data = []byte("{")
+
+	if err := retrying.Publish(context.Background(), event); !errors.Is(err, ErrInvalidEvent) {
+		t.Fatalf("expected %v, got %v", ErrInvalidEvent, err)
+	}
+
+	// the bus rejects the invalid event, so it isn't retried
+	if bus.attempts != 1 {
+		t.Fatalf("expected %d but got %d", 1, bus.attempts)
+	}
+}
+
+func Test_PublisherDeadLetter(t *testing.T) {
+	bus := &failingBus{down: 1}
+	p := NewPublisher(bus, 1, 10, nil)
+
+	deadLetters := make(chan *Event, 1)
+	p.OnDeadLetter = func(event *Event, err error) {
+		deadLetters <- event
+	}
+
+	event := textEvent(1, "test data")
+	if err := p.Publish(event); err != nil {
+		t.Fatalf("failed to queue event: %v", err)
+	}
+
+	p.Close()
+
+	select {
+	case deadLetter := <-deadLetters:
+		if deadLetter.ID != event.ID {
+			t.Fatalf("expected %s but got %s", event.ID, deadLetter.ID)
+		}
+	default:
+		t.Fatalf("event was not dead-lettered")
+	}
+}
@@ -0,0 +1,430 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// default configuration of the spool
+const (
+	defaultSpoolSegmentSize = 4 << 20   // 4 MiB
+	defaultSpoolMaxSize     = 256 << 20 // 256 MiB
+
+	spoolSegmentExt = ".seg"
+)
+
+// ErrSpoolFull is returned when the event can't be spooled because the spool reached its maximum size.
+var ErrSpoolFull = errors.New("spool is full")
+
+// Spool is a write-ahead log on local disk for events that couldn't be published.
+//
+// Events are appended to segment files, one JSON encoded event per line, and are read back in the same order.
+// A segment is deleted when all of its events were read and removed.
+type Spool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu       sync.Mutex
+	segments []uint64 // sequence numbers of the segments on disk, the last one is written to
+	writer   *os.File
+	written  int64 // size of the segment that is written to
+	reader   *os.File
+	buffer   *bufio.Reader
+	head     *Event // event that was read, but not removed yet
+	headSize int64  // size of the head event in the segment
+	offset   int64  // size of the removed events in the first segment
+	size     int64  // size of all the segments on disk
+	pending  int64  // number of events waiting in the spool
+	spooled  int64  // number of events appended since the spool was opened
+
+	notify chan struct{} // signals that an event was appended
+}
+
+// OpenSpool opens the spool in the directory and creates it if it doesn't exist.
+//
+// Events left in the directory by a previous spool are read first. A new segment is started when
+// the current one reaches segmentSize bytes and events are rejected when all segments reach maxSize bytes.
+func OpenSpool(dir string, segmentSize int64, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		notify:      make(chan struct{}, 1),
+	}
+
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), spoolSegmentExt), 10, 64)
+		if err != nil {
+			log.Warn().Msgf("ignoring unknown file in spool directory: %s", file)
+
+			continue
+		}
+
+		size, lines, err := countLines(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading spool segment: %v", err)
+		}
+
+		s.segments = append(s.segments, seq)
+		s.size += size
+		s.pending += lines
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	return s, nil
+}
+
+// Append writes the event to the end of the spool.
+//
+// The segment is synced to disk before Append returns, so a spooled event survives a crash of the service
+// or of the machine. Spooling is only used while the messaging bus is unavailable, so the sync doesn't slow
+// down the ingestion otherwise.
+func (s *Spool) Append(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(line)) > s.maxSize {
+		return ErrSpoolFull
+	}
+
+	if s.writer == nil || s.written >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	s.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing to spool: %v", err)
+	}
+
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("syncing spool: %v", err)
+	}
+
+	s.pending++
+	s.spooled++
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Next returns the first event in the spool without removing it, or nil if the spool is empty.
+func (s *Spool) Next() (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.head == nil {
+		if len(s.segments) == 0 {
+			return nil, nil
+		}
+
+		if s.reader == nil {
+			reader, err := os.Open(s.path(s.segments[0]))
+			if err != nil {
+				return nil, fmt.Errorf("opening spool segment: %v", err)
+			}
+
+			s.reader = reader
+			s.buffer = bufio.NewReader(reader)
+		}
+
+		line, err := s.buffer.ReadBytes('\n')
+		if err == io.EOF {
+			// lines are written whole while holding the lock, so only a crash can leave an incomplete line
+			if len(line) > 0 {
+				log.Error().Msgf("skipping incomplete event at the end of spool segment %d", s.segments[0])
+			}
+
+			if err := s.dropSegment(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading spool segment: %v", err)
+		}
+
+		event := &Event{}
+		if err := json.Unmarshal(line, event); err != nil {
+			log.Error().Msgf("skipping invalid event in spool segment %d: %v", s.segments[0], err)
+			s.pending--
+			s.offset += int64(len(line))
+
+			continue
+		}
+
+		s.head = event
+		s.headSize = int64(len(line))
+	}
+
+	return s.head, nil
+}
+
+// Remove removes the event returned by Next from the spool.
+func (s *Spool) Remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.head == nil {
+		return
+	}
+
+	s.head = nil
+	s.pending--
+	s.offset += s.headSize
+
+	// delete the segment right away if this was its last event, so it isn't read again after reopening
+	if _, err := s.buffer.Peek(1); err == io.EOF {
+		if err := s.dropSegment(); err != nil {
+			log.Error().Msgf("%v", err)
+		}
+	}
+}
+
+// Pending returns the number of events waiting in the spool.
+func (s *Spool) Pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending
+}
+
+// Spooled returns the number of events appended since the spool was opened.
+func (s *Spool) Spooled() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.spooled
+}
+
+// Appended returns a channel that receives a signal when an event is appended.
+func (s *Spool) Appended() <-chan struct{} {
+	return s.notify
+}
+
+// Close closes the segment files, events that weren't removed stay on disk.
+//
+// Removed events are only deleted from disk when their segment is deleted or when the spool is closed,
+// so events of a partially read segment are published again if the service crashes.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.writer != nil {
+		err = s.writer.Close()
+		s.writer = nil
+	}
+
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+		s.buffer = nil
+		s.head = nil
+
+		if s.offset > 0 {
+			if trimErr := s.trimSegment(); trimErr != nil && err == nil {
+				err = trimErr
+			}
+		}
+	}
+
+	return err
+}
+
+// rotate closes the segment that is written to and starts a new one.
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			return fmt.Errorf("closing spool segment: %v", err)
+		}
+		s.writer = nil
+	}
+
+	seq := uint64(1)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+
+	writer, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("creating spool segment: %v", err)
+	}
+
+	// the new segment is only found after a crash if its directory entry is synced as well
+	if err := syncDir(s.dir); err != nil {
+		writer.Close()
+
+		return fmt.Errorf("creating spool segment: %v", err)
+	}
+
+	s.segments = append(s.segments, seq)
+	s.writer = writer
+	s.written = 0
+
+	return nil
+}
+
+// dropSegment deletes the first segment after all of its events were read,
+// if it is also the segment that is written to, the next event starts a new one.
+func (s *Spool) dropSegment() error {
+	path := s.path(s.segments[0])
+
+	s.reader.Close()
+	s.reader = nil
+	s.buffer = nil
+
+	if len(s.segments) == 1 && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("deleting spool segment: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("deleting spool segment: %v", err)
+	}
+
+	s.size -= info.Size()
+	s.segments = s.segments[1:]
+	s.offset = 0
+
+	return nil
+}
+
+// trimSegment deletes the removed events from the first segment.
+//
+// The remaining events are copied to a new file, which is synced before it replaces the segment.
+func (s *Spool) trimSegment() error {
+	path := s.path(s.segments[0])
+
+	if err := copyFrom(path, path+".tmp", s.offset); err != nil {
+		return fmt.Errorf("trimming spool segment: %v", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("trimming spool segment: %v", err)
+	}
+
+	if err := syncDir(s.dir); err != nil {
+		return fmt.Errorf("trimming spool segment: %v", err)
+	}
+
+	s.size -= s.offset
+	s.offset = 0
+
+	return nil
+}
+
+// path returns the path of the segment file.
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", seq, spoolSegmentExt))
+}
+
+// countLines returns the size of the file and the number of lines in it without reading the whole file into memory.
+func countLines(path string) (int64, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var size, lines int64
+	buffer := make([]byte, 32<<10)
+	for {
+		n, err := file.Read(buffer)
+		size += int64(n)
+		lines += int64(bytes.Count(buffer[:n], []byte{'\n'}))
+
+		if err == io.EOF {
+			return size, lines, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// copyFrom copies the file from the offset to a new file and syncs it to disk.
+func copyFrom(path string, newPath string, offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(newPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+
+		return err
+	}
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+
+		return err
+	}
+
+	return dst.Close()
+}
+
+// syncDir syncs the directory, so the files created, renamed or deleted in it are kept after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,211 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingBus is a PubSub that fails publishing while it is down.
+type failingBus struct {
+	Memory
+	down int32
+}
+
+func (b *failingBus) Publish(ctx context.Context, event *Event) error {
+	if atomic.LoadInt32(&b.down) == 1 {
+		return errors.New("bus is down")
+	}
+
+	return b.Memory.Publish(ctx, event)
+}
+
+func Test_Spool(t *testing.T) {
+	dir := t.TempDir()
+
+	// a new segment is started after the second event
+	spool, err := OpenSpool(dir, 200, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+
+	for _, text := range []string{"first", "second", "third"} {
+		if err := spool.Append(textEvent(1, text)); err != nil {
+			t.Fatalf("failed to spool event: %v", err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read spool directory: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected %d but got %d", 2, len(files))
+	}
+
+	event, err := spool.Next()
+	if err != nil {
+		t.Fatalf("failed to read spooled event: %v", err)
+	}
+	if event.Text() != "first" {
+		t.Fatalf("expected %s but got %s", "first", event.Text())
+	}
+	spool.Remove()
+
+	if err := spool.Close(); err != nil {
+		t.Fatalf("failed to close spool: %v", err)
+	}
+
+	// events that weren't removed are read after reopening
+	spool, err = OpenSpool(dir, 200, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	defer spool.Close()
+
+	if pending := spool.Pending(); pending != 2 {
+		t.Fatalf("expected %d but got %d", 2, pending)
+	}
+
+	if err := spool.Append(textEvent(1, "fourth")); err != nil {
+		t.Fatalf("failed to spool event: %v", err)
+	}
+
+	for _, text := range []string{"second", "third", "fourth"} {
+		event, err := spool.Next()
+		if err != nil {
+			t.Fatalf("failed to read spooled event: %v", err)
+		}
+		if event == nil || event.Text() != text {
+			t.Fatalf("expected %s but got %v", text, event)
+		}
+		spool.Remove()
+	}
+
+	if event, err := spool.Next(); event != nil || err != nil {
+		t.Fatalf("expected empty spool but got %v, %v", event, err)
+	}
+
+	// drained segments are deleted
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read spool directory: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected %d but got %d", 0, len(files))
+	}
+}
+
+func Test_SpoolReopenLargeSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+
+	// the segment is larger than the buffer used to count its events
+	for i := 0; i < 1000; i++ {
+		if err := spool.Append(textEvent(1, "test data")); err != nil {
+			t.Fatalf("failed to spool event: %v", err)
+		}
+	}
+
+	if err := spool.Close(); err != nil {
+		t.Fatalf("failed to close spool: %v", err)
+	}
+
+	spool, err = OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	defer spool.Close()
+
+	if pending := spool.Pending(); pending != 1000 {
+		t.Fatalf("expected %d but got %d", 1000, pending)
+	}
+}
+
+func Test_SpoolFull(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20, 300)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	defer spool.Close()
+
+	if err := spool.Append(textEvent(1, "test data")); err != nil {
+		t.Fatalf("failed to spool event: %v", err)
+	}
+
+	if err := spool.Append(textEvent(1, "test data")); err != ErrSpoolFull {
+		t.Fatalf("expected %v, got %v", ErrSpoolFull, err)
+	}
+
+	if spooled := spool.Spooled(); spooled != 1 {
+		t.Fatalf("expected %d but got %d", 1, spooled)
+	}
+}
+
+func Test_PublisherSpool(t *testing.T) {
+	bus := &failingBus{down: 1}
+
+	sub, err := bus.Subscribe(context.Background(), Replay{}, 1)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+
+	p := NewPublisher(bus, 1, 10, spool)
+	defer p.Close()
+
+	texts := []string{"first", "second", "third", "fourth", "fifth"}
+	for _, text := range texts {
+		if err := p.Publish(textEvent(1, text)); err != nil {
+			t.Fatalf("failed to queue event: %v", err)
+		}
+	}
+
+	// wait until all the events are spooled
+	for deadline := time.Now().Add(time.Second); p.Stats().Spooled < int64(len(texts)); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	atomic.StoreInt32(&bus.down, 0)
+
+	// events are drained in order once the bus is available again
+	for _, text := range texts {
+		select {
+		case event := <-sub.Events():
+			if event.Text() != text {
+				t.Fatalf("expected %s but got %s", text, event.Text())
+			}
+		case <-time.After(3 * spoolRetryDelay):
+			t.Fatalf("timed out")
+		}
+	}
+
+	// the last event is removed from the spool after it was published
+	for deadline := time.Now().Add(time.Second); p.Stats().SpoolDepth > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := p.Stats()
+	if stats.Spooled != int64(len(texts)) || stats.SpoolDepth != 0 || stats.Failed != 0 {
+		t.Fatalf("queue stats, expected {Spooled:5 SpoolDepth:0 Failed:0}, was %+v", stats)
+	}
+}
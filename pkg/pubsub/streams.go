@@ -0,0 +1,440 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"celtra-programming-assigment/pkg/env"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+)
+
+// default configuration of the Redis Streams
+const (
+	defaultStreamMaxLen = 10000
+	streamField         = "event"     // field of the stream entry that holds the serialized event
+	streamCount         = 100         // maximum number of entries read at once
+	streamBlock         = time.Second // how long a read waits for new entries before checking if the subscription was closed
+	streamRetry         = time.Second // how long to wait before reading again after an error
+)
+
+// Streams struct is an implementation of PubSub interface that publishes the events to Redis Streams,
+// so that subscribers which lose the connection resume where they stopped instead of missing events.
+//
+// Every account has its own "events:ACCOUNT_ID" stream, trimmed to approximately maxLen entries.
+// Without a consumer group, every subscription receives all events published after it was created.
+// Subscriptions in a consumer group share the events, each event is delivered to one of them and acknowledged
+// once it is received. Events that weren't acknowledged are delivered again when the consumer subscribes again.
+//
+// Control messages aren't stored, they are exchanged with Redis publish/subscribe.
+type Streams struct {
+	*Redis
+	maxLen   int64  // STREAM_MAX_LEN
+	group    string // STREAM_GROUP
+	consumer string // STREAM_CONSUMER
+}
+
+// NewStreams creates a new PubSub client that uses Redis Streams for publishing and subscribing to events.
+//
+// Maximum length of the streams can be set with STREAM_MAX_LEN environment variable. Subscriptions join
+// the STREAM_GROUP consumer group if it is set, using STREAM_CONSUMER (hostname by default) as the consumer name.
+func NewStreams() error {
+	maxLen, err := env.Int("STREAM_MAX_LEN", defaultStreamMaxLen)
+	if err != nil {
+		return err
+	}
+
+	consumer := os.Getenv("STREAM_CONSUMER")
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+
+	r, err := newRedis()
+	if err != nil {
+		return err
+	}
+
+	Bus = &Streams{
+		Redis:    r,
+		maxLen:   int64(maxLen),
+		group:    os.Getenv("STREAM_GROUP"),
+		consumer: consumer,
+	}
+
+	return nil
+}
+
+// Publish appends the event to the stream of its account.
+func (s *Streams) Publish(ctx context.Context, event *Event) error {
+	eventData, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream:       accountChannel(event.AccountID),
+		MaxLenApprox: s.maxLen,
+		Values:       map[string]interface{}{streamField: string(eventData)},
+	}).Err()
+}
+
+// Subscribe is used to subscribe to one or multiple accounts.
+//
+// Without a consumer group, the subscription receives the events published after Subscribe returns,
+// or the stored events since the replay point first. The Cursor of the received events is the stream entry ID
+// and the Cursors of the subscription are the entry IDs every account's stream starts after.
+// In a consumer group, it first receives the events that were delivered to this consumer but never acknowledged.
+// Events can't be replayed in a consumer group, because its position is shared by all its consumers.
+// If reading fails, e.g. because Redis restarted, the subscription reports it on the Status channel,
+// keeps retrying and resumes after the last received event.
+//
+// Returns a Subscription where you can receive those events.
+func (s *Streams) Subscribe(ctx context.Context, replay Replay, accountIDs ...int) (*Subscription, error) {
+	streams := accountChannels(accountIDs)
+
+	var (
+		ids map[string]string
+		err error
+	)
+	switch {
+	case s.group != "" && !replay.IsZero():
+		return nil, ErrReplayNotSupported
+	case s.group != "":
+		ids, err = s.createGroups(ctx, streams)
+	case replay.IsZero():
+		ids, err = s.lastIDs(ctx, streams)
+	default:
+		ids, err = s.replayIDs(ctx, replay, accountIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &streamsSubscription{
+		Subscription: newSubscription(ctx, accountIDs),
+		bus:          s,
+		streams:      streams,
+		ids:          ids,
+	}
+	sub.Subscription.add = sub.add
+	sub.Subscription.remove = sub.remove
+
+	// positions in a consumer group are shared by all its consumers, so they can't be resumed
+	if s.group == "" {
+		sub.Subscription.cursors = make(map[int]string, len(accountIDs))
+		for _, accountID := range accountIDs {
+			sub.Subscription.cursors[accountID] = ids[accountChannel(accountID)]
+		}
+	}
+
+	go sub.run()
+
+	return sub.Subscription, nil
+}
+
+// streamsSubscription reads the events of the subscribed streams until the subscription ends.
+type streamsSubscription struct {
+	*Subscription
+	bus *Streams
+
+	mu      sync.Mutex // guards the streams and their IDs, which change when accounts are added or removed
+	streams []string
+	ids     map[string]string // position of every stream, ">" if only new events are read in a consumer group
+}
+
+// run reads the streams until the subscription ends.
+func (s *streamsSubscription) run() {
+	defer s.finish()
+
+	disconnected := false
+	for {
+		streams, ids := s.positions()
+
+		result, err := s.bus.read(s.ctx, streams, ids)
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil && err != redis.Nil {
+			// the error is only logged once, not on every retry
+			if !disconnected {
+				log.Warn().Msgf("error while reading streams, retrying: %v", err)
+
+				disconnected = true
+				s.report(StatusDisconnected, err)
+			}
+
+			select {
+			case <-time.After(streamRetry):
+			case <-s.ctx.Done():
+				return
+			}
+
+			if s.bus.group != "" {
+				// the group is gone if Redis restarted without persistence, pending events are read again otherwise
+				pending, err := s.bus.createGroups(s.ctx, streams)
+				if err != nil {
+					log.Warn().Msgf("error while creating consumer groups: %v", err)
+
+					continue
+				}
+
+				for stream, ID := range pending {
+					s.advance(stream, ID)
+				}
+			}
+
+			continue
+		}
+
+		if disconnected {
+			disconnected = false
+			s.report(StatusReconnected, nil)
+		}
+
+		for _, stream := range result {
+			if s.bus.group != "" && ids[stream.Stream] != ">" && len(stream.Messages) == 0 {
+				// all pending events were received, continue with the new ones
+				s.advance(stream.Stream, ">")
+			}
+
+			for _, msg := range stream.Messages {
+				payload, _ := msg.Values[streamField].(string)
+				if !s.deliver([]byte(payload), msg.ID) {
+					return
+				}
+
+				if s.bus.group != "" {
+					s.bus.ack(stream.Stream, msg.ID)
+				}
+
+				if ids[stream.Stream] != ">" {
+					s.advance(stream.Stream, msg.ID)
+				}
+			}
+		}
+	}
+}
+
+// add starts reading the streams of the accounts after their last entry, or joins the consumer group on them.
+//
+// Reading the streams that were subscribed before isn't interrupted, so the new streams are read
+// after streamBlock at the latest, but the events published after add returns aren't missed.
+func (s *streamsSubscription) add(ctx context.Context, accountIDs []int) error {
+	streams := accountChannels(accountIDs)
+
+	var (
+		ids map[string]string
+		err error
+	)
+	if s.bus.group != "" {
+		ids, err = s.bus.createGroups(ctx, streams)
+	} else {
+		ids, err = s.bus.lastIDs(ctx, streams)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams = append(s.streams, streams...)
+	for stream, ID := range ids {
+		s.ids[stream] = ID
+	}
+
+	return nil
+}
+
+// remove stops reading the streams of the accounts.
+func (s *streamsSubscription) remove(ctx context.Context, accountIDs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stream := range accountChannels(accountIDs) {
+		delete(s.ids, stream)
+	}
+
+	remaining := make([]string, 0, len(s.ids))
+	for _, stream := range s.streams {
+		if _, ok := s.ids[stream]; ok {
+			remaining = append(remaining, stream)
+		}
+	}
+	s.streams = remaining
+
+	return nil
+}
+
+// positions returns a copy of the streams and their IDs for the next read.
+func (s *streamsSubscription) positions() ([]string, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[string]string, len(s.ids))
+	for stream, ID := range s.ids {
+		ids[stream] = ID
+	}
+
+	return append([]string{}, s.streams...), ids
+}
+
+// advance sets the position of the stream, unless it was removed meanwhile.
+func (s *streamsSubscription) advance(stream string, ID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[stream]; ok {
+		s.ids[stream] = ID
+	}
+}
+
+// read reads the entries after the IDs of the streams, waiting for streamBlock if there aren't any.
+func (s *Streams) read(ctx context.Context, streams []string, ids map[string]string) ([]redis.XStream, error) {
+	args := make([]string, 0, len(streams)*2)
+	args = append(args, streams...)
+	for _, stream := range streams {
+		args = append(args, ids[stream])
+	}
+
+	if s.group == "" {
+		return s.client.XRead(ctx, &redis.XReadArgs{
+			Streams: args,
+			Count:   streamCount,
+			Block:   streamBlock,
+		}).Result()
+	}
+
+	return s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.group,
+		Consumer: s.consumer,
+		Streams:  args,
+		Count:    streamCount,
+		Block:    streamBlock,
+	}).Result()
+}
+
+// ack acknowledges that the event was received, so it isn't delivered to the group again.
+func (s *Streams) ack(stream string, ID string) {
+	// the event was already received, so it should be acknowledged even if the subscription was closed meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if err := s.client.XAck(ctx, stream, s.group, ID).Err(); err != nil {
+		log.Warn().Msgf("error while acknowledging event %s on %s stream: %v", ID, stream, err)
+	}
+}
+
+// lastIDs returns the ID of the last entry of each stream, so that only newer entries are read.
+func (s *Streams) lastIDs(ctx context.Context, streams []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	ids := map[string]string{}
+	for _, stream := range streams {
+		messages, err := s.client.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		ids[stream] = "0-0"
+		if len(messages) > 0 {
+			ids[stream] = messages[0].ID
+		}
+	}
+
+	return ids, nil
+}
+
+// replayIDs returns the IDs after which the replayed entries of each account's stream start.
+//
+// Accounts with a cursor in replay.Cursors resume after it. Entry IDs start with the time when the entry was added
+// in milliseconds, so the other accounts start after the After cursor or at Since, which is the same ID for all
+// streams, or only receive the new entries if neither is set.
+func (s *Streams) replayIDs(ctx context.Context, replay Replay, accountIDs []int) (map[string]string, error) {
+	start := replay.After
+	switch {
+	case start != "" && !validStreamID(start):
+		return nil, fmt.Errorf("invalid event cursor: %s", start)
+	case start == "" && !replay.Since.IsZero():
+		// entries are read after the ID, so start with the last possible ID of the previous millisecond
+		start = "0-0"
+		if ms := replay.Since.UnixNano() / int64(time.Millisecond); ms > 0 {
+			start = fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64))
+		}
+	}
+
+	ids := map[string]string{}
+	latest := []string{}
+	for _, accountID := range accountIDs {
+		stream := accountChannel(accountID)
+
+		if cursor, ok := replay.Cursors[accountID]; ok {
+			if !validStreamID(cursor) {
+				return nil, fmt.Errorf("invalid event cursor of account %d: %s", accountID, cursor)
+			}
+
+			ids[stream] = cursor
+		} else if start != "" {
+			ids[stream] = start
+		} else {
+			latest = append(latest, stream)
+		}
+	}
+
+	if len(latest) > 0 {
+		lastIDs, err := s.lastIDs(ctx, latest)
+		if err != nil {
+			return nil, err
+		}
+
+		for stream, ID := range lastIDs {
+			ids[stream] = ID
+		}
+	}
+
+	return ids, nil
+}
+
+// validStreamID checks if the ID is a valid stream entry ID (MILLISECONDS or MILLISECONDS-SEQUENCE).
+func validStreamID(ID string) bool {
+	for _, part := range strings.SplitN(ID, "-", 2) {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// createGroups creates the consumer group on the streams if it doesn't exist yet.
+//
+// Returns the IDs for reading the consumer's pending events of each stream first.
+func (s *Streams) createGroups(ctx context.Context, streams []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	ids := map[string]string{}
+	for _, stream := range streams {
+		// a new group only receives the events published after it was created
+		err := s.client.XGroupCreateMkStream(ctx, stream, s.group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+
+		ids[stream] = "0"
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,246 @@
+// Package pubsub contains code for publishing or subscribing data.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// statusBuffer is the number of status changes that can wait in the Status channel before new ones are dropped.
+const statusBuffer = 10
+
+// types of the subscription status changes
+const (
+	StatusError        = "error"        // an event couldn't be deserialized and was skipped
+	StatusDisconnected = "disconnected" // connection to the messaging bus was lost, the subscription is reconnecting
+	StatusReconnected  = "reconnected"  // connection to the messaging bus was established again
+)
+
+// ErrNoAccounts is returned when all the accounts would be removed from a subscription.
+var ErrNoAccounts = errors.New("subscription needs at least one account")
+
+// Status struct describes a change of the subscription's health.
+type Status struct {
+	Type      string
+	Timestamp time.Time
+	Err       error // cause of the error or disconnect
+}
+
+// Subscription struct represents an active subscription to the events of one or multiple accounts.
+//
+// Accounts can be added or removed while the subscription is active.
+// The subscription ends when Close is called or when the context used to create it is cancelled.
+// After that, its resources are released and the Events and Status channels are closed.
+type Subscription struct {
+	events chan *Event
+	status chan *Status
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// add and remove change the accounts of the messaging bus subscription
+	add    func(ctx context.Context, accountIDs []int) error
+	remove func(ctx context.Context, accountIDs []int) error
+
+	changes  sync.Mutex // serializes Add and Remove
+	mu       sync.Mutex // guards accounts
+	accounts map[int]struct{}
+
+	cursors map[int]string // position of every account's events when the subscription started, if they are stored
+}
+
+// newSubscription creates a new Subscription of the accounts that ends when the context is cancelled.
+func newSubscription(ctx context.Context, accountIDs []int) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+
+	accounts := make(map[int]struct{}, len(accountIDs))
+	for _, accountID := range accountIDs {
+		accounts[accountID] = struct{}{}
+	}
+
+	return &Subscription{
+		events:   make(chan *Event),
+		status:   make(chan *Status, statusBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		accounts: accounts,
+	}
+}
+
+// Events returns a channel where you can receive the events. It is closed when the subscription ends.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Status returns a channel where you can receive the changes of the subscription's health.
+// It is closed when the subscription ends.
+//
+// Status changes are dropped if they aren't received, so the subscription isn't blocked if nobody reads them.
+func (s *Subscription) Status() <-chan *Status {
+	return s.status
+}
+
+// Cursors returns the position of every account's events after which the subscription started receiving them,
+// or nil if the messaging bus doesn't store the events.
+//
+// Resuming with these cursors, updated with the cursors of the received events, doesn't miss the events
+// of the accounts that no events were received of yet.
+func (s *Subscription) Cursors() map[int]string {
+	if s.cursors == nil {
+		return nil
+	}
+
+	cursors := make(map[int]string, len(s.cursors))
+	for accountID, cursor := range s.cursors {
+		cursors[accountID] = cursor
+	}
+
+	return cursors
+}
+
+// Add subscribes to the events of the accounts, accounts that are already subscribed are skipped.
+//
+// Like with Subscribe, the events published after Add returns are received, stored events aren't replayed.
+func (s *Subscription) Add(ctx context.Context, accountIDs ...int) error {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+
+	added := []int{}
+	s.mu.Lock()
+	for _, accountID := range accountIDs {
+		if _, ok := s.accounts[accountID]; !ok {
+			s.accounts[accountID] = struct{}{}
+			added = append(added, accountID)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	// the messaging bus subscription is already cleaned up
+	if err := s.ctx.Err(); err != nil {
+		s.forget(added)
+
+		return err
+	}
+
+	if err := s.add(ctx, added); err != nil {
+		s.forget(added)
+
+		return err
+	}
+
+	return nil
+}
+
+// Remove stops receiving the events of the accounts, accounts that aren't subscribed are skipped.
+//
+// At least one account has to stay subscribed, otherwise ErrNoAccounts is returned and nothing is removed.
+// Events of the removed accounts aren't delivered anymore, even if the messaging bus returns an error,
+// but one event that was already waiting to be received from the Events channel can still be received.
+func (s *Subscription) Remove(ctx context.Context, accountIDs ...int) error {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+
+	removed := []int{}
+	s.mu.Lock()
+	remaining := len(s.accounts)
+	for _, accountID := range accountIDs {
+		if _, ok := s.accounts[accountID]; ok {
+			remaining--
+			removed = append(removed, accountID)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if remaining == 0 {
+		return ErrNoAccounts
+	}
+
+	// events that are already on their way aren't delivered once the accounts are forgotten
+	s.forget(removed)
+
+	return s.remove(ctx, removed)
+}
+
+// Close ends the subscription and waits until its resources are released.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// deliver deserializes the payload and sends the event at the cursor position to the Events channel.
+// Payloads that can't be deserialized are reported as errors and skipped.
+//
+// Returns false if the subscription ended before the event was received.
+func (s *Subscription) deliver(payload []byte, cursor string) bool {
+	event := &Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		log.Warn().Msgf("error while deserializing event, skipping it: %v", err)
+		s.report(StatusError, err)
+
+		return true
+	}
+	event.Cursor = cursor
+
+	// the event could have been received before its account was removed from the messaging bus subscription
+	if !s.subscribed(event.AccountID) {
+		return true
+	}
+
+	select {
+	case s.events <- event:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// subscribed checks if the events of the account are received.
+func (s *Subscription) subscribed(accountID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.accounts[accountID]
+
+	return ok
+}
+
+// forget removes the accounts, so their events aren't delivered anymore.
+func (s *Subscription) forget(accountIDs []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, accountID := range accountIDs {
+		delete(s.accounts, accountID)
+	}
+}
+
+// report sends the status change to the Status channel, it is dropped if the channel is full.
+func (s *Subscription) report(statusType string, err error) {
+	select {
+	case s.status <- &Status{Type: statusType, Timestamp: time.Now().UTC(), Err: err}:
+	default:
+		log.Warn().Msgf("status buffer is full, dropping %s status", statusType)
+	}
+}
+
+// finish closes the Events and Status channels and marks the subscription as done,
+// it has to be called after the cleanup.
+func (s *Subscription) finish() {
+	close(s.events)
+	close(s.status)
+	close(s.done)
+}